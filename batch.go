@@ -0,0 +1,219 @@
+package cqlstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/sessions"
+)
+
+// SaveBatch saves several sessions at once, like calling Save for each of
+// them. With the default unlogged batch type of WithBatchType the sessions
+// are written concurrently, each with its own statement, because an unlogged
+// batch spanning partitions can be written for some sessions and not others
+// without saying which. With a logged batch they are written in a single
+// batch, which Cassandra applies to all of them or to none; if it fails
+// SaveBatch returns its error and no session gets a cookie.
+//
+// Sessions that can not be saved, because BeforeSave or the validator set
+// with WithValuesValidator rejects them or because their write failed, are
+// reported in a BatchError. The other sessions are saved and get their
+// cookies.
+//
+// A logged batch holds one partition per session so Cassandra warns about
+// large ones; save a handful of sessions at a time. SaveBatch can not be used
+// with WithOptimisticLocking, since the conditional writes of a batch must
+// all be to one partition, nor with WithClusteringByUpdatedAt, WithUserIndex
+// or WithMinReissueAge, which read and write other rows for every save.
+func (st *CQLStore) SaveBatch(r *http.Request, w http.ResponseWriter, ss ...*sessions.Session) error {
+	if headersSent(w) {
+		return saveError{ErrHeadersAlreadySent}
+	}
+	if st.locking || st.recentBuckets > 0 || st.userKey != nil || st.reissueAge > 0 {
+		return saveError{errors.New("SaveBatch can not be used with WithOptimisticLocking, " +
+			"WithClusteringByUpdatedAt, WithUserIndex or WithMinReissueAge")}
+	}
+
+	ctx := st.queryContext()
+	stmts := make([]batchStmt, len(ss))
+	errs := make([]error, len(ss))
+	for i, s := range ss {
+		stmts[i], errs[i] = st.batchSave(ctx, r, s)
+	}
+
+	if st.batchType == gocql.UnloggedBatch {
+		var wg sync.WaitGroup
+		for i, s := range ss {
+			if errs[i] != nil || stmts[i].stmt == "" {
+				continue
+			}
+			wg.Add(1)
+			go func(i int, s *sessions.Session) {
+				defer wg.Done()
+				if err := st.rowQuery(ctx, s.ID, stmts[i].stmt, stmts[i].args...).Exec(); err != nil {
+					errs[i] = saveError{err}
+				}
+			}(i, s)
+		}
+		wg.Wait()
+	} else {
+		b := st.batch(ctx)
+		batched := 0
+		for i := range ss {
+			if errs[i] == nil && stmts[i].stmt != "" {
+				b.Query(stmts[i].stmt, stmts[i].args...)
+				batched++
+			}
+		}
+		if batched > 0 {
+			if err := b.Exec(); err != nil {
+				for i, s := range ss {
+					if errs[i] == nil {
+						st.uncache(s.ID)
+					}
+				}
+				return saveError{err}
+			}
+		}
+	}
+
+	var failed BatchError
+	for i, s := range ss {
+		err := errs[i]
+		if stmts[i].stmt != "" {
+			st.uncache(s.ID)
+		}
+		if err == nil {
+			stmts[i].finish()
+			err = st.setCookie(w, s)
+		}
+		if err != nil {
+			failed.Failures = append(failed.Failures, SaveFailure{ID: s.ID, Name: s.Name(), Err: err})
+		}
+	}
+	if failed.Failures != nil {
+		failed.Total = len(ss)
+		return failed
+	}
+
+	return nil
+}
+
+// batchStmt is the statement SaveBatch runs for a session, if any, and what
+// is left to do once it was run.
+type batchStmt struct {
+	stmt   string
+	args   []interface{}
+	finish func()
+}
+
+// batchSave prepares the statement saving s, or deleting it, for SaveBatch.
+func (st *CQLStore) batchSave(ctx context.Context, r *http.Request, s *sessions.Session) (batchStmt, error) {
+	if err := st.checkSave(s); err != nil {
+		return batchStmt{}, err
+	}
+
+	if s.Options.MaxAge < 0 {
+		deleted := func() {
+			st.deleted.Add(1)
+			if st.AfterDelete != nil {
+				st.AfterDelete(s)
+			}
+		}
+		if s.ID == "" {
+			// Never saved so there is nothing to delete
+			return batchStmt{finish: deleted}, nil
+		}
+		stmt, args := st.deleteStmt(s.ID, s.Name())
+		return batchStmt{stmt, args, deleted}, nil
+	}
+
+	existing, err := st.beginSave(r, s)
+	if err != nil {
+		return batchStmt{}, err
+	}
+	encData, err := st.encodeSession(ctx, s, existing, existing)
+	if err != nil {
+		return batchStmt{}, err
+	}
+
+	ttl := st.rowTTL(s.Name())
+	if ceiling := st.ceiling(); ttl > ceiling {
+		ttl = ceiling
+	}
+	cols, vals, fields, err := st.rowColumns(s, encData, st.now())
+	if err != nil {
+		return batchStmt{}, saveError{err}
+	}
+	stmt, args := st.insert(s, cols, vals, ttl)
+
+	return batchStmt{stmt, args, func() {
+		if st.changeDetection {
+			s.Values[metaStored] = row{data: encData, fields: fields}
+		}
+		st.finishSave(ctx, s, existing)
+	}}, nil
+}
+
+// SaveFailure describes a session SaveBatch could not save. ID is empty for a
+// new session whose BeforeSave hook failed.
+type SaveFailure struct {
+	ID   string
+	Name string
+	Err  error
+}
+
+// BatchError is returned by SaveBatch when some of its sessions could not be
+// saved. Sessions that are not listed were saved.
+type BatchError struct {
+	Failures []SaveFailure
+	Total    int
+}
+
+func (e BatchError) Error() string {
+	return fmt.Sprintf("Could not save %d of %d sessions. First error: %s",
+		len(e.Failures), e.Total, e.Failures[0].Err)
+}
+
+// IDs returns the IDs of the sessions that could not be saved.
+func (e BatchError) IDs() []string {
+	ids := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		ids[i] = f.ID
+	}
+	return ids
+}
+
+// DeleteBatch deletes the sessions with the given IDs, every session using
+// the ID with WithNameInKey, in a single batch of the type set with
+// WithBatchType. It is cheaper than deleting each one when logging out many
+// sessions at once, but the rows are deleted without WithExpireDelete, hooks
+// are not called and entries of the WithClusteringByUpdatedAt and
+// WithUserIndex tables are left until they expire.
+func (st *CQLStore) DeleteBatch(ids ...string) error {
+	if st.readOnly {
+		return saveError{ErrReadOnly}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	b := st.batch(st.queryContext())
+	for _, id := range ids {
+		where, args := st.where(id, "")
+		b.Query(`DELETE FROM "`+st.table+`" WHERE `+where, args...)
+	}
+	if err := b.Exec(); err != nil {
+		return saveError{err}
+	}
+
+	for _, id := range ids {
+		st.uncache(id)
+	}
+	st.deleted.Add(uint64(len(ids)))
+	return nil
+}
@@ -0,0 +1,201 @@
+package cqlstore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/sessions"
+)
+
+func TestSaveBatchReportsFailedSessions(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{
+		"00000000-0000-0000-0000-000000000001",
+		"00000000-0000-0000-0000-000000000002",
+		"00000000-0000-0000-0000-000000000003",
+	}
+	sessionsFor := func() []*sessions.Session {
+		var ss []*sessions.Session
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		for i, id := range ids {
+			s, _ := store.New(r, "sess-"+string(rune('a'+i)))
+			s.ID = id
+			ss = append(ss, s)
+		}
+		return ss
+	}
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+
+	// The second session is rejected before anything is written
+	errRejected := errors.New("rejected")
+	store.BeforeSave = func(s *sessions.Session) error {
+		if s.ID == ids[1] {
+			return errRejected
+		}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	err = store.SaveBatch(r, w, sessionsFor()...)
+
+	var batchErr BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected a BatchError, got %v", err)
+	}
+	if want := []string{ids[1]}; !reflect.DeepEqual(want, batchErr.IDs()) {
+		t.Errorf("expected failed IDs %v, got %v", want, batchErr.IDs())
+	}
+	if !errors.Is(batchErr.Failures[0].Err, errRejected) {
+		t.Errorf("expected the failure to wrap the hook's error, got %v", batchErr.Failures[0].Err)
+	}
+
+	// The others were saved and got cookies
+	rows := db.rows("sessions")
+	for i, id := range ids {
+		if _, ok := rows[id]; ok != (i != 1) {
+			t.Errorf("expected session %s to be saved %v, got %v", id, i != 1, ok)
+		}
+	}
+	if n := len(w.Header()["Set-Cookie"]); n != 2 {
+		t.Errorf("expected 2 cookies, got %d", n)
+	}
+
+	// Only the session whose write failed is reported
+	store.BeforeSave = nil
+	errDown := errors.New("node is down")
+	db.fail = func(stmt string, args []interface{}) error {
+		if strings.HasPrefix(stmt, "INSERT") && args[0] == ids[2] {
+			return errDown
+		}
+		return nil
+	}
+
+	w = httptest.NewRecorder()
+	err = store.SaveBatch(r, w, sessionsFor()...)
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected a BatchError, got %v", err)
+	}
+	if want := []string{ids[2]}; !reflect.DeepEqual(want, batchErr.IDs()) {
+		t.Errorf("expected failed IDs %v, got %v", want, batchErr.IDs())
+	}
+	if !errors.Is(batchErr.Failures[0].Err, errDown) {
+		t.Errorf("expected the failure to wrap the database error, got %v", batchErr.Failures[0].Err)
+	}
+	if n := len(w.Header()["Set-Cookie"]); n != 2 {
+		t.Errorf("expected 2 cookies, got %d", n)
+	}
+	if n := len(db.batchTypes()); n != 0 {
+		t.Errorf("expected no batches, got %d", n)
+	}
+}
+
+func TestSaveBatchLoggedFailure(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...), WithBatchType(gocql.LoggedBatch))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	var ss []*sessions.Session
+	for i := 0; i < 2; i++ {
+		s, _ := store.New(r, "test-sess")
+		ss = append(ss, s)
+	}
+
+	// A logged batch fails as a whole, which is not blamed on any session
+	errDown := errors.New("node is down")
+	db.fail = func(stmt string, args []interface{}) error {
+		return errDown
+	}
+	w := httptest.NewRecorder()
+	err = store.SaveBatch(r, w, ss...)
+	var batchErr BatchError
+	if errors.As(err, &batchErr) || !errors.Is(err, errDown) {
+		t.Errorf("expected the batch's error, got %v", err)
+	}
+	if n := len(w.Header()["Set-Cookie"]); n != 0 {
+		t.Errorf("expected no cookies, got %d", n)
+	}
+}
+
+func TestSaveBatchRejectsLocking(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...), WithOptimisticLocking())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	s, _ := store.New(r, "test-sess")
+	if err := store.SaveBatch(r, httptest.NewRecorder(), s); err == nil {
+		t.Error("expected SaveBatch to refuse WithOptimisticLocking")
+	}
+	if s.ID != "" {
+		t.Errorf("expected nothing to be saved, got ID %q", s.ID)
+	}
+}
+
+func TestBatchType(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts []Option
+		want gocql.BatchType
+	}{
+		{"default", nil, gocql.UnloggedBatch},
+		{"logged", []Option{WithBatchType(gocql.LoggedBatch)}, gocql.LoggedBatch},
+	} {
+		db := newFakeDB()
+		store, err := newStore(db, "sessions", append([]Option{WithKeyPairs(testKeys...)}, tt.opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []string
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		for i := 0; i < 3; i++ {
+			s, _ := store.New(r, "test-sess")
+			if err := s.Save(r, httptest.NewRecorder()); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, s.ID)
+		}
+
+		if err := store.DeleteBatch(ids[:2]...); err != nil {
+			t.Fatal(err)
+		}
+		if types := db.batchTypes(); !reflect.DeepEqual(types, []gocql.BatchType{tt.want}) {
+			t.Errorf("%s: expected one batch of type %v, got %v", tt.name, tt.want, types)
+		}
+
+		s, _ := store.New(r, "test-sess")
+		if err := store.SaveBatch(r, httptest.NewRecorder(), s); err != nil {
+			t.Fatal(err)
+		}
+		// Unlogged saves are sent one by one
+		want := []gocql.BatchType{tt.want}
+		if tt.want == gocql.LoggedBatch {
+			want = append(want, tt.want)
+		}
+		if types := db.batchTypes(); !reflect.DeepEqual(types, want) {
+			t.Errorf("%s: expected batches %v, got %v", tt.name, want, types)
+		}
+		ids = append(ids, s.ID)
+
+		rows := db.rows("sessions")
+		for i, id := range ids {
+			if _, ok := rows[id]; ok != (i >= 2) {
+				t.Errorf("%s: expected session %d to exist %v, got %v", tt.name, i, i >= 2, ok)
+			}
+		}
+	}
+}
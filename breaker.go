@@ -0,0 +1,176 @@
+package cqlstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// ErrCircuitOpen is returned by New and Save, wrapped in their usual errors,
+// when WithCircuitBreaker is used and the database has been failing. No query
+// is sent while the circuit is open.
+var ErrCircuitOpen = errors.New("Circuit breaker is open")
+
+// breaker tracks consecutive query failures for WithCircuitBreaker. It opens
+// after failures consecutive failures and stays open for cooldown. After that
+// a single query is let through as a probe. If the probe succeeds the breaker
+// closes, otherwise it opens again for another cooldown. The cooldown is
+// measured with now, which is the wall clock rather than the store's clock so
+// a stopped or faked clock can not keep the breaker open.
+type breaker struct {
+	failures int
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	count    int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether a query may run now.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.count < b.failures {
+		return true
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// done records the result of a query that was allowed. A query cancelled or
+// timed out by its context says nothing about the database so it counts as
+// neither a success nor a failure, and a probe ending that way lets the next
+// query probe instead.
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	if err == nil || errors.Is(err, gocql.ErrNotFound) {
+		b.count = 0
+		return
+	}
+
+	b.count++
+	if b.count >= b.failures {
+		b.openedAt = b.now()
+	}
+}
+
+// breakerQuery runs a query through the store's breaker.
+type breakerQuery struct {
+	query
+	b *breaker
+}
+
+func (q breakerQuery) run(fn func() error) error {
+	if !q.b.allow() {
+		return ErrCircuitOpen
+	}
+	err := fn()
+	q.b.done(err)
+	return err
+}
+
+func (q breakerQuery) Exec() error {
+	return q.run(q.query.Exec)
+}
+
+func (q breakerQuery) Scan(dest ...interface{}) error {
+	return q.run(func() error { return q.query.Scan(dest...) })
+}
+
+func (q breakerQuery) MapScanCAS(dest map[string]interface{}) (bool, error) {
+	var applied bool
+	err := q.run(func() error {
+		var err error
+		applied, err = q.query.MapScanCAS(dest)
+		return err
+	})
+	return applied, err
+}
+
+func (q breakerQuery) Iter() iter {
+	if !q.b.allow() {
+		return openIter{}
+	}
+	return breakerIter{q.query.Iter(), q.b}
+}
+
+func (q breakerQuery) Observer(o gocql.QueryObserver) query {
+	return breakerQuery{q.query.Observer(o), q.b}
+}
+
+func (q breakerQuery) RoutingKey(key []byte) query {
+	return breakerQuery{q.query.RoutingKey(key), q.b}
+}
+
+func (q breakerQuery) WithContext(ctx context.Context) query {
+	return breakerQuery{q.query.WithContext(ctx), q.b}
+}
+
+func (q breakerQuery) Consistency(c gocql.Consistency) query {
+	return breakerQuery{q.query.Consistency(c), q.b}
+}
+
+func (q breakerQuery) PageSize(n int) query {
+	return breakerQuery{q.query.PageSize(n), q.b}
+}
+
+func (q breakerQuery) PageState(state []byte) query {
+	return breakerQuery{q.query.PageState(state), q.b}
+}
+
+// breakerBatch runs a batch through the store's breaker.
+type breakerBatch struct {
+	batch
+	b *breaker
+}
+
+func (b breakerBatch) Exec() error {
+	if !b.b.allow() {
+		return ErrCircuitOpen
+	}
+	err := b.batch.Exec()
+	b.b.done(err)
+	return err
+}
+
+func (b breakerBatch) WithContext(ctx context.Context) batch {
+	return breakerBatch{b.batch.WithContext(ctx), b.b}
+}
+
+func (b breakerBatch) Observer(o gocql.BatchObserver) batch {
+	return breakerBatch{b.batch.Observer(o), b.b}
+}
+
+// breakerIter records the result of an iterator once it is closed.
+type breakerIter struct {
+	iter
+	b *breaker
+}
+
+func (i breakerIter) Close() error {
+	err := i.iter.Close()
+	i.b.done(err)
+	return err
+}
+
+// openIter is returned instead of running a query while the breaker is open.
+type openIter struct{}
+
+func (openIter) Scan(dest ...interface{}) bool { return false }
+func (openIter) PageState() []byte             { return nil }
+func (openIter) Close() error                  { return ErrCircuitOpen }
@@ -0,0 +1,126 @@
+package cqlstore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	db := newFakeDB()
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithCircuitBreaker(3, time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.breaker.now = func() time.Time { return now }
+
+	save := func() error {
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, _ := store.New(r, "test-sess")
+		return sess.Save(r, httptest.NewRecorder())
+	}
+
+	// Fail enough queries in a row to open the breaker
+	errDown := errors.New("database is down")
+	db.fail = func(stmt string, args []interface{}) error { return errDown }
+	for i := 0; i < 3; i++ {
+		if err := save(); !errors.Is(err, errDown) {
+			t.Fatalf("expected save %d to fail with the database error, got %v", i+1, err)
+		}
+	}
+
+	// While open nothing reaches the database
+	ran := len(db.statements())
+	if err := save(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if n := len(db.statements()); n != ran {
+		t.Errorf("expected no queries while the breaker is open, got %d", n-ran)
+	}
+
+	// After the cooldown a failing probe opens it again
+	now = now.Add(time.Minute)
+	if err := save(); !errors.Is(err, errDown) {
+		t.Fatalf("expected the probe to fail with the database error, got %v", err)
+	}
+	if err := save(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen after a failed probe, got %v", err)
+	}
+
+	// A successful probe closes it
+	now = now.Add(time.Minute)
+	db.fail = nil
+	if err := save(); err != nil {
+		t.Fatalf("expected the probe to succeed, got %v", err)
+	}
+	if err := save(); err != nil {
+		t.Fatalf("expected saves to work once the breaker closes, got %v", err)
+	}
+}
+
+func TestCircuitBreakerSurvivesQueryBuilders(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithCircuitBreaker(1, time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.fail = func(stmt string, args []interface{}) error { return errors.New("database is down") }
+	if err := store.query(store.queryContext(), `SELECT "data" FROM "sessions" WHERE "id" = ?`, "a").Exec(); err == nil {
+		t.Fatal("expected the query to fail")
+	}
+
+	// Every way of changing a query must keep it going through the breaker
+	q := store.query(store.queryContext(), `SELECT "data" FROM "sessions" WHERE "id" = ?`, "a")
+	builders := map[string]query{
+		"WithContext": q.WithContext(context.Background()),
+		"RoutingKey":  q.RoutingKey([]byte("a")),
+		"Consistency": q.Consistency(gocql.One),
+		"PageSize":    q.PageSize(10),
+		"PageState":   q.PageState(nil),
+		"Observer":    q.Observer(nil),
+	}
+	for name, q := range builders {
+		if err := q.Exec(); !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("%s: expected ErrCircuitOpen, got %v", name, err)
+		}
+		if _, ok := q.(breakerQuery); !ok {
+			t.Errorf("%s: expected a breakerQuery, got %T", name, q)
+		}
+	}
+}
+
+func TestCircuitBreakerIgnoresContextErrors(t *testing.T) {
+	b := &breaker{failures: 1, cooldown: time.Minute, now: time.Now}
+
+	for _, err := range []error{
+		context.Canceled,
+		context.DeadlineExceeded,
+		gocql.ErrNotFound,
+	} {
+		if !b.allow() {
+			t.Fatalf("expected the breaker to be closed before %v", err)
+		}
+		b.done(err)
+	}
+	if !b.allow() {
+		t.Fatal("expected context errors and gocql.ErrNotFound not to open the breaker")
+	}
+
+	b.done(errors.New("database is down"))
+	if b.allow() {
+		t.Error("expected a database error to open the breaker")
+	}
+}
@@ -0,0 +1,125 @@
+package cqlstore
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cache is a least recently used cache of loaded rows used by WithCache.
+// Entries are keyed by session ID and also hold the session name so a session
+// with a different name never gets another's row.
+type cache struct {
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type cacheEntry struct {
+	id     string
+	name   string
+	row    row
+	stored time.Time
+}
+
+func newCache(size int, ttl time.Duration) *cache {
+	return &cache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached row of session id with the given name if there is
+// one that is younger than the cache's ttl at time now.
+func (c *cache) get(id, name string, now time.Time) (row, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[id]; ok {
+		e := el.Value.(*cacheEntry)
+		if e.name == name && now.Sub(e.stored) < c.ttl {
+			c.ll.MoveToFront(el)
+			c.hits.Add(1)
+			return e.row, true
+		}
+		c.ll.Remove(el)
+		delete(c.items, id)
+	}
+
+	c.misses.Add(1)
+	return row{}, false
+}
+
+// add caches r as the row of session id with the given name, evicting the
+// least recently used entry if the cache is full.
+func (c *cache) add(id, name string, r row, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[id]; ok {
+		c.ll.Remove(el)
+	}
+	c.items[id] = c.ll.PushFront(&cacheEntry{id: id, name: name, row: r, stored: now})
+
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).id)
+	}
+}
+
+// remove forgets any cached row of session id.
+func (c *cache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[id]; ok {
+		c.ll.Remove(el)
+		delete(c.items, id)
+	}
+}
+
+// loadCached is load for New. With WithCache it uses and fills the cache.
+func (st *CQLStore) loadCached(ctx context.Context, id, name string) (row, error) {
+	if st.cache == nil {
+		return st.load(ctx, id, name)
+	}
+
+	now := st.now()
+	if r, ok := st.cache.get(id, name, now); ok {
+		return r, nil
+	}
+	r, err := st.load(ctx, id, name)
+	if err == nil && (st.MaxLoadSize <= 0 || r.size() <= st.MaxLoadSize) {
+		st.cache.add(id, name, r, now)
+	}
+	return r, err
+}
+
+// uncache forgets the cached row of session id after it is written or
+// deleted.
+func (st *CQLStore) uncache(id string) {
+	if st.cache != nil {
+		st.cache.remove(id)
+	}
+}
+
+// CacheStats reports how many times New found a session in the cache enabled
+// by WithCache and how many times it had to load one from the database. Both
+// are 0 without WithCache.
+func (st *CQLStore) CacheStats() (hits, misses uint64) {
+	if st.cache == nil {
+		return 0, 0
+	}
+	return st.cache.hits.Load(), st.cache.misses.Load()
+}
@@ -0,0 +1,67 @@
+package cqlstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheStats(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithCache(10, time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// save saves a new session and returns its cookies.
+	save := func() []*http.Cookie {
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, _ := store.New(r, "test-sess")
+		sess.Values["foo"] = "Foo"
+		w := httptest.NewRecorder()
+		if err := sess.Save(r, w); err != nil {
+			t.Fatal(err)
+		}
+		return (&http.Response{Header: w.Header()}).Cookies()
+	}
+
+	// get loads the session identified by cookies in a new request.
+	get := func(cookies []*http.Cookie) {
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		sess, err := store.Get(r, "test-sess")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sess.Values["foo"] != "Foo" {
+			t.Errorf("expected foo to be Foo, got %v", sess.Values["foo"])
+		}
+	}
+
+	first := save()
+	get(first)
+	get(first)
+	get(first)
+	if hits, misses := store.CacheStats(); hits != 2 || misses != 1 {
+		t.Errorf("expected 2 hits and 1 miss, got %d and %d", hits, misses)
+	}
+
+	// Loading the cached session does not query the database
+	before := len(db.statements())
+	get(first)
+	if n := len(db.statements()); n != before {
+		t.Errorf("expected a cache hit not to query, got %d queries", n-before)
+	}
+
+	// A session that was never loaded is a miss
+	get(save())
+	if hits, misses := store.CacheStats(); hits != 3 || misses != 2 {
+		t.Errorf("expected 3 hits and 2 misses, got %d and %d", hits, misses)
+	}
+}
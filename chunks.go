@@ -0,0 +1,75 @@
+package cqlstore
+
+import (
+	"bytes"
+	"sort"
+)
+
+// chunkedMarker is stored in the data column of sessions saved with
+// WithChunking whose data was split into the chunks column. The colon is not
+// part of the base64 alphabet securecookie uses so it can not be confused
+// with regular data.
+const chunkedMarker = "chunked:"
+
+// chunk splits the value of the data column into chunks of at most the size
+// set with WithChunking. It returns the value to store in the data column in
+// its place and the chunks, or data itself and no chunks if it is small
+// enough.
+func (st *CQLStore) chunk(data interface{}) (interface{}, map[int][]byte) {
+	var b []byte
+	switch d := data.(type) {
+	case string:
+		b = []byte(d)
+	case []byte:
+		b = d
+	}
+	if len(b) <= st.chunkSize {
+		return data, nil
+	}
+
+	chunks := make(map[int][]byte, len(b)/st.chunkSize+1)
+	for i := 0; len(b) > 0; i++ {
+		n := st.chunkSize
+		if n > len(b) {
+			n = len(b)
+		}
+		chunks[i] = b[:n]
+		b = b[n:]
+	}
+
+	if st.binary {
+		return []byte(chunkedMarker), chunks
+	}
+	return chunkedMarker, chunks
+}
+
+// unchunkData returns the value of the data column, scanned into data or
+// raw, joined with the chunks it was split into if the session was saved
+// with WithChunking.
+func (st *CQLStore) unchunkData(data string, raw []byte, chunks map[int][]byte) (string, []byte) {
+	if st.chunkSize == 0 {
+		return data, raw
+	}
+	if st.binary && string(raw) == chunkedMarker {
+		return data, unchunk(chunks)
+	}
+	if !st.binary && data == chunkedMarker {
+		return string(unchunk(chunks)), raw
+	}
+	return data, raw
+}
+
+// unchunk joins chunks made by chunk back together.
+func unchunk(chunks map[int][]byte) []byte {
+	keys := make([]int, 0, len(chunks))
+	for k := range chunks {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.Write(chunks[k])
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,103 @@
+package cqlstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChunking(t *testing.T) {
+	for _, binary := range []bool{false, true} {
+		opts := []Option{WithKeyPairs(testKeys...), WithChunking(256)}
+		if binary {
+			opts = append(opts, WithBinaryData())
+		}
+		db := newFakeDB()
+		store, err := newStore(db, "sessions", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		big := strings.Repeat("0123456789", 200)
+		req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, _ := store.New(req1, "test-sess")
+		sess.Values["big"] = big
+		w := httptest.NewRecorder()
+		if err := sess.Save(req1, w); err != nil {
+			t.Fatal(err)
+		}
+
+		row := db.rows("sessions")[sess.ID]
+		chunks := row["chunks"].(map[int][]byte)
+		if len(chunks) < 2 {
+			t.Errorf("binary %v: expected several chunks, got %d", binary, len(chunks))
+		}
+		for i, c := range chunks {
+			if len(c) > 256 {
+				t.Errorf("binary %v: chunk %d is %d bytes", binary, i, len(c))
+			}
+		}
+
+		req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+			req2.AddCookie(c)
+		}
+		sess2, err := store.New(req2, "test-sess")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sess2.Values["big"] != big {
+			t.Errorf("binary %v: expected the chunks to be joined again", binary)
+		}
+
+		// Small data is not chunked
+		sess2.Values = map[interface{}]interface{}{"small": "x"}
+		if err := sess2.Save(req2, httptest.NewRecorder()); err != nil {
+			t.Fatal(err)
+		}
+		if chunks := db.rows("sessions")[sess.ID]["chunks"].(map[int][]byte); chunks != nil {
+			t.Errorf("binary %v: expected no chunks for small data, got %d", binary, len(chunks))
+		}
+		sess3, err := store.New(req2, "test-sess")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sess3.Values["small"] != "x" {
+			t.Errorf("binary %v: expected to load the small session, got %v", binary, sess3.Values)
+		}
+	}
+}
+
+func TestChunkingExpireDelete(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithChunking(64),
+		WithExpireDelete(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	sess.Values["foo"] = strings.Repeat("Foo", 100)
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	sess.Options.MaxAge = -1
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewriting the row would leave the chunks behind
+	stmts := db.statements()
+	if last := stmts[len(stmts)-1]; !strings.HasPrefix(last, "DELETE") {
+		t.Errorf("expected the row to be deleted, got %s", last)
+	}
+	if n := len(db.rows("sessions")); n != 0 {
+		t.Errorf("expected no rows, got %d", n)
+	}
+}
@@ -0,0 +1,360 @@
+package cqlstore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// issuedSep separates the session ID from the time its cookie was issued in
+// the cookies of stores using WithMinReissueAge.
+const issuedSep = "|"
+
+// encodeID encodes a session ID for the session cookie. With
+// WithMinReissueAge the time issued is encoded along with it.
+func (st *CQLStore) encodeID(name, id string, issued time.Time) (string, error) {
+	if st.reissueAge > 0 {
+		id += issuedSep + strconv.FormatInt(issued.Unix(), 10)
+	}
+	codecs, _ := st.idCodecs()
+	return securecookie.EncodeMulti(name, id, codecs...)
+}
+
+// decodeID decodes a session cookie value into id and, with
+// WithMinReissueAge, the time the cookie was issued into issued. Cookies
+// issued without the option leave issued alone.
+func (st *CQLStore) decodeID(name, value string, id *string, issued *time.Time) error {
+	var v string
+	codecs, pairs := st.idCodecs()
+	if err := st.decodeMulti(name, value, &v, codecs, pairs); err != nil {
+		return err
+	}
+	*id = v
+
+	if st.reissueAge > 0 {
+		if i := strings.LastIndex(v, issuedSep); i >= 0 {
+			if sec, err := strconv.ParseInt(v[i+len(issuedSep):], 10, 64); err == nil {
+				*id = v[:i]
+				*issued = time.Unix(sec, 0)
+			}
+		}
+	}
+	return nil
+}
+
+// Encode encodes value with the store's Codecs the same way the store encodes
+// session data, so the result can be decoded by Decode on any store with the
+// same keys.
+func (st *CQLStore) Encode(name string, value interface{}) (string, error) {
+	st.syncCodecMaxAge()
+
+	st.mu.RLock()
+	codecs := st.Codecs
+	st.mu.RUnlock()
+
+	encoded, err := securecookie.EncodeMulti(name, value, codecs...)
+	return encoded, explainGobError(err)
+}
+
+// Decode decodes a value made by Encode into dst, which must be a pointer.
+// The name must be the same that was given to Encode.
+func (st *CQLStore) Decode(name, encoded string, dst interface{}) error {
+	st.syncCodecMaxAge()
+
+	st.mu.RLock()
+	codecs, pairs := st.Codecs, st.codecPairs
+	st.mu.RUnlock()
+
+	return explainGobError(st.decodeMulti(name, encoded, dst, codecs, pairs))
+}
+
+// DecodeID decodes the value of the session cookie called name and returns the
+// session ID it holds, without loading the session. A valid ID only means the
+// cookie was made with the store's keys, the session may have expired or been
+// deleted since. It returns ErrInvalidCookie if the value can not be decoded
+// or does not hold an ID the store could have made.
+func (st *CQLStore) DecodeID(name, cookieValue string) (string, error) {
+	var id string
+	var issued time.Time
+	if err := st.decodeID(name, cookieValue, &id, &issued); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidCookie, err)
+	}
+	if !st.validID(id) {
+		return "", ErrInvalidCookie
+	}
+	return id, nil
+}
+
+// encodeData encodes session values for storage.
+func (st *CQLStore) encodeData(name string, values map[interface{}]interface{}) (string, error) {
+	if st.fieldEncryption {
+		// The values are encoded separately when they are saved
+		return fieldsMarker, nil
+	}
+	codecs, _ := st.dataCodecs(name)
+	encData, err := securecookie.EncodeMulti(name, values, codecs...)
+	return encData, explainGobError(err)
+}
+
+// decodeData decodes stored session data into values.
+func (st *CQLStore) decodeData(name, data string, values *map[interface{}]interface{}) error {
+	codecs, pairs := st.dataCodecs(name)
+	return explainGobError(st.decodeMulti(name, data, values, codecs, pairs))
+}
+
+// decodeMulti is like securecookie.DecodeMulti but records the key pair of the
+// codec that decoded value. pairs holds the key pair of each of codecs.
+func (st *CQLStore) decodeMulti(name, value string, dst interface{}, codecs []securecookie.Codec, pairs []int) error {
+	if len(codecs) == 0 {
+		return securecookie.DecodeMulti(name, value, dst)
+	}
+
+	var errs securecookie.MultiError
+	for i, c := range codecs {
+		err := c.Decode(name, value, dst)
+		if err == nil {
+			st.hits.add(pairOf(pairs, i))
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// pairOf returns the key pair of the i-th codec given the pairs of the
+// codecs. Codecs set directly rather than through Options, AddCodec or
+// AddKeyPair have no pairs and are counted by their index.
+func pairOf(pairs []int, i int) int {
+	if i < len(pairs) {
+		return pairs[i]
+	}
+	return i
+}
+
+// codecHits counts successful decodes by the key pair of the codec that
+// decoded. The codecs made from a key pair for encrypting and for only
+// signing share it. Pairs are numbered in the order they were given to the
+// store so they stay put when codecs are added in front.
+type codecHits struct {
+	mu   sync.Mutex
+	hits map[int]uint64
+}
+
+func (h *codecHits) add(pair int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.hits == nil {
+		h.hits = make(map[int]uint64)
+	}
+	h.hits[pair]++
+}
+
+// CodecHits reports how many session ID cookies and stored sessions each of the
+// store's codecs has decoded, indexed like Codecs. Each successful decode is
+// counted once, for the first codec that could decode it. While keys are being
+// rotated this shows how much is still only readable with an old key. Once
+// nothing is counted past index 0 the older keys can be retired. Decodes by the
+// codec made from the same key pair for WithSignOnly or SetEncryption(false)
+// are counted with it, and the counts of existing codecs move with them when
+// AddCodec or AddKeyPair adds one in front.
+func (st *CQLStore) CodecHits() []uint64 {
+	st.mu.RLock()
+	n, pairs := len(st.Codecs), st.codecPairs
+	st.mu.RUnlock()
+
+	st.hits.mu.Lock()
+	defer st.hits.mu.Unlock()
+
+	hits := make([]uint64, n)
+	for i := range hits {
+		hits[i] = st.hits.hits[pairOf(pairs, i)]
+	}
+	return hits
+}
+
+// dataCodecs returns the codecs used for the stored data of sessions with the
+// given name along with their key pairs.
+func (st *CQLStore) dataCodecs(name string) ([]securecookie.Codec, []int) {
+	st.syncCodecMaxAge()
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	if st.unencrypted[name] {
+		return st.signedCodecs, st.signedPairs
+	}
+	return st.Codecs, st.codecPairs
+}
+
+// idCodecs returns the codecs used for session cookies along with their key
+// pairs.
+func (st *CQLStore) idCodecs() ([]securecookie.Codec, []int) {
+	st.syncCodecMaxAge()
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	if st.cookieCodecs != nil {
+		return st.cookieCodecs, st.signedPairs
+	}
+	return st.Codecs, st.codecPairs
+}
+
+// AddCodec adds c to the front of the store's Codecs so it is used to encode
+// everything from now on while the existing codecs can still decode what they
+// encoded. This allows keys to be rotated without restarting. It is safe to
+// call while the store is in use, unlike modifying Codecs directly. A
+// *securecookie.SecureCookie is given the store's serializer, MaxAge and
+// MaxLength first, like the codecs made from WithKeyPairs.
+//
+// The store can not tell the keys of c so it can not make the codecs that
+// only sign from it. Stores using WithSignOnly or SetEncryption(false) need
+// those, use AddKeyPair with them instead.
+func (st *CQLStore) AddCodec(c securecookie.Codec) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.configureCodec(c)
+	st.Codecs = prependCodec(c, st.Codecs)
+	st.codecPairs = prependPair(st.nextPair(), st.codecPairs)
+}
+
+// AddKeyPair is like AddCodec for a codec made from hashKey and blockKey, as
+// they would be given to WithKeyPairs. Unlike AddCodec it also adds a codec
+// made from hashKey alone for WithSignOnly and SetEncryption(false), so keys
+// can be rotated for every session. It returns ErrInvalidKey if the keys can
+// not be used.
+func (st *CQLStore) AddKeyPair(hashKey, blockKey []byte) error {
+	pair := [][]byte{hashKey, blockKey}
+	if err := validateKeyPairs(pair); err != nil {
+		return err
+	}
+	c := securecookie.CodecsFromPairs(pair...)[0]
+	signed := signOnlyCodecs(pair)[0]
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.configureCodec(c)
+	st.configureCodec(signed)
+	st.Codecs = prependCodec(c, st.Codecs)
+	st.signedCodecs = prependCodec(signed, st.signedCodecs)
+	if st.signOnly {
+		st.cookieCodecs = st.signedCodecs
+	}
+	p := st.nextPair()
+	st.codecPairs = prependPair(p, st.codecPairs)
+	st.signedPairs = prependPair(p, st.signedPairs)
+	st.keyPairs = append(pair, st.keyPairs...)
+	return nil
+}
+
+// configureCodec applies the store's settings to a codec added after the store
+// was created. The caller must hold st.mu.
+func (st *CQLStore) configureCodec(c securecookie.Codec) {
+	codec, ok := c.(*securecookie.SecureCookie)
+	if !ok {
+		return
+	}
+	if st.serializer != nil {
+		codec.SetSerializer(st.serializer)
+	}
+	if st.syncedAge > 0 {
+		codec.MaxAge(st.syncedAge)
+	}
+	codec.MaxLength(st.maxLength)
+}
+
+// updateCodecs replaces each *securecookie.SecureCookie the store uses with a
+// copy changed by fn. Codecs are never changed once in use since sessions are
+// encoded and decoded with them without holding st.mu. The caller must hold
+// st.mu, except while the store is configured.
+func (st *CQLStore) updateCodecs(fn func(codec *securecookie.SecureCookie)) {
+	st.Codecs = updatedCodecs(st.Codecs, fn)
+	st.signedCodecs = updatedCodecs(st.signedCodecs, fn)
+	if st.cookieCodecs != nil {
+		st.cookieCodecs = st.signedCodecs
+	}
+}
+
+// updatedCodecs returns a new slice of codecs with copies of the
+// *securecookie.SecureCookie ones changed by fn.
+func updatedCodecs(codecs []securecookie.Codec, fn func(codec *securecookie.SecureCookie)) []securecookie.Codec {
+	updated := make([]securecookie.Codec, len(codecs))
+	for i, c := range codecs {
+		if codec, ok := c.(*securecookie.SecureCookie); ok {
+			cp := *codec
+			fn(&cp)
+			c = &cp
+		}
+		updated[i] = c
+	}
+	return updated
+}
+
+// prependCodec returns a new slice holding c followed by codecs, so slices
+// already handed out are left alone.
+func prependCodec(c securecookie.Codec, codecs []securecookie.Codec) []securecookie.Codec {
+	return append(append(make([]securecookie.Codec, 0, len(codecs)+1), c), codecs...)
+}
+
+// prependPair is prependCodec for the key pairs of codecs.
+func prependPair(p int, pairs []int) []int {
+	return append(append(make([]int, 0, len(pairs)+1), p), pairs...)
+}
+
+// nextPair returns the number of a new key pair. The caller must hold st.mu.
+func (st *CQLStore) nextPair() int {
+	p := len(st.codecPairs)
+	if len(st.signedPairs) > p {
+		p = len(st.signedPairs)
+	}
+	return p
+}
+
+// numberPairs returns the pairs 0 to n-1 of n codecs made from the store's
+// key pairs in order.
+func numberPairs(n int) []int {
+	pairs := make([]int, n)
+	for i := range pairs {
+		pairs[i] = i
+	}
+	return pairs
+}
+
+// signOnlyCodecs builds codecs from the hash keys of keyPairs, leaving out the
+// block keys.
+func signOnlyCodecs(keyPairs [][]byte) []securecookie.Codec {
+	var hashKeys [][]byte
+	for i := 0; i < len(keyPairs); i += 2 {
+		hashKeys = append(hashKeys, keyPairs[i], nil)
+	}
+	return securecookie.CodecsFromPairs(hashKeys...)
+}
+
+// validateKeyPairs checks that keyPairs are pairs of a hash key and a block key
+// of lengths securecookie can use safely.
+func validateKeyPairs(keyPairs [][]byte) error {
+	if len(keyPairs) == 0 {
+		return fmt.Errorf("%w: at least one hash key and block key pair is required", ErrInvalidKey)
+	}
+	if len(keyPairs)%2 != 0 {
+		return fmt.Errorf("%w: got %d keys but keys must come in hash key and block key pairs, "+
+			"use a nil block key to only authenticate", ErrInvalidKey, len(keyPairs))
+	}
+	for i := 0; i < len(keyPairs); i += 2 {
+		if n := len(keyPairs[i]); n != 32 && n != 64 {
+			return fmt.Errorf("%w: hash key %d is %d bytes but must be 32 or 64", ErrInvalidKey, i/2+1, n)
+		}
+		block := keyPairs[i+1]
+		if n := len(block); block != nil && n != 16 && n != 24 && n != 32 {
+			return fmt.Errorf("%w: block key %d is %d bytes but must be 16, 24 or 32 or nil", ErrInvalidKey, i/2+1, n)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,677 @@
+package cqlstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+func TestInvalidKeys(t *testing.T) {
+	hashKey := []byte("0123456789abcdef0123456789abcdef")
+
+	tests := []struct {
+		name string
+		keys [][]byte
+	}{
+		{"no keys", nil},
+		{"odd number of keys", [][]byte{hashKey}},
+		{"short hash key", [][]byte{[]byte("foo-bar-baz"), nil}},
+		{"short block key", [][]byte{hashKey, []byte("too-short")}},
+		{"bad second pair", [][]byte{hashKey, nil, hashKey, []byte("0123456789abcdef0")}},
+	}
+
+	for _, tt := range tests {
+		_, err := newStore(newFakeDB(), "sessions", WithKeyPairs(tt.keys...))
+		if !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("%s: expected ErrInvalidKey, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestValidKeys(t *testing.T) {
+	hashKey := []byte("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	for _, block := range [][]byte{nil, make([]byte, 16), make([]byte, 24), make([]byte, 32)} {
+		if _, err := newStore(newFakeDB(), "sessions", WithKeyPairs(hashKey, block)); err != nil {
+			t.Errorf("expected a %d byte block key to be valid, got %v", len(block), err)
+		}
+	}
+}
+
+// rawCodec is a securecookie.Codec that gob encodes values without base64
+// encoding them, producing strings that are not valid UTF-8.
+type rawCodec struct{}
+
+func (rawCodec) Encode(name string, value interface{}) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(0xff)
+	err := gob.NewEncoder(&buf).Encode(value)
+	return buf.String(), err
+}
+
+func (rawCodec) Decode(name, value string, dst interface{}) error {
+	return gob.NewDecoder(bytes.NewBufferString(value[1:])).Decode(dst)
+}
+
+func TestNonUTF8DataRoundTrips(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Codecs = append(store.Codecs[:0:0], rawCodec{})
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	sess.Values["name"] = "Zoë"
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The text column only ever gets valid UTF-8
+	for _, row := range db.rows("sessions") {
+		if data := row["data"].(string); !utf8.ValidString(data) {
+			t.Fatalf("expected stored data to be valid UTF-8, got %q", data)
+		}
+	}
+
+	loaded, err := store.load(store.queryContext(), sess.ID, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[interface{}]interface{})
+	if err := store.decodeData("test-sess", loaded.data, &values); err != nil {
+		t.Fatal(err)
+	}
+	if values["name"] != "Zoë" {
+		t.Errorf("expected name to be Zoë, got %v", values["name"])
+	}
+}
+
+// encodeAt encodes value like a securecookie codec without a block key would
+// have at time at.
+func encodeAt(hashKey []byte, name string, value interface{}, at time.Time) string {
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(value)
+	b := []byte(fmt.Sprintf("%s|%d|%s|", name, at.Unix(), base64.URLEncoding.EncodeToString(buf.Bytes())))
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write(b[:len(b)-1])
+	b = append(b, mac.Sum(nil)...)[len(name)+1:]
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+func TestCodecMaxAgeFollowsStoreMaxAge(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.MaxAge(86400 * 90)
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend the session was saved 40 days ago, past securecookie's default
+	// MaxAge of 30 days.
+	saved := time.Now().Add(-40 * 24 * time.Hour)
+	values := map[interface{}]interface{}{"foo": "Foo"}
+	for _, row := range db.rows("sessions") {
+		row["data"] = encodeAt(testKeys[0], "test-sess", values, saved)
+	}
+
+	r2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	r2.AddCookie(&http.Cookie{Name: "test-sess", Value: encodeAt(testKeys[0], "test-sess", sess.ID, saved)})
+	sess2, err := store.New(r2, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess2.Values["foo"] != "Foo" {
+		t.Errorf("expected foo to be Foo, got %v", sess2.Values["foo"])
+	}
+
+	// A shorter codec MaxAge still rejects it
+	short, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithCodecMaxAge(30*24*time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short.MaxAge(86400 * 90)
+	if _, err := short.New(r2, "test-sess"); err == nil {
+		t.Error("expected the old cookie to be rejected with WithCodecMaxAge")
+	}
+}
+
+func TestCodecMaxAgeFollowsOptions(t *testing.T) {
+	saved := time.Now().Add(-40 * 24 * time.Hour)
+	values := map[interface{}]interface{}{"foo": "Foo"}
+
+	setters := map[string]func(st *CQLStore){
+		"Options": func(st *CQLStore) { st.Options.MaxAge = 86400 * 90 },
+		"SetOptions": func(st *CQLStore) {
+			opts := *st.Options
+			opts.MaxAge = 86400 * 90
+			st.SetOptions("test-sess", &opts)
+		},
+	}
+	for how, set := range setters {
+		db := newFakeDB()
+		store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		set(store)
+
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, _ := store.New(r, "test-sess")
+		if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range db.rows("sessions") {
+			row["data"] = encodeAt(testKeys[0], "test-sess", values, saved)
+		}
+
+		r2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		r2.AddCookie(&http.Cookie{Name: "test-sess", Value: encodeAt(testKeys[0], "test-sess", sess.ID, saved)})
+		sess2, err := store.New(r2, "test-sess")
+		if err != nil {
+			t.Fatalf("%s: %v", how, err)
+		}
+		if sess2.Values["foo"] != "Foo" {
+			t.Errorf("%s: expected foo to be Foo, got %v", how, sess2.Values["foo"])
+		}
+	}
+}
+
+func TestSetEncryption(t *testing.T) {
+	hashKey := []byte("0123456789abcdef0123456789abcdef")
+	blockKey := []byte("fedcba9876543210fedcba9876543210")
+
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(hashKey, blockKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetEncryption("prefs", false)
+
+	save := func(name string) (string, string) {
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, _ := store.New(r, name)
+		sess.Values["theme"] = "dark"
+		w := httptest.NewRecorder()
+		if err := sess.Save(r, w); err != nil {
+			t.Fatal(err)
+		}
+		return sess.ID, w.Header().Get("Set-Cookie")
+	}
+	prefsID, prefsCookie := save("prefs")
+	authID, _ := save("auth")
+
+	// Only the hash key is needed to read the prefs session
+	signer := securecookie.New(hashKey, nil)
+	values := make(map[interface{}]interface{})
+	if err := signer.Decode("prefs", db.rows("sessions")[prefsID]["data"].(string), &values); err != nil {
+		t.Errorf("expected prefs data to be readable without the block key, got %v", err)
+	}
+	if values["theme"] != "dark" {
+		t.Errorf("expected theme to be dark, got %v", values["theme"])
+	}
+	if err := signer.Decode("auth", db.rows("sessions")[authID]["data"].(string), &values); err == nil {
+		t.Error("expected auth data to need the block key")
+	}
+
+	// The prefs session still loads through the store
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	r.Header.Set("Cookie", prefsCookie)
+	sess, err := store.New(r, "prefs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.Values["theme"] != "dark" {
+		t.Errorf("expected theme to be dark, got %v", sess.Values["theme"])
+	}
+}
+
+func TestAddCodecWhileInUse(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// roundTrip saves a session and loads it again.
+	roundTrip := func() (string, error) {
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, _ := store.New(r, "test-sess")
+		sess.Values["foo"] = "Foo"
+		w := httptest.NewRecorder()
+		if err := sess.Save(r, w); err != nil {
+			return "", err
+		}
+		r2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		r2.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
+		if _, err := store.New(r2, "test-sess"); err != nil {
+			return "", err
+		}
+		return sess.ID, nil
+	}
+
+	newKey := []byte("abcdefghijklmnopqrstuvwxyz012345")
+	newCodec := securecookie.New(newKey, nil)
+
+	errs := make(chan error, 40)
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			for j := 0; j < 10; j++ {
+				_, err := roundTrip()
+				errs <- err
+			}
+		}()
+	}
+	go func() {
+		store.AddCodec(newCodec)
+		close(done)
+	}()
+	for i := 0; i < 40; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	<-done
+
+	// Sessions saved now are encoded with the new key
+	id, err := roundTrip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[interface{}]interface{})
+	data := db.rows("sessions")[id]["data"].(string)
+	if err := newCodec.Decode("test-sess", data, &values); err != nil {
+		t.Errorf("expected the session to decode with the new key, got %v", err)
+	}
+}
+
+func TestSetOptionsWhileInUse(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 40)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for j := 0; j < 10; j++ {
+				r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+				sess, _ := store.New(r, "test-sess")
+				w := httptest.NewRecorder()
+				if err := sess.Save(r, w); err != nil {
+					errs <- err
+					continue
+				}
+				r2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+				r2.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
+				_, err := store.New(r2, "test-sess")
+				errs <- err
+			}
+		}()
+	}
+	// The codecs are replaced rather than changed while they are in use,
+	// which the race detector checks
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 1; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			store.SetOptions("admin", &sessions.Options{MaxAge: 86400 * 30 * i})
+			store.MaxLength(defaultMaxLength * i)
+		}
+	}()
+	for i := 0; i < 40; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	close(done)
+	<-stopped
+}
+
+func TestAddCodecGetsStoreSettings(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...), WithCodecSerializer(JSONSerializer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.MaxLength(0)
+
+	newKey := []byte("abcdefghijklmnopqrstuvwxyz012345")
+	store.AddCodec(securecookie.New(newKey, nil))
+
+	// Larger than securecookie's default MaxLength
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	sess.Values["big"] = strings.Repeat("x", 8192)
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatalf("expected the new codec to have no MaxLength, got %v", err)
+	}
+
+	jsonCodec := securecookie.New(newKey, nil)
+	jsonCodec.SetSerializer(JSONSerializer{})
+	jsonCodec.MaxLength(0)
+	values := make(map[interface{}]interface{})
+	if err := jsonCodec.Decode("test-sess", db.rows("sessions")[sess.ID]["data"].(string), &values); err != nil {
+		t.Errorf("expected the data to be serialized as JSON with the new key, got %v", err)
+	}
+}
+
+func TestAddKeyPairSignOnly(t *testing.T) {
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	oldBlock := []byte("0123456789abcdef")
+	newKey := []byte("abcdefghijklmnopqrstuvwxyz012345")
+	newBlock := []byte("abcdefghijklmnop")
+
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(oldKey, oldBlock), WithSignOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetEncryption("prefs", false)
+
+	if err := store.AddKeyPair(newKey, []byte("short")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey, got %v", err)
+	}
+	if err := store.AddKeyPair(newKey, newBlock); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "prefs")
+	sess.Values["theme"] = "dark"
+	w := httptest.NewRecorder()
+	if err := sess.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both the cookie and the unencrypted data are only signed, with the new
+	// hash key.
+	signed := securecookie.New(newKey, nil)
+	cookie := (&http.Response{Header: w.Header()}).Cookies()[0]
+	var id string
+	if err := signed.Decode("prefs", cookie.Value, &id); err != nil || id != sess.ID {
+		t.Errorf("expected the cookie to be signed with the new key, got %q and %v", id, err)
+	}
+	values := make(map[interface{}]interface{})
+	if err := signed.Decode("prefs", db.rows("sessions")[sess.ID]["data"].(string), &values); err != nil {
+		t.Errorf("expected the data to be signed with the new key, got %v", err)
+	}
+}
+
+func TestCodecHits(t *testing.T) {
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+
+	db := newFakeDB()
+	oldStore, err := newStore(db, "sessions", WithKeyPairs(oldKey, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newStore(db, "sessions", WithKeyPairs(newKey, nil, oldKey, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// save saves a session with s and returns a request carrying its cookie.
+	save := func(s *CQLStore, r *http.Request) *http.Request {
+		sess, err := s.Get(r, "test-sess")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess.Values["foo"] = "Foo"
+		w := httptest.NewRecorder()
+		if err := sess.Save(r, w); err != nil {
+			t.Fatal(err)
+		}
+		r, _ = http.NewRequest("GET", "http://www.example.com/", nil)
+		for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+			r.AddCookie(c)
+		}
+		return r
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	r = save(oldStore, r)
+
+	// The cookie and data need the old key, the second codec
+	r = save(store, r)
+	if hits := store.CodecHits(); fmt.Sprint(hits) != "[0 2]" {
+		t.Errorf("expected 2 decodes with the old key, got %v", hits)
+	}
+
+	// After saving they have been encoded with the new key
+	save(store, r)
+	if hits := store.CodecHits(); fmt.Sprint(hits) != "[2 2]" {
+		t.Errorf("expected 2 decodes with the new key, got %v", hits)
+	}
+
+	// The counts move with the codecs when one is added in front
+	store.AddCodec(securecookie.New(newKey, nil))
+	if hits := store.CodecHits(); fmt.Sprint(hits) != "[0 2 2]" {
+		t.Errorf("expected the counts to move with the codecs, got %v", hits)
+	}
+
+	// Sessions only signed are counted with the key pair that signed them
+	// even though AddCodec did not add a codec for signing
+	oldStore.SetEncryption("prefs", false)
+	store.SetEncryption("prefs", false)
+	r, _ = http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := oldStore.New(r, "prefs")
+	sess.Values["theme"] = "dark"
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[interface{}]interface{})
+	data := db.rows("sessions")[sess.ID]["data"].(string)
+	if err := store.decodeData("prefs", data, &values); err != nil {
+		t.Fatal(err)
+	}
+	if hits := store.CodecHits(); fmt.Sprint(hits) != "[0 2 3]" {
+		t.Errorf("expected the decode to count for the old key, got %v", hits)
+	}
+}
+
+func TestDecodeID(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	w := httptest.NewRecorder()
+	if err := sess.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	value := (&http.Response{Header: w.Header()}).Cookies()[0].Value
+
+	id, err := store.DecodeID("test-sess", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != sess.ID {
+		t.Errorf("expected ID %s, got %s", sess.ID, id)
+	}
+
+	// Flip a character to tamper with it
+	tampered := []byte(value)
+	tampered[len(tampered)/2] ^= 1
+	if _, err := store.DecodeID("test-sess", string(tampered)); !errors.Is(err, ErrInvalidCookie) {
+		t.Errorf("expected ErrInvalidCookie for a tampered value, got %v", err)
+	}
+
+	// The name is part of what is signed
+	if _, err := store.DecodeID("other-sess", value); !errors.Is(err, ErrInvalidCookie) {
+		t.Errorf("expected ErrInvalidCookie for another name, got %v", err)
+	}
+
+	// Signed but not an ID the store makes
+	for _, bad := range []string{"", "garbage"} {
+		value, err := store.encodeID("test-sess", bad, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.DecodeID("test-sess", value); !errors.Is(err, ErrInvalidCookie) {
+			t.Errorf("%q: expected ErrInvalidCookie, got %v", bad, err)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := map[string]string{"foo": "Foo", "bar": "Bar"}
+	encoded, err := store.Encode("things", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any store with the same keys can decode it
+	var out map[string]string
+	if err := other.Decode("things", encoded, &out); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(out) != fmt.Sprint(in) {
+		t.Errorf("expected %v, got %v", in, out)
+	}
+
+	if err := other.Decode("other-things", encoded, &out); err == nil {
+		t.Error("expected decoding with another name to fail")
+	}
+}
+
+// reverseSerializer is a securecookie.Serializer that gob encodes values and
+// reverses the bytes, so it can not decode what gob encoded and vice versa.
+type reverseSerializer struct{}
+
+func (reverseSerializer) Serialize(src interface{}) ([]byte, error) {
+	b, err := securecookie.GobEncoder{}.Serialize(src)
+	reverse(b)
+	return b, err
+}
+
+func (reverseSerializer) Deserialize(src []byte, dst interface{}) error {
+	b := append([]byte(nil), src...)
+	reverse(b)
+	return securecookie.GobEncoder{}.Deserialize(b, dst)
+}
+
+func reverse(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
+func TestCodecSerializer(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions",
+		WithKeyPairs(testKeys...),
+		WithCodecSerializer(reverseSerializer{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobStore, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := store.Encode("test-sess", map[string]string{"foo": "Foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]string
+	if err := store.Decode("test-sess", encoded, &out); err != nil || out["foo"] != "Foo" {
+		t.Errorf("expected to decode with the serializer, got %v and %v", out, err)
+	}
+	if err := gobStore.Decode("test-sess", encoded, &out); err == nil {
+		t.Error("expected the default serializer not to decode it")
+	}
+}
+
+func TestJSONSerializer(t *testing.T) {
+	db := newFakeDB()
+	gobStore, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...), WithCodecSerializer(JSONSerializer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// save saves a session with st and returns a request with its cookie.
+	save := func(st *CQLStore) *http.Request {
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, _ := st.New(r, "test-sess")
+		sess.Values["foo"] = "Foo"
+		sess.Values["n"] = 1
+		w := httptest.NewRecorder()
+		if err := sess.Save(r, w); err != nil {
+			t.Fatal(err)
+		}
+		next, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+			next.AddCookie(c)
+		}
+		return next
+	}
+
+	sess, err := store.New(save(store), "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.Values["foo"] != "Foo" || sess.Values["n"] != float64(1) {
+		t.Errorf("expected the values back from JSON, got %v", sess.Values)
+	}
+
+	// Cookies made with gob do not load with JSON
+	sess, err = store.New(save(gobStore), "test-sess")
+	if err == nil || !sess.IsNew {
+		t.Errorf("expected a gob cookie to fail, got %v", err)
+	}
+
+	// Keys that are not strings can not be saved
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ = store.New(r, "test-sess")
+	sess.Values[1] = "one"
+	if err := sess.Save(r, httptest.NewRecorder()); err == nil {
+		t.Error("expected a key that is not a string to fail")
+	}
+}
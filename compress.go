@@ -0,0 +1,67 @@
+package cqlstore
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Markers put in front of everything serialized with WithCompressionThreshold
+// to tell whether the rest is compressed.
+const (
+	markerPlain      byte = 0
+	markerCompressed byte = 1
+)
+
+// compressSerializer wraps the serializer of the store's codecs to compress
+// serialized values larger than threshold bytes with DEFLATE.
+type compressSerializer struct {
+	securecookie.Serializer
+	threshold int
+}
+
+func (c compressSerializer) Serialize(src interface{}) ([]byte, error) {
+	b, err := c.Serializer.Serialize(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) <= c.threshold {
+		return append([]byte{markerPlain}, b...), nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(markerCompressed)
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c compressSerializer) Deserialize(src []byte, dst interface{}) error {
+	if len(src) == 0 {
+		return errors.New("cqlstore: missing compression marker")
+	}
+
+	switch src[0] {
+	case markerPlain:
+		return c.Serializer.Deserialize(src[1:], dst)
+	case markerCompressed:
+		b, err := io.ReadAll(flate.NewReader(bytes.NewReader(src[1:])))
+		if err != nil {
+			return err
+		}
+		return c.Serializer.Deserialize(b, dst)
+	default:
+		return errors.New("cqlstore: unknown compression marker")
+	}
+}
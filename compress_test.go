@@ -0,0 +1,84 @@
+package cqlstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestCompressSerializer(t *testing.T) {
+	c := compressSerializer{securecookie.JSONEncoder{}, 64}
+
+	for _, tt := range []struct {
+		name   string
+		value  string
+		marker byte
+	}{
+		{"small", "tiny", markerPlain},
+		{"large", strings.Repeat("0123456789", 100), markerCompressed},
+	} {
+		b, err := c.Serialize(tt.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[0] != tt.marker {
+			t.Errorf("%s: expected marker %d, got %d", tt.name, tt.marker, b[0])
+		}
+		if tt.marker == markerCompressed && len(b) >= len(tt.value) {
+			t.Errorf("%s: expected %d bytes to be compressed, got %d", tt.name, len(tt.value), len(b))
+		}
+
+		var got string
+		if err := c.Deserialize(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.value {
+			t.Errorf("%s: expected %q back, got %q", tt.name, tt.value, got)
+		}
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	big := strings.Repeat("0123456789", 200)
+
+	// size saves big with opts and returns the size of the stored row after
+	// checking it loads again.
+	size := func(opts ...Option) int {
+		db := newFakeDB()
+		store, err := newStore(db, "sessions", append([]Option{WithKeyPairs(testKeys...)}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, _ := store.New(req1, "test-sess")
+		sess.Values["big"] = big
+		sess.Values["small"] = "x"
+		w := httptest.NewRecorder()
+		if err := sess.Save(req1, w); err != nil {
+			t.Fatal(err)
+		}
+
+		req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+			req2.AddCookie(c)
+		}
+		sess2, err := store.New(req2, "test-sess")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sess2.Values["big"] != big || sess2.Values["small"] != "x" {
+			t.Errorf("expected the session to load, got %d values", len(sess2.Values))
+		}
+
+		return len(db.rows("sessions")[sess.ID]["data"].(string))
+	}
+
+	plain := size()
+	if compressed := size(WithCompressionThreshold(1024)); compressed >= plain/2 {
+		t.Errorf("expected compression to shrink %d bytes, got %d", plain, compressed)
+	}
+}
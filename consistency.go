@@ -0,0 +1,57 @@
+package cqlstore
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gocql/gocql"
+)
+
+// isUnavailable reports whether err means not enough replicas answered a
+// query in time for its consistency level.
+func isUnavailable(err error) bool {
+	var unavailable *gocql.RequestErrUnavailable
+	var timeout *gocql.RequestErrReadTimeout
+	return errors.As(err, &unavailable) || errors.As(err, &timeout) ||
+		errors.Is(err, gocql.ErrUnavailable) || errors.Is(err, gocql.ErrTimeoutNoResponse)
+}
+
+// downgradeQuery runs reads at consistency from and retries them once at
+// consistency to if not enough replicas are available, for
+// WithConsistencyDowngrade. Writes are left alone.
+type downgradeQuery struct {
+	query
+	from, to gocql.Consistency
+}
+
+func (q downgradeQuery) Scan(dest ...interface{}) error {
+	err := q.query.Consistency(q.from).Scan(dest...)
+	if isUnavailable(err) {
+		err = q.query.Consistency(q.to).Scan(dest...)
+	}
+	return err
+}
+
+func (q downgradeQuery) Observer(o gocql.QueryObserver) query {
+	return downgradeQuery{q.query.Observer(o), q.from, q.to}
+}
+
+func (q downgradeQuery) RoutingKey(key []byte) query {
+	return downgradeQuery{q.query.RoutingKey(key), q.from, q.to}
+}
+
+func (q downgradeQuery) WithContext(ctx context.Context) query {
+	return downgradeQuery{q.query.WithContext(ctx), q.from, q.to}
+}
+
+func (q downgradeQuery) Consistency(c gocql.Consistency) query {
+	return downgradeQuery{q.query.Consistency(c), q.from, q.to}
+}
+
+func (q downgradeQuery) PageSize(n int) query {
+	return downgradeQuery{q.query.PageSize(n), q.from, q.to}
+}
+
+func (q downgradeQuery) PageState(state []byte) query {
+	return downgradeQuery{q.query.PageState(state), q.from, q.to}
+}
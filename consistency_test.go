@@ -0,0 +1,87 @@
+package cqlstore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+func TestConsistencyDowngrade(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithConsistencyDowngrade(gocql.Quorum, gocql.LocalOne),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(req1, "test-sess")
+	sess.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first read finds too few replicas
+	failed := false
+	db.fail = func(stmt string, args []interface{}) error {
+		if !failed && strings.HasPrefix(stmt, "SELECT") {
+			failed = true
+			return &gocql.RequestErrUnavailable{Consistency: gocql.Quorum, Required: 2, Alive: 1}
+		}
+		return nil
+	}
+
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	sess2, err := store.New(req2, "test-sess")
+	if err != nil {
+		t.Fatalf("expected the load to be retried, got %v", err)
+	}
+	if sess2.Values["foo"] != "Foo" {
+		t.Errorf("expected foo to be Foo, got %v", sess2.Values["foo"])
+	}
+
+	var reads []gocql.Consistency
+	cons := db.consistencies()
+	for i, stmt := range db.statements() {
+		if strings.HasPrefix(stmt, "SELECT") {
+			reads = append(reads, cons[i])
+		} else if cons[i] != 0 {
+			t.Errorf("expected writes to keep the default consistency, got %s for %s", cons[i], stmt)
+		}
+	}
+	if len(reads) != 2 || reads[0] != gocql.Quorum || reads[1] != gocql.LocalOne {
+		t.Errorf("expected a read at QUORUM retried at LOCAL_ONE, got %v", reads)
+	}
+}
+
+func TestConsistencyDowngradeSurvivesQueryBuilders(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...), WithConsistencyDowngrade(gocql.Quorum, gocql.LocalOne))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := store.query(store.queryContext(), `SELECT "data" FROM "sessions" WHERE "id" = ?`, "a")
+	builders := map[string]query{
+		"WithContext": q.WithContext(context.Background()),
+		"RoutingKey":  q.RoutingKey([]byte("a")),
+		"Consistency": q.Consistency(gocql.One),
+		"PageSize":    q.PageSize(10),
+		"PageState":   q.PageState(nil),
+		"Observer":    q.Observer(nil),
+	}
+	for name, q := range builders {
+		if _, ok := q.(downgradeQuery); !ok {
+			t.Errorf("%s: expected a downgradeQuery, got %T", name, q)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package cqlstore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestBrowserSessionCookie(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithBrowserSessionCookie(2*time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	w := httptest.NewRecorder()
+	if err := sess.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+
+	c := w.Header().Get("Set-Cookie")
+	if strings.Contains(c, "Max-Age") || strings.Contains(c, "Expires") {
+		t.Errorf("expected a cookie without an expiry, got %q", c)
+	}
+
+	ttl, err := store.RemainingTTL(sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != 2*time.Hour {
+		t.Errorf("expected the row to live 2h, got %s", ttl)
+	}
+}
+
+func TestExpires(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	store, err := newStore(newFakeDB(), "sessions",
+		WithKeyPairs(testKeys...),
+		WithClock(func() time.Time { return now }),
+		WithExpires(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Options.MaxAge = 3600
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	w := httptest.NewRecorder()
+	if err := sess.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+
+	c := w.Header().Get("Set-Cookie")
+	if !strings.Contains(c, "Max-Age=3600") {
+		t.Errorf("expected Max-Age=3600, got %q", c)
+	}
+	if expires := "Expires=" + now.Add(time.Hour).Format(http.TimeFormat); !strings.Contains(c, expires) {
+		t.Errorf("expected %s, got %q", expires, c)
+	}
+}
+
+func TestEmptyCookie(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	r.Header.Set("Cookie", "test-sess=")
+	sess, err := store.New(r, "test-sess")
+	if err != nil {
+		t.Errorf("expected no error for an empty cookie, got %v", err)
+	}
+	if !sess.IsNew || sess.ID != "" || len(sess.Values) != 0 {
+		t.Errorf("expected a fresh session, got %q %v", sess.ID, sess.Values)
+	}
+	if n := store.DecodeFailures(); n != 0 {
+		t.Errorf("expected no decode failures, got %d", n)
+	}
+	if _, err := store.NewOrErr(r, "test-sess"); !errors.Is(err, ErrNoCookie) {
+		t.Errorf("expected NewOrErr to report ErrNoCookie, got %v", err)
+	}
+}
+
+func TestHasValidSession(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	if store.HasValidSession(req1, "test-sess") {
+		t.Error("expected no session without a cookie")
+	}
+
+	sess, _ := store.New(req1, "test-sess")
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	if !store.HasValidSession(req2, "test-sess") {
+		t.Error("expected the saved session to be valid")
+	}
+
+	req3, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	req3.AddCookie(&http.Cookie{Name: "test-sess", Value: "bogus"})
+	if store.HasValidSession(req3, "test-sess") {
+		t.Error("expected a bogus cookie to be invalid")
+	}
+
+	// A cookie for a deleted session is not valid either
+	sess.Options.MaxAge = -1
+	if err := sess.Save(req2, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if store.HasValidSession(req2, "test-sess") {
+		t.Error("expected a deleted session to be invalid")
+	}
+}
+
+func TestInvalidID(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"", "garbage"} {
+		value, err := store.encodeID("test-sess", id, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := len(db.statements())
+
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		r.AddCookie(&http.Cookie{Name: "test-sess", Value: value})
+		sess, err := store.New(r, "test-sess")
+		if !errors.Is(err, ErrInvalidCookie) {
+			t.Errorf("%q: expected ErrInvalidCookie, got %v", id, err)
+		}
+		if sess.ID != "" || !sess.IsNew {
+			t.Errorf("%q: expected a fresh session, got %q", id, sess.ID)
+		}
+		if n := len(db.statements()); n != before {
+			t.Errorf("%q: expected no query, got %d", id, n-before)
+		}
+	}
+}
+
+func TestDuplicateCookies(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// save saves a session with the value foo and returns its cookie.
+	save := func(foo string) (*sessions.Session, *http.Cookie) {
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, _ := store.New(r, "test-sess")
+		sess.Values["foo"] = foo
+		w := httptest.NewRecorder()
+		if err := sess.Save(r, w); err != nil {
+			t.Fatal(err)
+		}
+		return sess, (&http.Response{Header: w.Header()}).Cookies()[0]
+	}
+
+	stale, staleCookie := save("Stale")
+	stale.Options.MaxAge = -1
+	if err := stale.Save(&http.Request{}, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	valid, validCookie := save("Valid")
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	r.AddCookie(staleCookie)
+	r.AddCookie(validCookie)
+	sess, err := store.New(r, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.ID != valid.ID || sess.Values["foo"] != "Valid" {
+		t.Errorf("expected to load session %s, got %s with %v", valid.ID, sess.ID, sess.Values)
+	}
+
+	// Without a valid one the session is fresh
+	r, _ = http.NewRequest("GET", "http://www.example.com/", nil)
+	r.AddCookie(staleCookie)
+	r.AddCookie(&http.Cookie{Name: "test-sess", Value: "garbage"})
+	sess, err = store.New(r, "test-sess")
+	if err == nil {
+		t.Error("expected an error when no cookie loads")
+	}
+	if !sess.IsNew || sess.ID != "" || len(sess.Values) != 0 {
+		t.Errorf("expected a fresh session, got %s with %v", sess.ID, sess.Values)
+	}
+}
+
+func TestMinReissueAge(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithClock(func() time.Time { return now }),
+		WithMinReissueAge(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// save saves the session in the cookies of r and returns a request
+	// carrying the cookie it was saved with.
+	save := func(r *http.Request) (*sessions.Session, *http.Request) {
+		t.Helper()
+		sess, err := store.New(r, "test-sess")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess.Values["foo"] = "Foo"
+		w := httptest.NewRecorder()
+		if err := sess.Save(r, w); err != nil {
+			t.Fatal(err)
+		}
+		next, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+			next.AddCookie(c)
+		}
+		return sess, next
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess1, req2 := save(req1)
+	c1, _ := req2.Cookie("test-sess")
+	if id, err := store.DecodeID("test-sess", c1.Value); err != nil || id != sess1.ID {
+		t.Errorf("expected DecodeID to return %q, got %q, %v", sess1.ID, id, err)
+	}
+
+	// Before the threshold the cookie and ID are kept
+	now = now.Add(30 * time.Minute)
+	sess2, req3 := save(req2)
+	if sess2.ID != sess1.ID {
+		t.Errorf("expected the session to keep ID %q, got %q", sess1.ID, sess2.ID)
+	}
+	if c3, _ := req3.Cookie("test-sess"); c3.Value != c1.Value {
+		t.Errorf("expected the cookie to keep its issue time")
+	}
+
+	// Past it the session gets a new ID and the old row is removed
+	now = now.Add(45 * time.Minute)
+	sess3, req4 := save(req3)
+	if sess3.ID == sess1.ID {
+		t.Fatalf("expected the session to be reissued with a new ID")
+	}
+	if _, ok := db.rows("sessions")[sess1.ID]; ok {
+		t.Errorf("expected the row of the old ID to be deleted")
+	}
+
+	sess4, err := store.New(req4, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess4.ID != sess3.ID || sess4.Values["foo"] != "Foo" {
+		t.Errorf("expected the reissued session to load, got %q %v", sess4.ID, sess4.Values)
+	}
+
+	// The old cookie no longer loads the session
+	sess5, err := store.New(req2, "test-sess")
+	if err == nil || !sess5.IsNew {
+		t.Errorf("expected the replayed cookie to get a new session, got %v", err)
+	}
+}
+
+func TestNewOrErr(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, err := store.NewOrErr(req1, "test-sess")
+	if !errors.Is(err, ErrNoCookie) {
+		t.Errorf("expected ErrNoCookie without a cookie, got %v", err)
+	}
+	if sess == nil || !sess.IsNew {
+		t.Fatalf("expected a fresh session, got %v", sess)
+	}
+
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	if sess2, err := store.NewOrErr(req2, "test-sess"); err != nil || sess2.IsNew {
+		t.Errorf("expected the session to load, got %v", err)
+	}
+
+	// A cookie that does not load is a different error
+	req3, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	req3.AddCookie(&http.Cookie{Name: "test-sess", Value: "garbage"})
+	if _, err := store.NewOrErr(req3, "test-sess"); err == nil || errors.Is(err, ErrNoCookie) {
+		t.Errorf("expected a load error for a bad cookie, got %v", err)
+	}
+}
+
+func TestInvalidCookieName(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"bad name", "", "semi;colon", "tab\tname", "caf\u00e9"} {
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, err := store.New(r, name)
+		if !errors.Is(err, ErrInvalidCookieName) {
+			t.Errorf("%q: expected ErrInvalidCookieName from New, got %v", name, err)
+		}
+		if sess == nil {
+			t.Fatalf("%q: expected a session", name)
+		}
+		w := httptest.NewRecorder()
+		if err := sess.Save(r, w); !errors.Is(err, ErrInvalidCookieName) {
+			t.Errorf("%q: expected ErrInvalidCookieName from Save, got %v", name, err)
+		}
+		if c := w.Header().Get("Set-Cookie"); c != "" {
+			t.Errorf("%q: expected no cookie, got %q", name, c)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	if _, err := store.New(r, "good_name-1.0"); err != nil {
+		t.Errorf("expected a valid name to work, got %v", err)
+	}
+}
+
+func TestPath(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...), WithPath("/app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/app/", nil)
+	sess, _ := store.New(r, "test-sess")
+	w := httptest.NewRecorder()
+	if err := sess.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	if c := w.Header().Get("Set-Cookie"); !strings.Contains(c, "Path=/app") {
+		t.Errorf("expected Path=/app, got %q", c)
+	}
+
+	for _, p := range []string{"", "app", "/app;Domain=evil.com", "/a\nb"} {
+		if _, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...), WithPath(p)); err == nil {
+			t.Errorf("expected path %q to be rejected", p)
+		}
+	}
+}
+
+func TestSameSiteNone(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions",
+		WithKeyPairs(testKeys...),
+		WithSameSite(http.SameSiteNoneMode),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	w := httptest.NewRecorder()
+	if err := sess.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	c := w.Header().Get("Set-Cookie")
+	if !strings.Contains(c, "SameSite=None") || !strings.Contains(c, "Secure") {
+		t.Errorf("expected a Secure SameSite=None cookie, got %q", c)
+	}
+
+	store.Options.Secure = false
+	sess, _ = store.New(r, "other-sess")
+	w = httptest.NewRecorder()
+	if err := sess.Save(r, w); !errors.Is(err, ErrInsecureSameSiteNone) {
+		t.Errorf("expected ErrInsecureSameSiteNone, got %v", err)
+	}
+	if c := w.Header().Get("Set-Cookie"); c != "" {
+		t.Errorf("expected no cookie, got %q", c)
+	}
+}
+
+func TestPartitioned(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...), WithPartitioned())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	w := httptest.NewRecorder()
+	if err := sess.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	c := w.Header().Get("Set-Cookie")
+	if !strings.Contains(c, "; Partitioned") || !strings.Contains(c, "; Secure") {
+		t.Errorf("expected a Secure Partitioned cookie, got %q", c)
+	}
+
+	store.Options.Secure = false
+	sess, _ = store.New(r, "other-sess")
+	if err := sess.Save(r, httptest.NewRecorder()); !errors.Is(err, ErrInsecurePartitioned) {
+		t.Errorf("expected ErrInsecurePartitioned, got %v", err)
+	}
+}
@@ -3,10 +3,21 @@
 package cqlstore
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"reflect"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gocql/gocql"
 	"github.com/gorilla/securecookie"
@@ -19,158 +30,1828 @@ type CQLStore struct {
 	Options *sessions.Options
 	Codecs  []securecookie.Codec
 
-	saveQ   *gocql.Query
-	deleteQ *gocql.Query
-	loadQ   *gocql.Query
+	// BeforeSave, if set, is called by Save before a session is written to
+	// the database. Returning an error aborts the save.
+	BeforeSave func(s *sessions.Session) error
+	// AfterSave, if set, is called by Save after a session is written.
+	AfterSave func(s *sessions.Session)
+	// AfterDelete, if set, is called by Save after a session with a negative
+	// MaxAge is deleted.
+	AfterDelete func(s *sessions.Session)
+
+	// ErrorHandler, if set, is called by New when a session identified by the
+	// request's cookie can not be loaded. If it returns a session New returns
+	// that session without an error. If it returns nil New returns a fresh
+	// session and the error as usual.
+	ErrorHandler func(err error) *sessions.Session
+
+	// MaxLoadSize, if greater than 0, is the largest number of bytes of
+	// stored data New will decode. Larger sessions are not decoded and New
+	// returns a fresh session and ErrValueTooLong instead.
+	MaxLoadSize int
+
+	db    session
+	table string
+	now   func() time.Time
+
+	keyPairs     [][]byte
+	serializer   securecookie.Serializer
+	signOnly     bool
+	signedCodecs []securecookie.Codec
+	cookieCodecs []securecookie.Codec
+	codecPairs   []int
+	signedPairs  []int
+	codecMaxAge  int
+	syncedAge    int
+	maxLength    int
+
+	recentBuckets   int
+	merge           MergeFunc
+	locking         bool
+	defaults        map[interface{}]interface{}
+	expireDelete    bool
+	binary          bool
+	userKey         interface{}
+	maxPerUser      int
+	tenant          func(*http.Request) string
+	sessionName     string
+	absoluteTimeout time.Duration
+	syncMaxAge      bool
+	nameInKey       bool
+	idGenerator     func() string
+	textID          bool
+	readOnly        bool
+	browserTTL      int
+	expires         bool
+	hashedKey       bool
+	maxAgeCeiling   int
+	fieldEncryption bool
+	plainFields     map[string]bool
+	appTag          string
+	rejectForeign   bool
+	changeDetection bool
+	legacyCodecs    []securecookie.Codec
+	maxIdle         int
+	chunkSize       int
+	inPlace         bool
+	reissueAge      time.Duration
+	compressAbove   int
+	batchType       gocql.BatchType
+	autoMigrate     bool
+	tableComment    string
+	tableProps      map[string]string
+	clearBad        bool
+	globalMax       int
+	errorKeys       []interface{}
+	validator       func(map[interface{}]interface{}) error
+
+	replicationKeyspace string
+	minReplication      int
+
+	logger    Logger
+	slowQuery time.Duration
+	queryTag  string
+	breaker   *breaker
+	cache     *cache
+	baseCtx   context.Context
+
+	downgrade     bool
+	downgradeFrom gocql.Consistency
+	downgradeTo   gocql.Consistency
+
+	decodeFailures atomic.Uint64
+	draining       atomic.Bool
+	hits           codecHits
+	created        atomic.Uint64
+	loaded         atomic.Uint64
+	saved          atomic.Uint64
+	deleted        atomic.Uint64
+	global         globalCount
+
+	mu          sync.RWMutex
+	nameOptions map[string]*sessions.Options
+	unencrypted map[string]bool
+}
+
+// validCookieName reports whether name can be used as the name of a cookie. It
+// must be a token as defined by RFC 7230.
+func validCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validName matches the table and keyspace names the store accepts. Names are
+// always quoted in statements so anything matching this is safe to use.
+var validName = regexp.MustCompile("^[a-zA-Z0-9_]+$")
+
+// ValidName reports whether name can be used as a table or keyspace name by
+// the store.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
 }
 
 // New creates a new CQLStore. It requires an active gocql.Session and the name
 // of the table where it should store session data. It will create this table
-// with the appropriate schema if it does not exist. Additionally pass one or
-// more byte slices to serve as authentication and/or encryption keys for both
-// the cookie's session ID value and the values stored in the database.
+// with the appropriate schema if it does not exist. The name is always quoted
+// in statements so it is case sensitive and may be a CQL keyword such as
+// token. Additionally pass one or more pairs of byte slices to serve as
+// authentication and encryption keys for both the cookie's session ID value
+// and the values stored in the database. The keys are checked as described by
+// WithKeyPairs.
 func New(cs *gocql.Session, table string, keypairs ...[]byte) (*CQLStore, error) {
-	var err error
+	return NewWithOptions(cs, table, WithKeyPairs(keypairs...))
+}
 
-	re := regexp.MustCompile("^[a-zA-Z0-9_]+$")
-	if !re.MatchString(table) {
-		return &CQLStore{}, errors.New("Invalid table name " + table)
+// NewWithOptions creates a new CQLStore like New but accepts Options to
+// customize the store. Keys are provided with the WithKeyPairs Option.
+func NewWithOptions(cs *gocql.Session, table string, opts ...Option) (*CQLStore, error) {
+	return newStore(gocqlSession{cs}, table, opts...)
+}
+
+// newStore does the work of NewWithOptions against any implementation of
+// session.
+func newStore(db session, table string, opts ...Option) (*CQLStore, error) {
+	st, err := configure(db, table, opts...)
+	if err != nil {
+		return &CQLStore{}, err
 	}
 
-	// TODO add more columns for timestamps?
-	create := `
-	CREATE TABLE IF NOT EXISTS "` + table + `" (
-		id uuid,
-		data text,
-		PRIMARY KEY (id)
-	)`
-	err = cs.Query(create, table).Exec()
+	if st.replicationKeyspace != "" {
+		if err := st.checkReplication(); err != nil {
+			return &CQLStore{}, err
+		}
+	}
+	if !st.readOnly {
+		for _, create := range st.schema() {
+			if err := st.query(st.queryContext(), create).Exec(); err != nil {
+				return &CQLStore{}, createError{err}
+			}
+		}
+		if st.autoMigrate {
+			if err := st.migrateColumns(); err != nil {
+				return &CQLStore{}, createError{err}
+			}
+		}
+	}
+	register(st)
+
+	return st, nil
+}
+
+// SchemaDDL returns the statements New would run to create the tables of a
+// store with the given table and Options, separated by semicolons, without
+// running them. Use it to keep schema managed by migration tools in sync
+// with what the store expects, along with WithReadOnlyStore or simply letting
+// the store find the tables already exist.
+func SchemaDDL(table string, opts ...Option) (string, error) {
+	st, err := configure(nil, table, opts...)
 	if err != nil {
-		return &CQLStore{}, createError{err}
+		return "", err
+	}
+
+	stmts := st.schema()
+	for i, stmt := range stmts {
+		stmts[i] = strings.TrimSpace(stmt) + ";"
+	}
+	return strings.Join(stmts, "\n\n"), nil
+}
+
+// ValidateConfig runs every check New makes of its table name and Options
+// without connecting to a database, for example to vet configuration in CI.
+// Unlike New it does not stop at the first problem: all of them are returned
+// together, joined with errors.Join. The checks of how Options combine are
+// only made once every Option applied cleanly.
+func ValidateConfig(table string, opts ...Option) error {
+	var errs []error
+	if table == "" {
+		errs = append(errs, ErrTableRequired)
+	} else if !validName.MatchString(table) {
+		errs = append(errs, errors.New("Invalid table name "+table))
+	}
+
+	st := defaultStore(nil, table)
+	optsOK := true
+	for _, opt := range opts {
+		if err := opt(st); err != nil {
+			errs = append(errs, err)
+			optsOK = false
+		}
 	}
+	if optsOK {
+		if err := st.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
 
-	st := &CQLStore{
+// defaultStore returns a store using db with the defaults Options start from.
+func defaultStore(db session, table string) *CQLStore {
+	return &CQLStore{
 		Options: &sessions.Options{
 			Path:   "/",
 			MaxAge: 86400 * 30,
 		},
-		Codecs: securecookie.CodecsFromPairs(keypairs...),
 
-		saveQ:   cs.Query(`INSERT INTO "` + table + `" ("id", "data") VALUES(?, ?) USING TTL ?`),
-		deleteQ: cs.Query(`DELETE FROM "` + table + `" WHERE "id" = ?`),
-		loadQ:   cs.Query(`SELECT "data" FROM "` + table + `" WHERE "id" = ?`),
+		db:        db,
+		table:     table,
+		now:       time.Now,
+		batchType: gocql.UnloggedBatch,
+		maxLength: defaultMaxLength,
+	}
+}
+
+// configure creates a store using db with the given Options applied without
+// touching the database.
+func configure(db session, table string, opts ...Option) (*CQLStore, error) {
+	if table == "" {
+		return &CQLStore{}, ErrTableRequired
+	}
+	if !validName.MatchString(table) {
+		return &CQLStore{}, errors.New("Invalid table name " + table)
+	}
+
+	st := defaultStore(db, table)
+	for _, opt := range opts {
+		if err := opt(st); err != nil {
+			return &CQLStore{}, err
+		}
+	}
+	if err := st.validate(); err != nil {
+		return &CQLStore{}, err
+	}
+	st.signedCodecs = signOnlyCodecs(st.keyPairs)
+	st.codecPairs = numberPairs(len(st.Codecs))
+	st.signedPairs = numberPairs(len(st.signedCodecs))
+	if st.signOnly {
+		st.cookieCodecs = st.signedCodecs
+	}
+	if st.compressAbove > 0 {
+		inner := st.serializer
+		if inner == nil {
+			inner = securecookie.GobEncoder{}
+		}
+		st.serializer = compressSerializer{inner, st.compressAbove}
+	}
+	if st.serializer != nil {
+		st.updateCodecs(func(codec *securecookie.SecureCookie) {
+			codec.SetSerializer(st.serializer)
+		})
+	}
+	st.setCodecMaxAge(st.codecAge())
+	if st.logger == nil {
+		st.logger = log.New(os.Stderr, "", log.LstdFlags)
 	}
 
 	return st, nil
 }
 
+// column is a column of the sessions table.
+type column struct {
+	name, typ string
+}
+
+// columns returns the columns Options add to the sessions table, in the order
+// they are created.
+func (st *CQLStore) columns() []column {
+	var cols []column
+	if st.recentBuckets > 0 {
+		cols = append(cols, column{"updated_at", "timestamp"})
+	}
+	if st.locking {
+		cols = append(cols, column{"version", "int"})
+	}
+	if st.tenant != nil {
+		cols = append(cols, column{"tenant", "text"})
+	}
+	if st.appTag != "" {
+		cols = append(cols, column{"app_tag", "text"})
+	}
+	if st.maxIdle > 0 {
+		cols = append(cols, column{"last_accessed", "timestamp"})
+	}
+	if st.chunkSize > 0 {
+		cols = append(cols, column{"chunks", "map<int, blob>"})
+	}
+	if st.absoluteTimeout > 0 {
+		cols = append(cols, column{"created_at", "timestamp"})
+	}
+	if st.fieldEncryption {
+		cols = append(cols, column{"fields", "map<text, blob>"})
+	}
+	return cols
+}
+
+// schema returns the CREATE statements for every table the store needs.
+func (st *CQLStore) schema() []string {
+	// TODO add more columns for timestamps?
+	dataType := "text"
+	if st.binary {
+		dataType = "blob"
+	}
+	idType := "uuid"
+	if st.textID {
+		idType = "text"
+	}
+	columns := `
+		id ` + idType + `,
+		data ` + dataType + `,`
+	primaryKey := "id"
+	if st.nameInKey {
+		columns += `
+		name text,`
+		primaryKey = "id, name"
+	}
+	for _, c := range st.columns() {
+		columns += `
+		` + c.name + ` ` + c.typ + `,`
+	}
+
+	create := `
+	CREATE TABLE IF NOT EXISTS "` + st.table + `" (` + columns + `
+		PRIMARY KEY (` + primaryKey + `)
+	)`
+	var with []string
+	if st.tableComment != "" {
+		with = append(with, `comment = `+cqlString(st.tableComment))
+	}
+	for _, name := range sortedKeys(st.tableProps) {
+		with = append(with, name+` = `+st.tableProps[name])
+	}
+	if len(with) > 0 {
+		create += ` WITH ` + strings.Join(with, ` AND `)
+	}
+	stmts := []string{create}
+
+	if st.recentBuckets > 0 {
+		stmts = append(stmts, `
+	CREATE TABLE IF NOT EXISTS "`+st.recentTable()+`" (
+		bucket int,
+		updated_at timestamp,
+		id `+idType+`,
+		PRIMARY KEY ((bucket), updated_at, id)
+	) WITH CLUSTERING ORDER BY (updated_at DESC, id ASC)`)
+	}
+
+	if st.userKey != nil {
+		stmts = append(stmts, `
+	CREATE TABLE IF NOT EXISTS "`+st.userTable()+`" (
+		user_id text,
+		id `+idType+`,
+		updated_at timestamp,
+		PRIMARY KEY ((user_id), id)
+	)`)
+	}
+
+	return stmts
+}
+
+// migrateColumns adds the columns the store needs to a sessions table that was
+// created without them, for WithAutoMigrate.
+func (st *CQLStore) migrateColumns() error {
+	for _, c := range st.columns() {
+		err := st.query(st.queryContext(), `ALTER TABLE "`+st.table+`" ADD `+c.name+` `+c.typ).Exec()
+		if err != nil && !columnExists(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// columnExists reports whether err is Cassandra refusing to add a column
+// because the table already has it.
+func columnExists(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "conflicts with an existing column") ||
+		strings.Contains(msg, "already exist")
+}
+
 // Get creates or returns a session from the request registry. It never returns
 // a nil session.
+//
+// Only the first Get for a name in a request loads the session. Later calls
+// with the same request return that same *sessions.Session, along with the
+// error from loading it, even if the stored session has changed since. Use
+// Fresh to read it from the database again.
 func (st *CQLStore) Get(r *http.Request, name string) (*sessions.Session, error) {
 	return sessions.GetRegistry(r).Get(st, name)
 }
 
+// Fresh loads the session with the given name from the database like New,
+// bypassing both the request registry used by Get and the cache of
+// WithCache. The session it returns is not added to the registry so later
+// calls to Get still return the session Get loaded first.
+func (st *CQLStore) Fresh(r *http.Request, name string) (*sessions.Session, error) {
+	if st.cache != nil {
+		for _, c := range r.Cookies() {
+			var id string
+			var issued time.Time
+			if c.Name == name && st.decodeID(name, c.Value, &id, &issued) == nil {
+				st.uncache(id)
+			}
+		}
+	}
+	return st.New(r, name)
+}
+
+// Session is like Get for the session name configured with WithSessionName.
+func (st *CQLStore) Session(r *http.Request) (*sessions.Session, error) {
+	if st.sessionName == "" {
+		return nil, errors.New("Session requires the WithSessionName option")
+	}
+	return st.Get(r, st.sessionName)
+}
+
 // New creates and returns a new session without adding it to the registry. If
 // the request has the named cookie then it will decode the session ID and load
 // session values from the database. If the request might already have had the
 // session loaded then calling Get instead will be faster. It never returns a
 // nil session.
 func (st *CQLStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	return st.newSession(st.queryContext(), r, name)
+}
+
+// newSession does the work of New, loading the session with ctx.
+func (st *CQLStore) newSession(ctx context.Context, r *http.Request, name string) (*sessions.Session, error) {
 	s := sessions.NewSession(st, name)
 	s.IsNew = true
 
 	// Copy options from store to session
-	opts := *st.Options
+	opts := *st.optionsFor(name)
 	s.Options = &opts
 
+	for k, v := range st.defaults {
+		s.Values[k] = v
+	}
+
+	if !validCookieName(name) {
+		return s, ErrInvalidCookieName
+	}
+
 	// See if the request has a cookie for this session. If it does not we can
-	// just return the new session struct.
-	c, errCookie := r.Cookie(name)
-	if errCookie != nil {
+	// just return the new session struct. Clients may send several cookies
+	// with the same name, set for different paths or domains, so try to load
+	// each until one works. Empty cookies are what is left after a logout and
+	// are treated as missing.
+	var errLoad error
+	for _, c := range r.Cookies() {
+		if c.Name != name || c.Value == "" {
+			continue
+		}
+		s.ID = ""
+		err := st.loadInto(ctx, r, s, c.Value)
+		if err == nil {
+			st.loaded.Add(1)
+			return s, nil
+		}
+		if errLoad == nil {
+			errLoad = err
+		}
+	}
+	if errLoad == nil {
 		return s, nil
 	}
 
-	// Okay so the request identified a session. Try to load it.
+	// None of them could be loaded so report why the first one failed.
+	err := loadError{errLoad}
+	if st.ErrorHandler != nil {
+		if handled := st.ErrorHandler(err); handled != nil {
+			return handled, nil
+		}
+	}
+	return s, err
+}
+
+// NewOrErr is like New but also returns ErrNoCookie, along with the fresh
+// session, when the request has no cookie for the session at all or only an
+// empty one, as left behind by a logout. That tells
+// it apart from a request whose cookie could not be loaded, which fails with
+// the same error New returns.
+func (st *CQLStore) NewOrErr(r *http.Request, name string) (*sessions.Session, error) {
+	s, err := st.New(r, name)
+	if err != nil {
+		return s, err
+	}
+	if c, errCookie := r.Cookie(name); errCookie != nil || c.Value == "" {
+		return s, ErrNoCookie
+	}
+	return s, nil
+}
+
+// HasValidSession reports whether the request has a cookie for the session
+// with the given name that refers to a stored session, without decoding the
+// session's values. Errors, including from the database, are reported as
+// false. New can still fail to load a session HasValidSession accepted, for
+// example if its data can not be decoded or it belongs to another tenant.
+func (st *CQLStore) HasValidSession(r *http.Request, name string) bool {
+	for _, c := range r.Cookies() {
+		if c.Name != name || c.Value == "" {
+			continue
+		}
+
+		var id string
+		var issued time.Time
+		if err := st.decodeID(name, c.Value, &id, &issued); err != nil {
+			continue
+		}
+		row, err := st.loadCached(st.queryContext(), id, name)
+		if err != nil {
+			continue
+		}
+		if st.absoluteTimeout > 0 && !row.createdAt.IsZero() &&
+			st.now().Sub(row.createdAt) > st.absoluteTimeout {
+			continue
+		}
+		return true
+	}
+	return false
+}
 
+// loadInto loads the session identified by the cookie value into s.
+func (st *CQLStore) loadInto(ctx context.Context, r *http.Request, s *sessions.Session, value string) error {
 	// Decode the cookie value into the session id
-	if err := securecookie.DecodeMulti(name, c.Value, &s.ID, st.Codecs...); err != nil {
-		return s, loadError{err}
+	var issued time.Time
+	if err := st.decodeID(s.Name(), value, &s.ID, &issued); err != nil {
+		if st.importLegacy(s, value) {
+			return nil
+		}
+		st.decodeFailed(s)
+		return err
+	}
+	if !st.validID(s.ID) {
+		// Querying with it would only fail with a confusing error from the
+		// driver.
+		s.ID = ""
+		st.decodeFailed(s)
+		return ErrInvalidCookie
+	}
+
+	var row row
+	var err error
+	if st.inPlace {
+		// Nothing may keep row.data once loadInto returns, it is only a view
+		// of buf.
+		buf := loadBuffers.Get().(*loadBuffer)
+		defer loadBuffers.Put(buf)
+		row, err = st.loadRow(ctx, s.ID, s.Name(), buf)
+	} else {
+		row, err = st.loadCached(ctx, s.ID, s.Name())
+	}
+	if err != nil {
+		return err
+	}
+
+	if st.absoluteTimeout > 0 && !row.createdAt.IsZero() &&
+		st.now().Sub(row.createdAt) > st.absoluteTimeout {
+		s.ID = ""
+		return ErrSessionExpired
+	}
+
+	if st.MaxLoadSize > 0 && row.size() > st.MaxLoadSize {
+		s.ID = ""
+		return ErrValueTooLong
 	}
 
-	var encData string
-	if err := st.loadQ.Bind(s.ID).Scan(&encData); err != nil {
-		return s, loadError{err}
+	if st.tenant != nil && row.tenant != st.tenant(r) {
+		// Forget the ID so saving this session can not overwrite the other
+		// tenant's session.
+		s.ID = ""
+		return ErrTenantMismatch
 	}
 
-	if err := securecookie.DecodeMulti(s.Name(), encData, &s.Values, st.Codecs...); err != nil {
-		return s, loadError{err}
+	if st.rejectForeign && row.appTag != st.appTag {
+		s.ID = ""
+		return ErrAppTagMismatch
+	}
+
+	// Decode into a new map so the defaults for new sessions do not leak into
+	// the loaded one.
+	values := make(map[interface{}]interface{})
+	if err := st.decodeRow(s.Name(), row, &values); err != nil {
+		st.decodeFailed(s)
+		return err
+	}
+	s.Values = values
+	if st.changeDetection {
+		s.Values[metaStored] = row
+	}
+
+	if st.locking {
+		s.Values[metaVersion] = row.version
+	}
+	if st.absoluteTimeout > 0 {
+		s.Values[metaCreatedAt] = row.createdAt
+	}
+	if st.reissueAge > 0 {
+		s.Values[metaIssued] = issued
+	}
+	if st.syncMaxAge && row.ttl > 0 {
+		s.Options.MaxAge = row.ttl
+	}
+
+	if st.maxIdle > 0 {
+		// The session was loaded fine, failing to keep it alive should not
+		// fail the request.
+		if err := st.touch(ctx, s, row); err != nil {
+			st.logger.Printf("cqlstore: could not refresh the TTL of session %s: %v", s.ID, err)
+		}
 	}
 
 	s.IsNew = false
 
-	return s, nil
+	return nil
 }
 
-// Save persists session values to the database and adds the session ID cookie
-// to the request. Save must be called before writing the response or the
-// cookie will not be sent.
-func (st *CQLStore) Save(r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
-	if s.Options.MaxAge < 0 {
-		if err := st.deleteQ.Bind(s.ID).Exec(); err != nil {
-			return saveError{err}
-		}
+// SetOptions sets the Options used for sessions with the given name instead of
+// the store's Options. This allows, for example, an admin session cookie to be
+// scoped to a different Path than the rest of the site's sessions. The
+// options' MaxAge is also used for the lifetime of the sessions' rows, and
+// the codecs are updated so they accept values as old as the longest MaxAge
+// of any session. Like MaxLength it should be called before the store is
+// used.
+func (st *CQLStore) SetOptions(name string, opts *sessions.Options) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
 
-		http.SetCookie(w, sessions.NewCookie(s.Name(), "", s.Options))
-		return nil
+	if st.nameOptions == nil {
+		st.nameOptions = make(map[string]*sessions.Options)
 	}
+	st.nameOptions[name] = opts
+	st.setCodecMaxAge(st.codecAge())
+}
 
-	if s.ID == "" {
-		// TODO is there a better one to use here?
-		s.ID = gocql.UUIDFromTime(time.Now()).String()
+// SetEncryption controls whether the data of sessions with the given name is
+// encrypted. Sessions are encrypted by default when WithKeyPairs was given
+// block keys. Turning encryption off for a session that only holds harmless
+// data, like a UI theme, saves the cost of encrypting and decrypting it.
+//
+// Unencrypted data is still signed so it can not be tampered with, but anyone
+// with read access to the database, its backups or its logs can read it. Never
+// turn encryption off for a session holding anything sensitive. Sessions
+// saved before encryption is switched on or off can no longer be loaded.
+func (st *CQLStore) SetEncryption(name string, encrypt bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.unencrypted == nil {
+		st.unencrypted = make(map[string]bool)
 	}
+	st.unencrypted[name] = !encrypt
+}
 
-	// Encode the data to store in the db
-	encData, err := securecookie.EncodeMulti(s.Name(), s.Values, st.Codecs...)
-	if err != nil {
-		return saveError{err}
+// optionsFor returns the Options for sessions with the given name.
+func (st *CQLStore) optionsFor(name string) *sessions.Options {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	if opts, ok := st.nameOptions[name]; ok {
+		return opts
 	}
+	return st.Options
+}
 
-	if err := st.saveQ.Bind(s.ID, encData, st.Options.MaxAge).Exec(); err != nil {
-		return saveError{err}
+// defaultMaxLength is the maximum length of encoded values securecookie
+// defaults to.
+const defaultMaxLength = 4096
+
+// MaxLength restricts the maximum length of encoded session values to l. If l
+// is 0 there is no limit. securecookie defaults to 4096 bytes which is far
+// less than a row can hold but also limits the size of each session.
+func (st *CQLStore) MaxLength(l int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.maxLength = l
+	st.updateCodecs(func(codec *securecookie.SecureCookie) {
+		codec.MaxLength(l)
+	})
+}
+
+// maxTTL is the longest time to live in seconds Cassandra allows, 20 years.
+const maxTTL = 630720000
+
+// ceiling returns the largest MaxAge and time to live in seconds the store
+// will use.
+func (st *CQLStore) ceiling() int {
+	if st.maxAgeCeiling > 0 {
+		return st.maxAgeCeiling
 	}
+	return maxTTL
+}
 
-	// Encode the session ID and set it in a cookie
-	encID, err := securecookie.EncodeMulti(s.Name(), s.ID, st.Codecs...)
-	if err != nil {
-		return saveError{err}
+// rowTTL returns the time to live in seconds of the rows of sessions with the
+// given name.
+func (st *CQLStore) rowTTL(name string) int {
+	if st.browserTTL > 0 {
+		return st.browserTTL
 	}
-	http.SetCookie(w, sessions.NewCookie(s.Name(), encID, s.Options))
+	if st.maxIdle > 0 {
+		return st.maxIdle
+	}
+	return st.optionsFor(name).MaxAge
+}
 
-	return nil
+// MaxAge sets the MaxAge of the store's Options. Like MaxLength it should be
+// called before the store is used.
+func (st *CQLStore) MaxAge(age int) {
+	st.Options.MaxAge = age
+	st.syncCodecMaxAge()
 }
 
-// TODO better error handling
+// codecAge returns the MaxAge the store's codecs should have. Unless
+// WithCodecMaxAge was used it follows the MaxAge of the store's Options and
+// those given to SetOptions, so the timestamps securecookie adds to cookies
+// and stored data do not expire before the sessions do. The caller must hold
+// st.mu.
+func (st *CQLStore) codecAge() int {
+	if st.codecMaxAge > 0 {
+		return st.codecMaxAge
+	}
+	if st.browserTTL > 0 {
+		return st.browserTTL
+	}
+	age := st.Options.MaxAge
+	for _, opts := range st.nameOptions {
+		if opts.MaxAge > age {
+			age = opts.MaxAge
+		}
+	}
+	return age
+}
 
-type createError struct {
-	err error
+// syncCodecMaxAge updates the codecs if the MaxAge they should have changed
+// since they were last set, which happens when the store's Options are
+// modified directly. It is called before the codecs are used.
+func (st *CQLStore) syncCodecMaxAge() {
+	st.mu.RLock()
+	age := st.codecAge()
+	synced := age == st.syncedAge
+	st.mu.RUnlock()
+	if synced {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.setCodecMaxAge(st.codecAge())
 }
 
-func (e createError) Error() string {
-	return "Could not create sessions table. Error: " + e.err.Error()
+// setCodecMaxAge sets the MaxAge of every codec the store uses. Ages that are
+// not positive are ignored since securecookie would treat every timestamp as
+// expired. The caller must hold st.mu, except while the store is configured.
+func (st *CQLStore) setCodecMaxAge(age int) {
+	st.syncedAge = age
+	if age <= 0 {
+		return
+	}
+	st.updateCodecs(func(codec *securecookie.SecureCookie) {
+		codec.MaxAge(age)
+	})
 }
 
-type saveError struct {
-	err error
+// Drain stops the store from creating sessions, for example to turn away new
+// logins during maintenance. Saving a session that has never been saved fails
+// with ErrDraining while existing sessions can still be loaded, saved and
+// deleted. Undrain resumes creating sessions.
+func (st *CQLStore) Drain() {
+	st.draining.Store(true)
 }
 
-func (e saveError) Error() string {
-	return "Could not save session data. Error: " + e.err.Error()
+// Undrain undoes Drain.
+func (st *CQLStore) Undrain() {
+	st.draining.Store(false)
 }
 
-type loadError struct {
-	err error
+// decodeFailed records that the cookie or data of s could not be decoded.
+func (st *CQLStore) decodeFailed(s *sessions.Session) {
+	st.decodeFailures.Add(1)
+	if st.clearBad {
+		s.Values[metaBadCookie] = true
+	}
 }
 
-func (e loadError) Error() string {
-	return "Could not load session data. Error: " + e.err.Error()
+// ClearBadCookie adds a Set-Cookie header to w that deletes the cookie of s if
+// New could not decode it or the session data it refers to, and reports
+// whether it did. Browsers otherwise keep sending such cookies, after keys
+// were rotated out for example, and every request fails to load them again.
+// Saving s replaces the cookie too. It requires WithClearBadCookies, with
+// which Middleware calls it for every session.
+func (st *CQLStore) ClearBadCookie(w http.ResponseWriter, s *sessions.Session) bool {
+	if bad, _ := s.Values[metaBadCookie].(bool); !bad {
+		return false
+	}
+	delete(s.Values, metaBadCookie)
+
+	opts := *s.Options
+	opts.MaxAge = -1
+	http.SetCookie(w, sessions.NewCookie(s.Name(), "", &opts))
+	return true
+}
+
+// DecodeFailures reports how many times New has failed to decode a session ID
+// cookie or the session data it refers to. A sudden increase usually means
+// someone is tampering with cookies or keys were rotated incorrectly.
+func (st *CQLStore) DecodeFailures() uint64 {
+	return st.decodeFailures.Load()
+}
+
+// Save persists session values to the database and adds the session ID cookie
+// to the request. Save must be called before writing the response or the
+// cookie will not be sent.
+func (st *CQLStore) Save(r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
+	return st.saveSession(st.queryContext(), r, w, s)
+}
+
+// saveSession does the work of Save, saving the session with ctx.
+func (st *CQLStore) saveSession(ctx context.Context, r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
+	if headersSent(w) {
+		return saveError{ErrHeadersAlreadySent}
+	}
+	if err := st.persist(ctx, r, s); err != nil {
+		return err
+	}
+	return st.setCookie(w, s)
+}
+
+// SaveWithTimestamp is like Save but writes the session's row with the given
+// write timestamp, in microseconds since the epoch, instead of the current
+// time. Cassandra keeps whichever write has the highest timestamp, so an
+// import given the timestamp of the data it replays does not overwrite newer
+// changes however late it runs. It can not be used with
+// WithOptimisticLocking since Cassandra does not allow custom timestamps on
+// conditional writes.
+func (st *CQLStore) SaveWithTimestamp(r *http.Request, w http.ResponseWriter, s *sessions.Session, micros int64) error {
+	if st.locking {
+		return saveError{errors.New("SaveWithTimestamp can not be used with WithOptimisticLocking")}
+	}
+
+	s.Values[metaTimestamp] = micros
+	defer delete(s.Values, metaTimestamp)
+	return st.Save(r, w, s)
+}
+
+// SaveIfChanged is like Save but does nothing if the values of s are the same
+// as when it was loaded or last saved. Neither the row's time to live nor the
+// cookie are refreshed then, so sessions only handled this way are not kept
+// alive. New sessions and sessions being deleted are always saved. The store
+// must have been created with the WithChangeDetection Option.
+func (st *CQLStore) SaveIfChanged(r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
+	if !st.changeDetection {
+		return saveError{errors.New("SaveIfChanged requires the WithChangeDetection option")}
+	}
+	if s.IsNew || s.Options.MaxAge < 0 {
+		return st.Save(r, w, s)
+	}
+	stored, ok := s.Values[metaStored].(row)
+	if !ok {
+		return st.Save(r, w, s)
+	}
+
+	values := make(map[interface{}]interface{})
+	if err := st.decodeRow(s.Name(), stored, &values); err != nil {
+		return st.Save(r, w, s)
+	}
+	if !reflect.DeepEqual(values, storedValues(s.Values)) {
+		return st.Save(r, w, s)
+	}
+	return nil
+}
+
+// Update loads the session with the given name for r, calls fn with its
+// values and saves it, all in one call. If fn returns an error nothing is
+// saved and Update returns it. With WithOptimisticLocking a session saved by
+// someone else in the meantime is loaded again and fn is called again with
+// its values, so fn must only change the values it is given. A request
+// without a session cookie, or whose session no longer exists, gets a new
+// session. Any other error loading the session is returned without calling
+// fn. Update does not use the request's registry so sessions returned by Get
+// do not see the changes.
+func (st *CQLStore) Update(r *http.Request, w http.ResponseWriter, name string, fn func(values map[interface{}]interface{}) error) error {
+	for attempt := 1; ; attempt++ {
+		s, err := st.New(r, name)
+		if err != nil && !errors.Is(err, gocql.ErrNotFound) {
+			return err
+		}
+
+		if err := fn(s.Values); err != nil {
+			return err
+		}
+
+		err = st.Save(r, w, s)
+		if errors.Is(err, ErrConcurrentModification) && attempt < maxMergeAttempts {
+			continue
+		}
+		return err
+	}
+}
+
+// persist does the database work of Save for s without touching the
+// response.
+func (st *CQLStore) persist(ctx context.Context, r *http.Request, s *sessions.Session) error {
+	if err := st.checkSave(s); err != nil {
+		return err
+	}
+
+	if s.Options.MaxAge < 0 {
+		if err := st.remove(ctx, s); err != nil {
+			return saveError{err}
+		}
+		return nil
+	}
+
+	existing, err := st.beginSave(r, s)
+	if err != nil {
+		return err
+	}
+
+	// Move a session whose cookie is too old to a new ID. The old row is
+	// deleted once the session is saved under the new one.
+	var reissued string
+	if st.reissueAge > 0 {
+		issued, _ := s.Values[metaIssued].(time.Time)
+		if !existing || st.now().Sub(issued) >= st.reissueAge {
+			if existing {
+				reissued = s.ID
+				s.ID = st.newID()
+				delete(s.Values, metaVersion)
+			}
+			s.Values[metaIssued] = st.now()
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		encData, err := st.encodeSession(ctx, s, existing, existing && reissued == "")
+		if err != nil {
+			return err
+		}
+
+		err = st.save(ctx, s, encData, st.rowTTL(s.Name()))
+		if err == ErrConcurrentModification && st.merge != nil && attempt < maxMergeAttempts {
+			// Someone else saved between our merge and our write. Merge
+			// their changes too and try again.
+			continue
+		}
+		if err != nil {
+			return saveError{err}
+		}
+		break
+	}
+
+	if reissued != "" {
+		if err := st.delete(ctx, reissued, s.Name()); err != nil {
+			return saveError{err}
+		}
+		if user := st.userOf(s); user != "" {
+			if err := st.deleteUserEntry(ctx, user, reissued); err != nil {
+				return saveError{err}
+			}
+		}
+	}
+
+	st.finishSave(ctx, s, existing)
+	return nil
+}
+
+// checkSave makes the checks Save does before writing anything for s and
+// brings its MaxAge within the limits of the store.
+func (st *CQLStore) checkSave(s *sessions.Session) error {
+	if st.readOnly {
+		return saveError{ErrReadOnly}
+	}
+	if !validCookieName(s.Name()) {
+		return saveError{ErrInvalidCookieName}
+	}
+	if s.Options.SameSite == http.SameSiteNoneMode && !s.Options.Secure {
+		return saveError{ErrInsecureSameSiteNone}
+	}
+	if s.Options.Partitioned && !s.Options.Secure {
+		return saveError{ErrInsecurePartitioned}
+	}
+
+	if s.Options.MaxAge < -1 {
+		s.Options.MaxAge = -1
+	}
+	if ceiling := st.ceiling(); s.Options.MaxAge > ceiling {
+		st.logger.Printf("cqlstore: MaxAge %d of session %s is over the ceiling of %d and was lowered",
+			s.Options.MaxAge, s.Name(), ceiling)
+		s.Options.MaxAge = ceiling
+	}
+	return nil
+}
+
+// beginSave gives s an ID if it is new and its tenant, then calls
+// BeforeSave. It reports whether s was saved before.
+func (st *CQLStore) beginSave(r *http.Request, s *sessions.Session) (bool, error) {
+	existing := s.ID != ""
+	if !existing && st.draining.Load() {
+		return false, saveError{ErrDraining}
+	}
+	if !existing {
+		s.ID = st.newID()
+	}
+
+	if st.tenant != nil {
+		s.Values[metaTenant] = st.tenant(r)
+	}
+
+	if st.BeforeSave != nil {
+		if err := st.BeforeSave(s); err != nil {
+			if !existing {
+				s.ID = ""
+			}
+			return existing, saveError{err}
+		}
+	}
+	return existing, nil
+}
+
+// encodeSession merges the values of s with the stored ones, if merge is set
+// and the store has a MergeFunc, validates them and encodes them for storage.
+// A new session, one that was not existing, loses its ID if it is invalid.
+func (st *CQLStore) encodeSession(ctx context.Context, s *sessions.Session, existing, merge bool) (string, error) {
+	if st.merge != nil && merge {
+		if err := st.mergeStored(ctx, s); err != nil {
+			return "", saveError{err}
+		}
+	}
+
+	if st.validator != nil {
+		if err := st.validator(storedValues(s.Values)); err != nil {
+			if !existing {
+				s.ID = ""
+			}
+			return "", saveError{fmt.Errorf("%w: %w", ErrValidation, err)}
+		}
+	}
+
+	encData, err := st.encodeData(s.Name(), storedValues(s.Values))
+	if err != nil {
+		return "", saveError{err}
+	}
+	return encData, nil
+}
+
+// finishSave does the bookkeeping for s once it was written.
+func (st *CQLStore) finishSave(ctx context.Context, s *sessions.Session, existing bool) {
+	st.saved.Add(1)
+	if !existing {
+		st.created.Add(1)
+		if st.globalMax > 0 {
+			// The session was saved fine, failing to make room for it
+			// should not fail the request.
+			if err := st.evictOverGlobalMax(ctx); err != nil {
+				st.logger.Printf("cqlstore: could not evict sessions over the global maximum: %v", err)
+			}
+		}
+	}
+	if st.AfterSave != nil {
+		st.AfterSave(s)
+	}
+}
+
+// setCookie adds the cookie for s to the response, clearing it if s was
+// deleted.
+func (st *CQLStore) setCookie(w http.ResponseWriter, s *sessions.Session) error {
+	if s.Options.MaxAge < 0 {
+		http.SetCookie(w, sessions.NewCookie(s.Name(), "", s.Options))
+		return nil
+	}
+
+	opts := s.Options
+	if st.browserTTL > 0 {
+		browser := *opts
+		browser.MaxAge = 0
+		opts = &browser
+	}
+
+	// Encode the session ID and set it in a cookie
+	issued, _ := s.Values[metaIssued].(time.Time)
+	encID, err := st.encodeID(s.Name(), s.ID, issued)
+	if err != nil {
+		return saveError{err}
+	}
+	cookie := sessions.NewCookie(s.Name(), encID, opts)
+	if st.expires && opts.MaxAge > 0 {
+		// NewCookie uses the wall clock, keep Expires in step with the
+		// store's.
+		cookie.Expires = st.now().Add(time.Duration(opts.MaxAge) * time.Second)
+	}
+	http.SetCookie(w, cookie)
+
+	return nil
+}
+
+// Reset removes every value from s and immediately writes the empty session
+// to the database. The session keeps its ID, so its cookie stays valid, and
+// its row gets a fresh time to live as if it were saved. A session that has
+// never been saved is only emptied. Reset does not merge with stored values
+// or call BeforeSave and AfterSave.
+func (st *CQLStore) Reset(s *sessions.Session) error {
+	if st.readOnly {
+		return saveError{ErrReadOnly}
+	}
+
+	for k := range s.Values {
+		if _, ok := k.(metaKey); !ok {
+			delete(s.Values, k)
+		}
+	}
+	if s.ID == "" {
+		return nil
+	}
+
+	encData, err := st.encodeData(s.Name(), storedValues(s.Values))
+	if err != nil {
+		return saveError{err}
+	}
+	if err := st.save(st.queryContext(), s, encData, st.rowTTL(s.Name())); err != nil {
+		return saveError{err}
+	}
+
+	return nil
+}
+
+// RemainingTTL returns how long the session id has left before its row
+// expires. It returns 0 for a session saved without a time to live and
+// ErrSessionNotFound if the session does not exist. With WithNameInKey the
+// first session using the ID is checked.
+func (st *CQLStore) RemainingTTL(id string) (time.Duration, error) {
+	r, err := st.load(st.queryContext(), id, "")
+	if err == gocql.ErrNotFound {
+		return 0, ErrSessionNotFound
+	}
+	if err != nil {
+		return 0, loadError{err}
+	}
+
+	return time.Duration(r.ttl) * time.Second, nil
+}
+
+// Logout deletes the session with the given name identified by the request's
+// cookie and clears the cookie. It is the same as setting the session's MaxAge
+// to -1 and saving it. If the request has no session that can be loaded only
+// the cookie is cleared.
+func (st *CQLStore) Logout(r *http.Request, w http.ResponseWriter, name string) error {
+	if headersSent(w) {
+		return saveError{ErrHeadersAlreadySent}
+	}
+	if !validCookieName(name) {
+		return saveError{ErrInvalidCookieName}
+	}
+
+	// Use the registry so a copy of the session loaded earlier in the request
+	// is not saved again after it is deleted.
+	s, _ := st.Get(r, name)
+	s.Options.MaxAge = -1
+
+	if s.ID == "" {
+		http.SetCookie(w, sessions.NewCookie(name, "", s.Options))
+		return nil
+	}
+
+	return st.Save(r, w, s)
+}
+
+// maxMergeAttempts is how many times Save will merge and write a session when
+// both WithMergeFunc and WithOptimisticLocking are in use and the write keeps
+// losing the race with other saves.
+const maxMergeAttempts = 3
+
+// row holds the stored fields of a session.
+type row struct {
+	data      string
+	fields    map[string][]byte
+	version   int
+	tenant    string
+	appTag    string
+	createdAt time.Time
+	ttl       int
+}
+
+// size returns the number of bytes of encoded session data in r.
+func (r row) size() int {
+	n := len(r.data)
+	for _, b := range r.fields {
+		n += len(b)
+	}
+	return n
+}
+
+// load reads the stored fields of session id with the given name.
+func (st *CQLStore) load(ctx context.Context, id, name string) (row, error) {
+	return st.loadRow(ctx, id, name, nil)
+}
+
+// loadRow is load reading the data column into buf when it is not nil. The
+// data of the row returned is then only valid until buf is used again.
+func (st *CQLStore) loadRow(ctx context.Context, id, name string, buf *loadBuffer) (row, error) {
+	var r row
+	var raw []byte
+	cols := `"data"`
+	dest := []interface{}{&r.data}
+	if buf != nil {
+		dest[0] = &buf.raw
+	} else if st.binary {
+		dest[0] = &raw
+	}
+	if st.locking {
+		cols += `, "version"`
+		dest = append(dest, &r.version)
+	}
+	if st.tenant != nil {
+		cols += `, "tenant"`
+		dest = append(dest, &r.tenant)
+	}
+	if st.appTag != "" {
+		cols += `, "app_tag"`
+		dest = append(dest, &r.appTag)
+	}
+	if st.absoluteTimeout > 0 {
+		cols += `, "created_at"`
+		dest = append(dest, &r.createdAt)
+	}
+	cols += `, TTL("data")`
+	dest = append(dest, &r.ttl)
+	if st.fieldEncryption {
+		cols += `, "fields"`
+		dest = append(dest, &r.fields)
+	}
+	var chunks map[int][]byte
+	if st.chunkSize > 0 {
+		cols += `, "chunks"`
+		dest = append(dest, &chunks)
+	}
+
+	where, args := st.where(id, name)
+	err := st.rowQuery(ctx, id, `SELECT `+cols+` FROM "`+st.table+`" WHERE `+where, args...).Scan(dest...)
+	if buf != nil {
+		raw = buf.raw
+		if !st.binary {
+			r.data = buf.view(raw)
+		}
+	}
+	if err == nil {
+		r.data, raw = st.unchunkData(r.data, raw, chunks)
+	}
+	if st.binary && buf != nil {
+		r.data = buf.encodeBinary(raw)
+	} else if st.binary {
+		r.data = encodeBinary(raw)
+	} else if err == nil {
+		r.data, err = decodeText(r.data)
+	}
+	if err == nil && r.data == "" {
+		// The session was deleted with WithExpireDelete and has not quite
+		// expired yet.
+		err = gocql.ErrNotFound
+	}
+	return r, err
+}
+
+// mergeStored replaces the values of s with the result of the store's
+// MergeFunc applied to the values currently in the database and the values of
+// s. Sessions that are no longer in the database are left alone.
+func (st *CQLStore) mergeStored(ctx context.Context, s *sessions.Session) error {
+	r, err := st.load(ctx, s.ID, s.Name())
+	if err == gocql.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	stored := make(map[interface{}]interface{})
+	if err := st.decodeRow(s.Name(), r, &stored); err != nil {
+		return err
+	}
+
+	merged := st.merge(stored, storedValues(s.Values))
+	for k, v := range s.Values {
+		if _, ok := k.(metaKey); ok {
+			merged[k] = v
+		}
+	}
+	if st.locking {
+		// We merged with what is stored now so that is what we expect to
+		// overwrite.
+		merged[metaVersion] = r.version
+	}
+	s.Values = merged
+
+	return nil
+}
+
+// save writes the encoded session data for s along with any bookkeeping rows
+// required by the store's Options. The rows expire after ttl seconds.
+func (st *CQLStore) save(ctx context.Context, s *sessions.Session, encData string, ttl int) error {
+	if ceiling := st.ceiling(); ttl > ceiling {
+		ttl = ceiling
+	}
+
+	now := st.now()
+	cols, vals, fields, err := st.rowColumns(s, encData, now)
+	if err != nil {
+		return err
+	}
+
+	var prev time.Time
+	if st.recentBuckets > 0 {
+		if prev, err = st.updatedAt(ctx, s.ID, s.Name()); err != nil {
+			return err
+		}
+		cols = append(cols, "updated_at")
+		vals = append(vals, now)
+	}
+
+	defer st.uncache(s.ID)
+	if err := st.write(ctx, s, cols, vals, ttl); err != nil {
+		return err
+	}
+	if st.changeDetection {
+		s.Values[metaStored] = row{data: encData, fields: fields}
+	}
+
+	if st.recentBuckets > 0 {
+		if err := st.touchRecent(ctx, s.ID, prev, now, ttl); err != nil {
+			return err
+		}
+	}
+
+	if st.userKey != nil {
+		return st.indexUser(ctx, s, now, ttl)
+	}
+
+	return nil
+}
+
+// rowColumns returns the columns, other than the key, and values of the row
+// of s holding the encoded data encData when it is written at now. The values
+// encrypted with WithFieldEncryption are returned too.
+func (st *CQLStore) rowColumns(s *sessions.Session, encData string, now time.Time) ([]string, []interface{}, map[string][]byte, error) {
+	data, err := st.dataValue(encData)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var chunks map[int][]byte
+	if st.chunkSize > 0 {
+		data, chunks = st.chunk(data)
+	}
+
+	cols := []string{"data"}
+	vals := []interface{}{data}
+
+	if st.chunkSize > 0 {
+		cols = append(cols, "chunks")
+		vals = append(vals, chunks)
+	}
+
+	var fields map[string][]byte
+	if st.fieldEncryption {
+		if fields, err = st.encodeFields(s.Name(), storedValues(s.Values)); err != nil {
+			return nil, nil, nil, err
+		}
+		cols = append(cols, "fields")
+		vals = append(vals, fields)
+	}
+
+	if st.tenant != nil {
+		tenant, _ := s.Values[metaTenant].(string)
+		cols = append(cols, "tenant")
+		vals = append(vals, tenant)
+	}
+
+	if st.appTag != "" {
+		cols = append(cols, "app_tag")
+		vals = append(vals, st.appTag)
+	}
+
+	if st.maxIdle > 0 {
+		cols = append(cols, "last_accessed")
+		vals = append(vals, now)
+	}
+	if st.absoluteTimeout > 0 {
+		created, _ := s.Values[metaCreatedAt].(time.Time)
+		if created.IsZero() {
+			created = now
+			s.Values[metaCreatedAt] = created
+		}
+		cols = append(cols, "created_at")
+		vals = append(vals, created)
+	}
+
+	return cols, vals, fields, nil
+}
+
+// write stores the given columns in the session row for s. With optimistic
+// locking it only succeeds if the row has not been saved since s was loaded.
+func (st *CQLStore) write(ctx context.Context, s *sessions.Session, cols []string, vals []interface{}, ttl int) error {
+	if !st.locking {
+		stmt, args := st.insert(s, cols, vals, ttl)
+		return st.rowQuery(ctx, s.ID, stmt, args...).Exec()
+	}
+
+	keyCols, keyVals := st.key(s.ID, s.Name())
+	var q query
+	version, loaded := s.Values[metaVersion].(int)
+	if loaded {
+		// Rows saved before locking was enabled have no version.
+		var expected interface{} = version
+		if version == 0 {
+			expected = nil
+		}
+
+		set := make([]string, len(cols))
+		for i, c := range cols {
+			set[i] = `"` + c + `" = ?`
+		}
+		where, whereArgs := st.where(s.ID, s.Name())
+		args := append([]interface{}{ttl}, vals...)
+		args = append(append(append(args, version+1), whereArgs...), expected)
+		q = st.rowQuery(ctx, s.ID, `UPDATE "`+st.table+`" USING TTL ? SET `+strings.Join(set, ", ")+
+			`, "version" = ? WHERE `+where+` IF "version" = ?`, args...)
+	} else {
+		cols = append(append(keyCols, cols...), "version")
+		args := append(append(keyVals, vals...), 1, ttl)
+		q = st.rowQuery(ctx, s.ID, `INSERT INTO "`+st.table+`" (`+columnList(cols)+`)`+
+			` VALUES(`+placeholders(len(cols))+`) IF NOT EXISTS USING TTL ?`, args...)
+	}
+
+	applied, err := q.MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return ErrConcurrentModification
+	}
+
+	s.Values[metaVersion] = version + 1
+	return nil
+}
+
+// insert returns an INSERT statement, and its arguments, unconditionally
+// writing the given columns to the row of s with the time to live ttl.
+func (st *CQLStore) insert(s *sessions.Session, cols []string, vals []interface{}, ttl int) (string, []interface{}) {
+	keyCols, keyVals := st.key(s.ID, s.Name())
+	cols = append(keyCols, cols...)
+	args := append(append(keyVals, vals...), ttl)
+	stmt := `INSERT INTO "` + st.table + `" (` + columnList(cols) + `)` +
+		` VALUES(` + placeholders(len(cols)) + `) USING TTL ?`
+	if ts, ok := s.Values[metaTimestamp].(int64); ok {
+		stmt += ` AND TIMESTAMP ?`
+		args = append(args, ts)
+	}
+	return stmt, args
+}
+
+// key returns the primary key columns and values of the row for session id
+// with the given name.
+func (st *CQLStore) key(id, name string) ([]string, []interface{}) {
+	id = st.rowID(id)
+	if st.nameInKey {
+		return []string{"id", "name"}, []interface{}{id, name}
+	}
+	return []string{"id"}, []interface{}{id}
+}
+
+// where returns a WHERE clause and its arguments selecting the row of session
+// id with the given name. With WithNameInKey an empty name selects the rows of
+// every name using the ID.
+func (st *CQLStore) where(id, name string) (string, []interface{}) {
+	id = st.rowID(id)
+	if st.nameInKey && name != "" {
+		return `"id" = ? AND "name" = ?`, []interface{}{id, name}
+	}
+	return `"id" = ?`, []interface{}{id}
+}
+
+// rowID returns the value of the id column for session id. With
+// WithHashedKey it is a UUID made from the SHA-256 hash of id.
+func (st *CQLStore) rowID(id string) string {
+	if !st.hashedKey {
+		return id
+	}
+	sum := sha256.Sum256([]byte(id))
+	// Mark it as a version 5 (name based, SHA) UUID
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	u, _ := gocql.UUIDFromBytes(sum[:16])
+	return u.String()
+}
+
+// validID reports whether id can be a session ID of the store. Unless the id
+// column holds text or hashes, IDs must be UUIDs.
+func (st *CQLStore) validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	if st.textID || st.hashedKey {
+		return true
+	}
+	_, err := gocql.ParseUUID(id)
+	return err == nil
+}
+
+// newID returns an ID for a new session.
+func (st *CQLStore) newID() string {
+	if st.idGenerator != nil {
+		return st.idGenerator()
+	}
+	// TODO is there a better one to use here?
+	return gocql.UUIDFromTime(time.Now()).String()
+}
+
+// dataValue converts encoded session data to the value stored in the data
+// column.
+func (st *CQLStore) dataValue(encData string) (interface{}, error) {
+	if !st.binary {
+		return encodeText(encData), nil
+	}
+	return decodeBinary(encData)
+}
+
+// textPrefix marks data in the text column that had to be base64 encoded to
+// be stored. The colon is not part of the base64 alphabet securecookie uses so
+// it can not be confused with regular data.
+const textPrefix = "b64:"
+
+// encodeText makes encoded session data safe to store in a text column which
+// Cassandra requires to be valid UTF-8. securecookie always produces base64
+// text which is stored as is but a custom Codec may produce arbitrary bytes.
+func encodeText(encData string) string {
+	if utf8.ValidString(encData) && !strings.HasPrefix(encData, textPrefix) {
+		return encData
+	}
+	return textPrefix + base64.RawURLEncoding.EncodeToString([]byte(encData))
+}
+
+// decodeText reverses encodeText.
+func decodeText(data string) (string, error) {
+	if !strings.HasPrefix(data, textPrefix) {
+		return data, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(data, textPrefix))
+	return string(raw), err
+}
+
+// encodeBinary and decodeBinary convert between the base64 text securecookie
+// produces and the raw bytes stored with WithBinaryData.
+func encodeBinary(raw []byte) string {
+	return base64.URLEncoding.EncodeToString(raw)
+}
+
+func decodeBinary(encData string) ([]byte, error) {
+	return base64.URLEncoding.DecodeString(encData)
+}
+
+// columnList quotes and joins column names for use in a statement.
+func columnList(cols []string) string {
+	return `"` + strings.Join(cols, `", "`) + `"`
+}
+
+// placeholders returns n comma separated bind markers.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// remove deletes s the way a Save with a negative MaxAge does: its rows and
+// user index entry go, the deletion is counted and AfterDelete is called.
+func (st *CQLStore) remove(ctx context.Context, s *sessions.Session) error {
+	if err := st.delete(ctx, s.ID, s.Name()); err != nil {
+		return err
+	}
+	if err := st.unindexUser(ctx, s); err != nil {
+		return err
+	}
+	st.deleted.Add(1)
+	if st.AfterDelete != nil {
+		st.AfterDelete(s)
+	}
+	return nil
+}
+
+// evict removes the session id pushed out by WithMaxSessionsPerUser or
+// WithGlobalMaxSessions through remove. Its values are loaded first so
+// AfterDelete sees them; a session that can not be decoded is still removed,
+// just without them. user is the user whose index entry named the session, if
+// any, and that entry is removed even when the session is already gone.
+func (st *CQLStore) evict(ctx context.Context, id, user string) error {
+	r, err := st.load(ctx, id, st.sessionName)
+	if err == gocql.ErrNotFound {
+		if user == "" {
+			return nil
+		}
+		return st.deleteUserEntry(ctx, user, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	s := sessions.NewSession(st, st.sessionName)
+	s.ID = id
+	s.Options.MaxAge = -1
+	st.decodeRow(st.sessionName, r, &s.Values)
+	if err := st.remove(ctx, s); err != nil {
+		return err
+	}
+	if user != "" && user != st.userOf(s) {
+		return st.deleteUserEntry(ctx, user, id)
+	}
+	return nil
+}
+
+// delete removes the session row for id with the given name along with any
+// bookkeeping rows.
+func (st *CQLStore) delete(ctx context.Context, id, name string) error {
+	var prev time.Time
+	if st.recentBuckets > 0 {
+		var err error
+		if prev, err = st.updatedAt(ctx, id, name); err != nil {
+			return err
+		}
+	}
+
+	defer st.uncache(id)
+	if err := st.deleteRow(ctx, id, name); err != nil {
+		return err
+	}
+
+	if st.recentBuckets > 0 {
+		return st.touchRecent(ctx, id, prev, time.Time{}, 0)
+	}
+
+	return nil
+}
+
+// deleteRow removes the session row for id with the given name.
+func (st *CQLStore) deleteRow(ctx context.Context, id, name string) error {
+	stmt, args := st.deleteStmt(id, name)
+	return st.rowQuery(ctx, id, stmt, args...).Exec()
+}
+
+// deleteStmt returns the statement, and its arguments, removing the session
+// row for id with the given name. With WithExpireDelete the row is
+// overwritten to expire in a second instead.
+func (st *CQLStore) deleteStmt(id, name string) (string, []interface{}) {
+	keyCols, keyVals := st.key(id, name)
+
+	// Without a name we can not write a row for every name sharing the ID so
+	// fall back to deleting them all. The fields and chunks columns can not
+	// be given a TTL of a second without writing them, and writing a
+	// collection replaces it with a tombstone anyway, so they are deleted too.
+	if !st.expireDelete || (st.nameInKey && name == "") || st.fieldEncryption || st.chunkSize > 0 {
+		where, args := st.where(id, name)
+		return `DELETE FROM "` + st.table + `" WHERE ` + where, args
+	}
+
+	// Every cell has its own TTL and only an INSERT replaces the TTL of the
+	// row itself so each column has to be written again. Writing nulls would
+	// create the tombstones we are trying to avoid.
+	data, _ := st.dataValue("")
+	cols := append(keyCols, "data")
+	vals := append(keyVals, data)
+	if st.recentBuckets > 0 {
+		cols = append(cols, "updated_at")
+		vals = append(vals, st.now())
+	}
+	if st.locking {
+		cols = append(cols, "version")
+		vals = append(vals, 0)
+	}
+	if st.tenant != nil {
+		cols = append(cols, "tenant")
+		vals = append(vals, "")
+	}
+	if st.appTag != "" {
+		cols = append(cols, "app_tag")
+		vals = append(vals, st.appTag)
+	}
+	if st.absoluteTimeout > 0 {
+		cols = append(cols, "created_at")
+		vals = append(vals, st.now())
+	}
+	if st.maxIdle > 0 {
+		cols = append(cols, "last_accessed")
+		vals = append(vals, st.now())
+	}
+
+	return `INSERT INTO "` + st.table + `" (` + columnList(cols) + `)` +
+		` VALUES(` + placeholders(len(cols)) + `) USING TTL 1`, vals
+}
+
+// ErrTableRequired is returned when creating a store without a table name.
+var ErrTableRequired = errors.New("A table name is required to store sessions")
+
+// ErrInvalidKey is returned when creating a store with keys that are missing,
+// not in pairs or of the wrong length. See WithKeyPairs.
+var ErrInvalidKey = errors.New("Invalid session key")
+
+// ErrNoCookie is returned by NewOrErr when the request has no cookie for the
+// session.
+var ErrNoCookie = errors.New("Request has no session cookie")
+
+// ErrInvalidCookieName is returned by New and Save for session names that can
+// not be used as cookie names. Names may only contain letters, digits and
+// !#$%&'*+-.^_`|~.
+var ErrInvalidCookieName = errors.New("Invalid session cookie name")
+
+// ErrInsecureSameSiteNone is returned by Save for sessions with SameSite=None
+// cookies that are not Secure. Browsers drop such cookies.
+var ErrInsecureSameSiteNone = errors.New("SameSite=None session cookies must be Secure")
+
+// ErrInsecurePartitioned is returned by Save for sessions with Partitioned
+// cookies that are not Secure. Browsers drop such cookies.
+var ErrInsecurePartitioned = errors.New("Partitioned session cookies must be Secure")
+
+// ErrInvalidCookie is returned by DecodeID when a cookie value can not be
+// decoded with the store's keys, and by New when a cookie decodes to something
+// that can not be a session ID.
+var ErrInvalidCookie = errors.New("Invalid session cookie")
+
+// ErrValueTooLong is returned by New when a session's stored data is larger
+// than the store's MaxLoadSize.
+var ErrValueTooLong = errors.New("Stored session data is too long")
+
+// ErrSessionNotFound is returned when a session that was asked for by ID is
+// not in the database.
+var ErrSessionNotFound = errors.New("Session not found")
+
+// ErrReadOnly is returned by anything that would write to the database when
+// the store was created with WithReadOnlyStore.
+var ErrReadOnly = errors.New("Session store is read only")
+
+// ErrDraining is returned by Save for a new session while the store is
+// drained with Drain.
+var ErrDraining = errors.New("Session store is draining and not creating sessions")
+
+// ErrHeadersAlreadySent is returned by Save when it is called with a
+// ResponseWriter from Middleware after the response was started, when the
+// cookie can no longer be set. Nothing is saved.
+var ErrHeadersAlreadySent = errors.New("Response headers were already sent")
+
+// ErrValidation is returned by Save, wrapping the validator's error, when the
+// validator set with WithValuesValidator rejects a session's values.
+var ErrValidation = errors.New("Session values are invalid")
+
+// ErrConcurrentModification is returned by Save when optimistic locking is
+// enabled and the session was saved by someone else after it was loaded.
+var ErrConcurrentModification = errors.New("Session was modified since it was loaded")
+
+// ErrTenantMismatch is returned by New when WithTenant is used and the
+// request's session cookie belongs to a different tenant.
+var ErrTenantMismatch = errors.New("Session belongs to a different tenant")
+
+// ErrAppTagMismatch is returned by New when WithRejectForeignTags is used and
+// the request's session was saved by a store with a different WithAppTag.
+var ErrAppTagMismatch = errors.New("Session was saved by a different app")
+
+// ErrSessionExpired is returned by New when a session is older than the
+// limit set with WithAbsoluteTimeout.
+var ErrSessionExpired = errors.New("Session has expired")
+
+// TODO better error handling
+
+type createError struct {
+	err error
+}
+
+func (e createError) Error() string {
+	return "Could not create sessions table. Error: " + e.err.Error()
+}
+
+func (e createError) Unwrap() error {
+	return e.err
+}
+
+type saveError struct {
+	err error
+}
+
+func (e saveError) Error() string {
+	return "Could not save session data. Error: " + e.err.Error()
+}
+
+func (e saveError) Unwrap() error {
+	return e.err
+}
+
+type loadError struct {
+	err error
+}
+
+func (e loadError) Error() string {
+	return "Could not load session data. Error: " + e.err.Error()
+}
+
+func (e loadError) Unwrap() error {
+	return e.err
 }
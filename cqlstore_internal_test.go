@@ -0,0 +1,709 @@
+package cqlstore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+func TestLogout(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Save a session
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(req1, "test-sess")
+	sess.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+
+	// Log out with its cookie
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	w2 := httptest.NewRecorder()
+	if err := store.Logout(req2, w2, "test-sess"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(db.rows("sessions")); n != 0 {
+		t.Errorf("expected no rows after logging out, got %d", n)
+	}
+	if c := w2.Header().Get("Set-Cookie"); !strings.HasPrefix(c, "test-sess=; ") {
+		t.Errorf("expected the cookie to be cleared, got %q", c)
+	}
+
+	// Logging out without a session just clears the cookie
+	req3, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	w3 := httptest.NewRecorder()
+	if err := store.Logout(req3, w3, "test-sess"); err != nil {
+		t.Fatal(err)
+	}
+	if c := w3.Header().Get("Set-Cookie"); !strings.HasPrefix(c, "test-sess=; ") {
+		t.Errorf("expected the cookie to be cleared, got %q", c)
+	}
+}
+
+func TestReset(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Save a session with some values
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(req1, "test-sess")
+	sess.Values["cart"] = "3 apples"
+	sess.Values["user"] = "bob"
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+	id := sess.ID
+
+	// Reset and save it again
+	if err := store.Reset(sess); err != nil {
+		t.Fatal(err)
+	}
+	if len(sess.Values) != 0 {
+		t.Errorf("expected no values after resetting, got %v", sess.Values)
+	}
+	if sess.ID != id {
+		t.Errorf("expected ID %q to be kept, got %q", id, sess.ID)
+	}
+	if err := sess.Save(req1, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The original cookie loads the same, now empty, session
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	sess2, err := store.New(req2, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess2.ID != id {
+		t.Errorf("expected ID %q, got %q", id, sess2.ID)
+	}
+	if len(sess2.Values) != 0 {
+		t.Errorf("expected no values after reloading, got %v", sess2.Values)
+	}
+}
+
+// BenchmarkLoadLargeSession measures loading a session holding a large value,
+// with the data copied out of the result as usual and with WithInPlaceDecode.
+func BenchmarkLoadLargeSession(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		opts []Option
+	}{
+		{"copy", nil},
+		{"in place", []Option{WithInPlaceDecode()}},
+		{"binary copy", []Option{WithBinaryData()}},
+		{"binary in place", []Option{WithBinaryData(), WithInPlaceDecode()}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			store, err := newStore(newFakeDB(), "sessions", append(bm.opts, WithKeyPairs(testKeys...))...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			store.MaxLength(0)
+
+			r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+			sess, _ := store.New(r, "test-sess")
+			sess.Values["big"] = strings.Repeat("x", 1<<20)
+
+			w := httptest.NewRecorder()
+			if err := sess.Save(r, w); err != nil {
+				b.Fatal(err)
+			}
+			cookies := (&http.Response{Header: w.Header()}).Cookies()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+				for _, c := range cookies {
+					r.AddCookie(c)
+				}
+				if _, err := store.New(r, "test-sess"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestInPlaceDecode(t *testing.T) {
+	for _, binary := range []bool{false, true} {
+		opts := []Option{WithKeyPairs(testKeys...), WithInPlaceDecode()}
+		if binary {
+			opts = append(opts, WithBinaryData())
+		}
+		store, err := newStore(newFakeDB(), "sessions", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, _ := store.New(req1, "test-sess")
+		sess.Values["foo"] = "Foo"
+		w := httptest.NewRecorder()
+		if err := sess.Save(req1, w); err != nil {
+			t.Fatal(err)
+		}
+
+		// Load it twice so the second load reuses the buffer of the first.
+		for i := 0; i < 2; i++ {
+			req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+			for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+				req2.AddCookie(c)
+			}
+			sess2, err := store.New(req2, "test-sess")
+			if err != nil {
+				t.Fatalf("binary %v: %v", binary, err)
+			}
+			if sess2.Values["foo"] != "Foo" {
+				t.Errorf("binary %v: expected Foo, got %v", binary, sess2.Values["foo"])
+			}
+		}
+	}
+
+	_, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...), WithInPlaceDecode(), WithChangeDetection())
+	if err == nil {
+		t.Error("expected WithInPlaceDecode to be rejected with WithChangeDetection")
+	}
+}
+
+func TestRemainingTTL(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Options.MaxAge = 3600
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	ttl, err := store.RemainingTTL(sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != time.Hour {
+		t.Errorf("expected 1h remaining, got %s", ttl)
+	}
+
+	if _, err := store.RemainingTTL(gocql.TimeUUID().String()); err != ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestReadOnlyStore(t *testing.T) {
+	db := newFakeDB()
+	writer, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := writer.New(req1, "test-sess")
+	sess.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+
+	// Creating a read only store runs no DDL
+	before := len(db.statements())
+	reader, err := newStore(db, "sessions", WithKeyPairs(testKeys...), WithReadOnlyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(db.statements()); n != before {
+		t.Errorf("expected no statements creating a read only store, got %d", n-before)
+	}
+
+	// It can load sessions
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	sess2, err := reader.Get(req2, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess2.Values["foo"] != "Foo" {
+		t.Errorf("expected foo to be Foo, got %v", sess2.Values["foo"])
+	}
+
+	// But not save or delete them
+	if err := sess2.Save(req2, httptest.NewRecorder()); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected saving to fail with ErrReadOnly, got %v", err)
+	}
+	if err := reader.Logout(req2, httptest.NewRecorder(), "test-sess"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected deleting to fail with ErrReadOnly, got %v", err)
+	}
+	if n := len(db.rows("sessions")); n != 1 {
+		t.Errorf("expected the session to remain, got %d rows", n)
+	}
+
+	// Nor clean up the user index
+	indexed, err := newStore(db, "sessions", WithKeyPairs(testKeys...), WithReadOnlyStore(), WithUserIndex("user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = indexed.ReconcileUserIndex()
+	if _, ok := err.(saveError); !ok || !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected reconciling to fail with a save error of ErrReadOnly, got %v", err)
+	}
+}
+
+func TestMaxLoadSize(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.MaxLoadSize = 1024
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(req1, "test-sess")
+	sess.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+
+	// A session under the limit loads
+	sess2, err := store.New(req2, "test-sess")
+	if err != nil || sess2.IsNew {
+		t.Fatalf("expected the session to load, got %v", err)
+	}
+
+	// Replace the row with one over the limit
+	err = db.Query(`INSERT INTO "sessions" ("id", "data") VALUES(?, ?) USING TTL ?`,
+		sess.ID, strings.Repeat("x", 2048), 3600).Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess3, err := store.New(req2, "test-sess")
+	if !errors.Is(err, ErrValueTooLong) {
+		t.Errorf("expected ErrValueTooLong, got %v", err)
+	}
+	if !sess3.IsNew || sess3.ID != "" || len(sess3.Values) != 0 {
+		t.Errorf("expected a fresh session, got %s with %v", sess3.ID, sess3.Values)
+	}
+	if n := store.DecodeFailures(); n != 0 {
+		t.Errorf("expected the data not to be decoded, got %d failures", n)
+	}
+}
+
+func TestAppTag(t *testing.T) {
+	db := newFakeDB()
+	newTagged := func(tag string, opts ...Option) *CQLStore {
+		opts = append(opts, WithKeyPairs(testKeys...), WithAppTag(tag))
+		store, err := newStore(db, "sessions", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	v1 := newTagged("app/v1", WithRejectForeignTags())
+	v2 := newTagged("app/v2", WithRejectForeignTags())
+	lenient := newTagged("app/v3")
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := v1.New(req1, "test-sess")
+	sess.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+	if tag := db.rows("sessions")[sess.ID]["app_tag"]; tag != "app/v1" {
+		t.Errorf("expected the row to be tagged app/v1, got %v", tag)
+	}
+
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+
+	if sess2, err := v1.New(req2, "test-sess"); err != nil || sess2.Values["foo"] != "Foo" {
+		t.Errorf("expected the same app to load the session, got %v", err)
+	}
+
+	sess2, err := v2.New(req2, "test-sess")
+	if !errors.Is(err, ErrAppTagMismatch) {
+		t.Errorf("expected ErrAppTagMismatch, got %v", err)
+	}
+	if !sess2.IsNew || sess2.ID != "" || len(sess2.Values) != 0 {
+		t.Errorf("expected a fresh session, got %s with %v", sess2.ID, sess2.Values)
+	}
+
+	if sess3, err := lenient.New(req2, "test-sess"); err != nil || sess3.Values["foo"] != "Foo" {
+		t.Errorf("expected a store without WithRejectForeignTags to load the session, got %v", err)
+	}
+
+	if _, err := newStore(db, "sessions", WithKeyPairs(testKeys...), WithRejectForeignTags()); err == nil {
+		t.Error("expected WithRejectForeignTags without WithAppTag to fail")
+	}
+}
+
+func TestSaveIfChanged(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithChangeDetection(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(req1, "test-sess")
+	sess.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	if err := store.SaveIfChanged(req1, w, sess); err != nil {
+		t.Fatal(err)
+	}
+
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+
+	// writes counts the statements that wrote to the database.
+	writes := func() int {
+		n := 0
+		for _, stmt := range db.statements() {
+			if strings.HasPrefix(stmt, "INSERT") {
+				n++
+			}
+		}
+		return n
+	}
+	before := writes()
+
+	// Unmodified
+	sess2, err := store.New(req2, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	if err := store.SaveIfChanged(req2, w, sess2); err != nil {
+		t.Fatal(err)
+	}
+	if n := writes() - before; n != 0 {
+		t.Errorf("expected no writes for an unmodified session, got %d", n)
+	}
+	if c := w.Header().Get("Set-Cookie"); c != "" {
+		t.Errorf("expected no cookie for an unmodified session, got %q", c)
+	}
+
+	// Modified, then unmodified since that save
+	sess2.Values["foo"] = "Bar"
+	if err := store.SaveIfChanged(req2, httptest.NewRecorder(), sess2); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveIfChanged(req2, httptest.NewRecorder(), sess2); err != nil {
+		t.Fatal(err)
+	}
+	if n := writes() - before; n != 1 {
+		t.Errorf("expected 1 write for the modified session, got %d", n)
+	}
+}
+
+func TestSaveWithTimestamp(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(req1, "test-sess")
+	now := time.Now().UnixMicro()
+
+	// The newer version is written first, the older one can not replace it
+	sess.Values["v"] = "new"
+	w := httptest.NewRecorder()
+	if err := store.SaveWithTimestamp(req1, w, sess, now); err != nil {
+		t.Fatal(err)
+	}
+	sess.Values["v"] = "old"
+	if err := store.SaveWithTimestamp(req1, httptest.NewRecorder(), sess, now-1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sess.Values[metaTimestamp]; ok {
+		t.Error("expected the timestamp to be removed from the session")
+	}
+	if stmt := db.statements()[len(db.statements())-1]; !strings.Contains(stmt, "USING TTL ? AND TIMESTAMP ?") {
+		t.Errorf("expected a custom timestamp in %q", stmt)
+	}
+
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	sess2, err := store.New(req2, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := sess2.Values["v"]; v != "new" {
+		t.Errorf("expected the newer write to win, got %v", v)
+	}
+}
+
+func TestFresh(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...), WithCache(10, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(req1, "test-sess")
+	sess.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+
+	got, _ := store.Get(req2, "test-sess")
+
+	// Someone else changes the session
+	other, _ := store.New(req2, "test-sess")
+	other.Values["foo"] = "Bar"
+	if err := other.Save(req2, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	if again, _ := store.Get(req2, "test-sess"); again != got || again.Values["foo"] != "Foo" {
+		t.Errorf("expected Get to return the same session, got %v", again.Values)
+	}
+	fresh, err := store.Fresh(req2, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh == got || fresh.Values["foo"] != "Bar" {
+		t.Errorf("expected Fresh to read the change, got %v", fresh.Values)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	increment := func(values map[interface{}]interface{}) error {
+		counter, _ := values["counter"].(int)
+		values["counter"] = counter + 1
+		return nil
+	}
+
+	var cookies []*http.Cookie
+	for i := 0; i < 3; i++ {
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		if err := store.Update(r, w, "test-sess", increment); err != nil {
+			t.Fatal(err)
+		}
+		cookies = (&http.Response{Header: w.Header()}).Cookies()
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	sess, err := store.New(r, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.Values["counter"] != 3 {
+		t.Errorf("expected the counter to be 3, got %v", sess.Values["counter"])
+	}
+
+	// An error from fn aborts the save
+	errNope := errors.New("nope")
+	err = store.Update(r, httptest.NewRecorder(), "test-sess", func(values map[interface{}]interface{}) error {
+		values["counter"] = 100
+		return errNope
+	})
+	if err != errNope {
+		t.Errorf("expected fn's error, got %v", err)
+	}
+	if sess, _ := store.New(r, "test-sess"); sess.Values["counter"] != 3 {
+		t.Errorf("expected the counter to stay 3, got %v", sess.Values["counter"])
+	}
+}
+
+func TestHashedKey(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithHashedKey(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(req1, "test-sess")
+	sess.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+
+	// The row is keyed by a hash of the ID
+	rows := db.rows("sessions")
+	if _, ok := rows[sess.ID]; ok {
+		t.Error("expected the real ID not to be stored")
+	}
+	if _, ok := rows[store.rowID(sess.ID)]; !ok {
+		t.Error("expected the hashed ID to be stored")
+	}
+	if _, err := gocql.ParseUUID(store.rowID(sess.ID)); err != nil {
+		t.Errorf("expected the hashed ID to be a UUID, got %v", err)
+	}
+
+	// The cookie still finds it
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	sess2, err := store.New(req2, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess2.ID != sess.ID || sess2.Values["foo"] != "Foo" {
+		t.Errorf("expected to load session %s, got %s with %v", sess.ID, sess2.ID, sess2.Values)
+	}
+}
+
+func TestMaxAgeIsClamped(t *testing.T) {
+	db := newFakeDB()
+	logs := &logRecorder{}
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithLogger(logs),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Absurd MaxAges are lowered to what Cassandra accepts
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	sess.Options.MaxAge = 100 * 365 * 86400
+	store.Options.MaxAge = sess.Options.MaxAge
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if sess.Options.MaxAge != maxTTL {
+		t.Errorf("expected MaxAge to be clamped to %d, got %d", maxTTL, sess.Options.MaxAge)
+	}
+	if ttl := db.rows("sessions")[sess.ID][`TTL("data")`]; ttl != maxTTL {
+		t.Errorf("expected the row TTL to be clamped to %d, got %v", maxTTL, ttl)
+	}
+	if n := len(logs.lines()); n != 1 {
+		t.Errorf("expected a warning to be logged, got %d lines", n)
+	}
+
+	// Any negative MaxAge deletes
+	sess.Options.MaxAge = -5
+	w := httptest.NewRecorder()
+	if err := sess.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	if sess.Options.MaxAge != -1 {
+		t.Errorf("expected MaxAge to be -1, got %d", sess.Options.MaxAge)
+	}
+	if n := len(db.rows("sessions")); n != 0 {
+		t.Errorf("expected the session to be deleted, got %d rows", n)
+	}
+	if c := w.Header().Get("Set-Cookie"); !strings.HasPrefix(c, "test-sess=; ") {
+		t.Errorf("expected the cookie to be cleared, got %q", c)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	existing, _ := store.New(req1, "test-sess")
+	existing.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	if err := existing.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Drain()
+
+	// New sessions can not be saved
+	fresh, _ := store.New(req1, "test-sess")
+	if err := fresh.Save(req1, httptest.NewRecorder()); !errors.Is(err, ErrDraining) {
+		t.Errorf("expected ErrDraining, got %v", err)
+	}
+	if fresh.ID != "" {
+		t.Errorf("expected the new session to have no ID, got %q", fresh.ID)
+	}
+
+	// Existing sessions load
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	loaded, err := store.New(req2, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Values["foo"] != "Foo" {
+		t.Errorf("expected foo to be Foo, got %v", loaded.Values["foo"])
+	}
+
+	// And save
+	loaded.Values["foo"] = "Bar"
+	if err := loaded.Save(req2, httptest.NewRecorder()); err != nil {
+		t.Errorf("expected existing sessions to save, got %v", err)
+	}
+
+	store.Undrain()
+	if err := fresh.Save(req1, httptest.NewRecorder()); err != nil {
+		t.Errorf("expected new sessions to save after Undrain, got %v", err)
+	}
+}
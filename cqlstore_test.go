@@ -1,18 +1,29 @@
 package cqlstore_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gocql/gocql"
+	"github.com/gorilla/sessions"
 	"github.com/jcbwlkr/cqlstore"
 	"github.com/stretchr/testify/suite"
 )
 
+// testKeys are valid keys for stores created in tests.
+var testKeys = [][]byte{[]byte("0123456789abcdef0123456789abcdef"), nil}
+
 type testSuite struct {
 	suite.Suite
 	cluster *gocql.ClusterConfig
@@ -49,14 +60,11 @@ func doSetup() (*gocql.ClusterConfig, error) {
 		return nil, err
 	}
 
-	create := fmt.Sprintf(`
-		CREATE KEYSPACE %q WITH REPLICATION = {
-			'class' : 'SimpleStrategy',
-			'replication_factor' : 1
-		}`,
-		keyspace,
-	)
-	if err := sess.Query(create, cluster.Keyspace).Exec(); err != nil {
+	err = cqlstore.EnsureKeyspace(sess, keyspace, map[string]interface{}{
+		"class":              "SimpleStrategy",
+		"replication_factor": 1,
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -90,7 +98,7 @@ func (suite *testSuite) TestSessionData() {
 	dbSess, _ := suite.cluster.CreateSession()
 	defer dbSess.Close()
 
-	store, err := cqlstore.New(dbSess, "sessions", []byte("foo-bar-baz"))
+	store, err := cqlstore.New(dbSess, "sessions", testKeys...)
 	suite.NoError(err)
 
 	// Step 1 ------------------------------------------------------------------
@@ -156,7 +164,7 @@ func (suite *testSuite) TestDeletingASession() {
 	dbSess, _ := suite.cluster.CreateSession()
 	defer dbSess.Close()
 
-	store, err := cqlstore.New(dbSess, "sessions", []byte("foo-bar-baz"))
+	store, err := cqlstore.New(dbSess, "sessions", testKeys...)
 	suite.NoError(err)
 
 	// Step 1 ------------------------------------------------------------------
@@ -207,15 +215,69 @@ func (suite *testSuite) TestBadTableNames() {
 	dbSess, _ := suite.cluster.CreateSession()
 	defer dbSess.Close()
 
-	_, err := cqlstore.New(dbSess, `1"; DROP TABLE students; --`, []byte("bobby-tables"))
+	_, err := cqlstore.New(dbSess, `1"; DROP TABLE students; --`, testKeys...)
 	suite.Error(err)
 }
 
+func (suite *testSuite) TestEmptyTableName() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	_, err := cqlstore.New(dbSess, "", testKeys...)
+	suite.Equal(cqlstore.ErrTableRequired, err)
+}
+
+// TestReservedWordTableName shows that table names are always quoted so a CQL
+// keyword like token can be used.
+func (suite *testSuite) TestReservedWordTableName() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.NewWithOptions(dbSess, "token",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithClusteringByUpdatedAt(1),
+		cqlstore.WithUserIndex("user"),
+	)
+	suite.NoError(err)
+
+	// Step 1 ------------------------------------------------------------------
+	// Save a session.
+	r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	sess, err := store.New(r, "test-sess")
+	suite.NoError(err)
+	sess.Values["user"] = "bob"
+	w := httptest.NewRecorder()
+	suite.NoError(sess.Save(r, w))
+
+	var count int
+	suite.NoError(dbSess.Query(`SELECT count(*) FROM "token"`).Scan(&count))
+	suite.Equal(1, count)
+
+	// Step 2 ------------------------------------------------------------------
+	// Load it.
+	r2, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		r2.AddCookie(c)
+	}
+	sess2, err := store.New(r2, "test-sess")
+	suite.NoError(err)
+	suite.Equal("bob", sess2.Values["user"])
+
+	// Step 3 ------------------------------------------------------------------
+	// Delete it.
+	sess2.Options.MaxAge = -1
+	suite.NoError(sess2.Save(r2, httptest.NewRecorder()))
+	suite.NoError(dbSess.Query(`SELECT count(*) FROM "token"`).Scan(&count))
+	suite.Equal(0, count)
+}
+
 func (suite *testSuite) TestSettingOptionsOnOneDoesNotSetForAll() {
 	dbSess, _ := suite.cluster.CreateSession()
 	defer dbSess.Close()
 
-	store, err := cqlstore.New(dbSess, `sessions`, []byte("banana"))
+	store, err := cqlstore.New(dbSess, `sessions`, testKeys...)
 	suite.NoError(err)
 
 	store.Options.MaxAge = 1800
@@ -236,50 +298,1343 @@ func (suite *testSuite) TestSettingOptionsOnOneDoesNotSetForAll() {
 	suite.Equal(1800, store.Options.MaxAge)
 }
 
-// BenchmarkARoundTrip measures the time it takes to make a new session, save
-// it with some values, then make a new request that loads the same session.
-func BenchmarkARoundTrip(b *testing.B) {
-	cluster, err := doSetup()
-	if err != nil {
-		b.Error(err)
+func (suite *testSuite) TestRecentSessions() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	now := time.Date(2015, time.June, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithClock(clock),
+		cqlstore.WithClusteringByUpdatedAt(4),
+	)
+	suite.NoError(err)
+
+	// Save three sessions a minute apart
+	var ids []string
+	for i := 0; i < 3; i++ {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+
+		sess, err := store.New(r, "test-sess")
+		suite.NoError(err)
+		sess.Values["i"] = i
+
+		suite.NoError(sess.Save(r, httptest.NewRecorder()))
+		ids = append(ids, sess.ID)
+
+		now = now.Add(time.Minute)
 	}
-	dbSess, err := cluster.CreateSession()
-	if err != nil {
-		b.Error(err)
+
+	recent, err := store.RecentSessions(2)
+	suite.NoError(err)
+	suite.Len(recent, 2)
+	suite.Equal(ids[2], recent[0].ID)
+	suite.Equal(ids[1], recent[1].ID)
+	suite.True(recent[0].UpdatedAt.After(recent[1].UpdatedAt))
+
+	recent, err = store.RecentSessions(10)
+	suite.NoError(err)
+	suite.Len(recent, 3)
+	suite.Equal(ids[0], recent[2].ID)
+}
+
+func (suite *testSuite) TestDecodeFailures() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.New(dbSess, "sessions", testKeys...)
+	suite.NoError(err)
+	suite.Equal(uint64(0), store.DecodeFailures())
+
+	for i := 0; i < 3; i++ {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+		r.AddCookie(&http.Cookie{Name: "test-sess", Value: "bogus"})
+
+		_, err = store.New(r, "test-sess")
+		suite.Error(err)
 	}
+	suite.Equal(uint64(3), store.DecodeFailures())
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		store, _ := cqlstore.New(dbSess, "sessions", []byte("bench-me"))
-		req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
-		sess, _ := store.Get(req1, "test-sess")
+	// Requests without a cookie are not failures
+	r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	_, err = store.New(r, "test-sess")
+	suite.NoError(err)
+	suite.Equal(uint64(3), store.DecodeFailures())
+}
+
+func (suite *testSuite) TestMergeFunc() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	union := func(stored, current map[interface{}]interface{}) map[interface{}]interface{} {
+		for k, v := range stored {
+			if _, ok := current[k]; !ok {
+				current[k] = v
+			}
+		}
+		return current
+	}
+
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithMergeFunc(union),
+	)
+	suite.NoError(err)
+
+	// Step 1 ------------------------------------------------------------------
+	// Save an initial session and grab its cookie.
+	req1, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+
+	sess, err := store.New(req1, "test-sess")
+	suite.NoError(err)
+	sess.Values["cart"] = "created"
+
+	w := httptest.NewRecorder()
+	suite.NoError(sess.Save(req1, w))
+	resp := http.Response{Header: w.Header()}
+
+	// Step 2 ------------------------------------------------------------------
+	// Load the session in two concurrent requests that each add an item then
+	// save one after the other.
+	var reqs [2]*http.Request
+	var loaded [2]*sessions.Session
+	for i := range reqs {
+		reqs[i], err = http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+		for _, c := range resp.Cookies() {
+			reqs[i].AddCookie(c)
+		}
+
+		loaded[i], err = store.New(reqs[i], "test-sess")
+		suite.NoError(err)
+	}
+
+	loaded[0].Values["apple"] = 1
+	loaded[1].Values["banana"] = 2
+	suite.NoError(loaded[0].Save(reqs[0], httptest.NewRecorder()))
+	suite.NoError(loaded[1].Save(reqs[1], httptest.NewRecorder()))
+
+	// Step 3 ------------------------------------------------------------------
+	// Both contributions survive.
+	req3, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	for _, c := range resp.Cookies() {
+		req3.AddCookie(c)
+	}
+
+	sess3, err := store.New(req3, "test-sess")
+	suite.NoError(err)
+	suite.Equal("created", sess3.Values["cart"])
+	suite.Equal(1, sess3.Values["apple"])
+	suite.Equal(2, sess3.Values["banana"])
+}
+
+func (suite *testSuite) TestOptimisticLocking() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithOptimisticLocking(),
+	)
+	suite.NoError(err)
+
+	// Step 1 ------------------------------------------------------------------
+	// Save a new session.
+	req1, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+
+	sess, err := store.New(req1, "test-sess")
+	suite.NoError(err)
+	sess.Values["foo"] = "Foo"
+
+	w := httptest.NewRecorder()
+	suite.NoError(sess.Save(req1, w))
+	resp := http.Response{Header: w.Header()}
+
+	// Step 2 ------------------------------------------------------------------
+	// Load it twice. Saving the first copy works but saving the second one
+	// must fail since it would overwrite the first.
+	var reqs [2]*http.Request
+	var loaded [2]*sessions.Session
+	for i := range reqs {
+		reqs[i], err = http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+		for _, c := range resp.Cookies() {
+			reqs[i].AddCookie(c)
+		}
+
+		loaded[i], err = store.New(reqs[i], "test-sess")
+		suite.NoError(err)
+	}
+
+	loaded[0].Values["foo"] = "First"
+	suite.NoError(loaded[0].Save(reqs[0], httptest.NewRecorder()))
 
+	loaded[1].Values["foo"] = "Second"
+	err = loaded[1].Save(reqs[1], httptest.NewRecorder())
+	suite.True(errors.Is(err, cqlstore.ErrConcurrentModification))
+
+	// The first copy can keep saving since it has the latest version
+	loaded[0].Values["foo"] = "First again"
+	suite.NoError(loaded[0].Save(reqs[0], httptest.NewRecorder()))
+}
+
+func (suite *testSuite) TestPerNameOptions() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.New(dbSess, "sessions", testKeys...)
+	suite.NoError(err)
+
+	store.SetOptions("admin-sess", &sessions.Options{
+		Path:   "/admin",
+		MaxAge: 3600,
+	})
+
+	r, err := http.NewRequest("GET", "http://www.example.com/admin", nil)
+	suite.NoError(err)
+
+	w := httptest.NewRecorder()
+	for _, name := range []string{"test-sess", "admin-sess"} {
+		sess, err := store.Get(r, name)
+		suite.NoError(err)
 		sess.Values["foo"] = "Foo"
-		sess.Values["bar"] = "Bar"
+		suite.NoError(sess.Save(r, w))
+	}
+
+	paths := make(map[string]string)
+	resp := http.Response{Header: w.Header()}
+	for _, c := range resp.Cookies() {
+		paths[c.Name] = c.Path
+	}
+	suite.Equal("/", paths["test-sess"])
+	suite.Equal("/admin", paths["admin-sess"])
+
+	// The store's own options are unchanged
+	suite.Equal("/", store.Options.Path)
+}
+
+func (suite *testSuite) TestDefaultValues() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithDefaultValues(map[interface{}]interface{}{
+			"locale": "en-US",
+		}),
+	)
+	suite.NoError(err)
+
+	// Step 1 ------------------------------------------------------------------
+	// A fresh session has the defaults. Remove them before saving.
+	req1, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+
+	sess, err := store.New(req1, "test-sess")
+	suite.NoError(err)
+	suite.True(sess.IsNew)
+	suite.Equal("en-US", sess.Values["locale"])
+
+	delete(sess.Values, "locale")
+	sess.Values["foo"] = "Foo"
+
+	w := httptest.NewRecorder()
+	suite.NoError(sess.Save(req1, w))
+
+	// Step 2 ------------------------------------------------------------------
+	// The loaded session does not get the defaults back.
+	req2, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	resp := http.Response{Header: w.Header()}
+	for _, c := range resp.Cookies() {
+		req2.AddCookie(c)
+	}
+
+	sess2, err := store.New(req2, "test-sess")
+	suite.NoError(err)
+	suite.False(sess2.IsNew)
+	suite.Equal("Foo", sess2.Values["foo"])
+	_, ok := sess2.Values["locale"]
+	suite.False(ok)
+}
+
+func (suite *testSuite) TestExpireDelete() {
+	// Record every statement the store runs
+	rec := &statementRecorder{}
+	cluster := *suite.cluster
+	cluster.QueryObserver = rec
+
+	dbSess, err := cluster.CreateSession()
+	suite.NoError(err)
+	defer dbSess.Close()
+
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithExpireDelete(),
+	)
+	suite.NoError(err)
+
+	r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+
+	sess, err := store.New(r, "test-sess")
+	suite.NoError(err)
+	sess.Values["foo"] = "Foo"
+	suite.NoError(sess.Save(r, httptest.NewRecorder()))
+
+	sess.Options.MaxAge = -1
+	suite.NoError(sess.Save(r, httptest.NewRecorder()))
+
+	// Give the row time to expire
+	time.Sleep(2 * time.Second)
+
+	var count int
+	err = dbSess.Query(`SELECT count(*) FROM "sessions"`).Scan(&count)
+	suite.NoError(err)
+	suite.Equal(0, count)
+
+	for _, stmt := range rec.statements() {
+		suite.NotContains(strings.ToUpper(stmt), "DELETE")
+	}
+}
+
+func (suite *testSuite) TestExportImport() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	src, err := cqlstore.New(dbSess, "sessions", testKeys...)
+	suite.NoError(err)
+	dst, err := cqlstore.New(dbSess, "imported", testKeys...)
+	suite.NoError(err)
+
+	// Step 1 ------------------------------------------------------------------
+	// Save a session in the source store and export it.
+	req1, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+
+	sess, err := src.New(req1, "test-sess")
+	suite.NoError(err)
+	sess.Values["foo"] = "Foo"
+
+	w := httptest.NewRecorder()
+	suite.NoError(sess.Save(req1, w))
+
+	blob, err := src.ExportSession(sess.ID)
+	suite.NoError(err)
+	suite.NotEmpty(blob)
+
+	// Step 2 ------------------------------------------------------------------
+	// Import it into the other store and load it from there with the same
+	// cookie.
+	suite.NoError(dst.ImportSession(sess.ID, blob, time.Hour))
+
+	req2, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	resp := http.Response{Header: w.Header()}
+	for _, c := range resp.Cookies() {
+		req2.AddCookie(c)
+	}
+
+	sess2, err := dst.New(req2, "test-sess")
+	suite.NoError(err)
+	suite.False(sess2.IsNew)
+	suite.Equal("Foo", sess2.Values["foo"])
+}
+
+func (suite *testSuite) TestBinaryData() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	textStore, err := cqlstore.New(dbSess, "sessions", testKeys...)
+	suite.NoError(err)
+	binStore, err := cqlstore.NewWithOptions(dbSess, "binary_sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithBinaryData(),
+	)
+	suite.NoError(err)
+
+	value := []byte{0x00, 0xff, 0xfe, 0x80, 0x7f, 'a', 'b', 'c'}
+
+	var textID, binID string
+	for _, store := range []*cqlstore.CQLStore{textStore, binStore} {
+		// Save the binary value
+		req1, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+
+		sess, err := store.New(req1, "test-sess")
+		suite.NoError(err)
+		sess.Values["bin"] = value
 
 		w := httptest.NewRecorder()
-		_ = sess.Save(req1, w)
+		suite.NoError(sess.Save(req1, w))
 
-		req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		if store == textStore {
+			textID = sess.ID
+		} else {
+			binID = sess.ID
+		}
 
-		// Filter the test recorder through a Response so we can get cookie values
+		// Load it back
+		req2, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
 		resp := http.Response{Header: w.Header()}
 		for _, c := range resp.Cookies() {
 			req2.AddCookie(c)
 		}
 
-		_, _ = store.Get(req2, "test-sess")
-
-		// I want each pass to make the table but I don't want to count the
-		// time I spend dropping it between passes
-		b.StopTimer()
-		_ = dbSess.Query(`DROP TABLE "sessions"`).Exec()
-		b.StartTimer()
+		sess2, err := store.New(req2, "test-sess")
+		suite.NoError(err)
+		suite.Equal(value, sess2.Values["bin"])
 	}
-	b.StopTimer()
 
-	err = doTearDown(cluster)
-	if err != nil {
+	var text string
+	err = dbSess.Query(`SELECT "data" FROM "sessions" WHERE "id" = ?`, textID).Scan(&text)
+	suite.NoError(err)
+
+	var bin []byte
+	err = dbSess.Query(`SELECT "data" FROM "binary_sessions" WHERE "id" = ?`, binID).Scan(&bin)
+	suite.NoError(err)
+
+	suite.True(len(bin) < len(text), "blob is %d bytes, text is %d", len(bin), len(text))
+}
+
+func (suite *testSuite) TestMaxSessionsPerUser() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	now := time.Date(2015, time.June, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	const max = 2
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithClock(clock),
+		cqlstore.WithUserIndex("user"),
+		cqlstore.WithMaxSessionsPerUser(max),
+	)
+	suite.NoError(err)
+
+	// Log the same user in max+2 times, a minute apart
+	var ids []string
+	for i := 0; i < max+2; i++ {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+
+		sess, err := store.New(r, "test-sess")
+		suite.NoError(err)
+		sess.Values["user"] = "jerry"
+
+		suite.NoError(sess.Save(r, httptest.NewRecorder()))
+		ids = append(ids, sess.ID)
+
+		now = now.Add(time.Minute)
+	}
+
+	// Only the newest sessions remain
+	var remaining []string
+	iter := dbSess.Query(`SELECT "id" FROM "sessions"`).Iter()
+	var id gocql.UUID
+	for iter.Scan(&id) {
+		remaining = append(remaining, id.String())
+	}
+	suite.NoError(iter.Close())
+
+	suite.Len(remaining, max)
+	suite.Contains(remaining, ids[max])
+	suite.Contains(remaining, ids[max+1])
+
+	var count int
+	err = dbSess.Query(`SELECT count(*) FROM "sessions_by_user" WHERE "user_id" = ?`, "jerry").Scan(&count)
+	suite.NoError(err)
+	suite.Equal(max, count)
+}
+
+func (suite *testSuite) TestEnsureKeyspace() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	name := suite.cluster.Keyspace + "_ensured"
+	replication := map[string]interface{}{
+		"class":              "SimpleStrategy",
+		"replication_factor": 1,
+	}
+
+	// Creating it twice is fine
+	suite.NoError(cqlstore.EnsureKeyspace(dbSess, name, replication))
+	suite.NoError(cqlstore.EnsureKeyspace(dbSess, name, replication))
+
+	var count int
+	err := dbSess.Query(`SELECT count(*) FROM system_schema.keyspaces WHERE keyspace_name = ?`, name).Scan(&count)
+	suite.NoError(err)
+	suite.Equal(1, count)
+
+	suite.NoError(dbSess.Query(fmt.Sprintf("DROP KEYSPACE %q", name)).Exec())
+
+	// Bad names are rejected
+	err = cqlstore.EnsureKeyspace(dbSess, `x" WITH durable_writes = false; --`, replication)
+	suite.Error(err)
+}
+
+func (suite *testSuite) TestTenantIsolation() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	byHost := func(r *http.Request) string { return r.Host }
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithTenant(byHost),
+	)
+	suite.NoError(err)
+
+	// Step 1 ------------------------------------------------------------------
+	// Save a session for tenant a.
+	req1, err := http.NewRequest("GET", "http://a.example.com/", nil)
+	suite.NoError(err)
+
+	sess, err := store.New(req1, "test-sess")
+	suite.NoError(err)
+	sess.Values["secret"] = "a's secret"
+
+	w := httptest.NewRecorder()
+	suite.NoError(sess.Save(req1, w))
+	resp := http.Response{Header: w.Header()}
+
+	// Step 2 ------------------------------------------------------------------
+	// Tenant b can not load it with the same cookie.
+	req2, err := http.NewRequest("GET", "http://b.example.com/", nil)
+	suite.NoError(err)
+	for _, c := range resp.Cookies() {
+		req2.AddCookie(c)
+	}
+
+	sess2, err := store.New(req2, "test-sess")
+	suite.True(errors.Is(err, cqlstore.ErrTenantMismatch))
+	suite.True(sess2.IsNew)
+	suite.Empty(sess2.ID)
+	suite.Empty(sess2.Values)
+
+	// Step 3 ------------------------------------------------------------------
+	// Tenant a still can.
+	req3, err := http.NewRequest("GET", "http://a.example.com/", nil)
+	suite.NoError(err)
+	for _, c := range resp.Cookies() {
+		req3.AddCookie(c)
+	}
+
+	sess3, err := store.New(req3, "test-sess")
+	suite.NoError(err)
+	suite.Equal("a's secret", sess3.Values["secret"])
+}
+
+func (suite *testSuite) TestDefaultSessionName() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithSessionName("test-sess"),
+	)
+	suite.NoError(err)
+
+	req1, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+
+	sess, err := store.Session(req1)
+	suite.NoError(err)
+	suite.Equal("test-sess", sess.Name())
+	sess.Values["foo"] = "Foo"
+
+	w := httptest.NewRecorder()
+	suite.NoError(sess.Save(req1, w))
+
+	req2, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	resp := http.Response{Header: w.Header()}
+	for _, c := range resp.Cookies() {
+		suite.Equal("test-sess", c.Name)
+		req2.AddCookie(c)
+	}
+
+	sess2, err := store.Session(req2)
+	suite.NoError(err)
+	suite.False(sess2.IsNew)
+	suite.Equal("Foo", sess2.Values["foo"])
+}
+
+func (suite *testSuite) TestAbsoluteTimeout() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithClock(clock),
+		cqlstore.WithAbsoluteTimeout(12*time.Hour),
+	)
+	suite.NoError(err)
+
+	// Step 1 ------------------------------------------------------------------
+	// Save a session.
+	req1, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+
+	sess, err := store.New(req1, "test-sess")
+	suite.NoError(err)
+	sess.Values["foo"] = "Foo"
+
+	w := httptest.NewRecorder()
+	suite.NoError(sess.Save(req1, w))
+	resp := http.Response{Header: w.Header()}
+
+	load := func() (*sessions.Session, error) {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+		for _, c := range resp.Cookies() {
+			r.AddCookie(c)
+		}
+		return store.New(r, "test-sess")
+	}
+
+	// Step 2 ------------------------------------------------------------------
+	// Keep using it for 11 hours. Saving it does not extend its life.
+	now = now.Add(11 * time.Hour)
+	sess2, err := load()
+	suite.NoError(err)
+	suite.Equal("Foo", sess2.Values["foo"])
+	suite.NoError(sess2.Save(req1, httptest.NewRecorder()))
+
+	// Step 3 ------------------------------------------------------------------
+	// After 13 hours it is gone even though its row has not expired.
+	now = now.Add(2 * time.Hour)
+	sess3, err := load()
+	suite.True(errors.Is(err, cqlstore.ErrSessionExpired))
+	suite.True(sess3.IsNew)
+	suite.Empty(sess3.ID)
+}
+
+func (suite *testSuite) TestSyncMaxAgeFromTTL() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithSyncMaxAgeFromTTL(),
+	)
+	suite.NoError(err)
+	store.Options.MaxAge = 3600
+
+	req1, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+
+	sess, err := store.New(req1, "test-sess")
+	suite.NoError(err)
+
+	w := httptest.NewRecorder()
+	suite.NoError(sess.Save(req1, w))
+
+	// Give the row a moment to age then load it and change the store's
+	// MaxAge. The session's MaxAge follows the row, not the store.
+	time.Sleep(1100 * time.Millisecond)
+	store.Options.MaxAge = 86400
+
+	req2, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	resp := http.Response{Header: w.Header()}
+	for _, c := range resp.Cookies() {
+		req2.AddCookie(c)
+	}
+
+	sess2, err := store.New(req2, "test-sess")
+	suite.NoError(err)
+	suite.True(sess2.Options.MaxAge < 3600)
+	suite.True(sess2.Options.MaxAge > 3590)
+}
+
+func (suite *testSuite) TestErrorHandler() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.New(dbSess, "sessions", testKeys...)
+	suite.NoError(err)
+
+	var handled []error
+	store.ErrorHandler = func(err error) *sessions.Session {
+		handled = append(handled, err)
+		fresh := sessions.NewSession(store, "test-sess")
+		fresh.IsNew = true
+		return fresh
+	}
+
+	r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	r.AddCookie(&http.Cookie{Name: "test-sess", Value: "bogus"})
+
+	sess, err := store.New(r, "test-sess")
+	suite.NoError(err)
+	suite.NotNil(sess)
+	suite.True(sess.IsNew)
+	suite.Len(handled, 1)
+
+	// Without the handler the error is returned
+	store.ErrorHandler = nil
+	_, err = store.New(r, "test-sess")
+	suite.Error(err)
+}
+
+func (suite *testSuite) TestSignOnlyCookies() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	hashKey := []byte("0123456789abcdef0123456789abcdef")
+	blockKey := []byte("fedcba9876543210fedcba9876543210")
+
+	signed, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(hashKey, blockKey),
+		cqlstore.WithSignOnly(),
+	)
+	suite.NoError(err)
+	encrypted, err := cqlstore.New(dbSess, "sessions", hashKey, blockKey)
+	suite.NoError(err)
+
+	// cookieValue saves a session with store and returns its ID and cookie.
+	cookieValue := func(store *cqlstore.CQLStore) (string, *http.Cookie) {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+		sess, err := store.New(r, "test-sess")
+		suite.NoError(err)
+		w := httptest.NewRecorder()
+		suite.NoError(sess.Save(r, w))
+		return sess.ID, (&http.Response{Header: w.Header()}).Cookies()[0]
+	}
+
+	// payload digs the encoded value out of a securecookie value.
+	payload := func(value string) []byte {
+		outer, err := base64.URLEncoding.DecodeString(value)
+		suite.NoError(err)
+		parts := bytes.SplitN(outer, []byte("|"), 3)
+		suite.Len(parts, 3)
+		inner, err := base64.URLEncoding.DecodeString(string(parts[1]))
+		suite.NoError(err)
+		return inner
+	}
+
+	// Step 1 ------------------------------------------------------------------
+	// The ID can be read from a sign only cookie but not an encrypted one.
+	id, c := cookieValue(signed)
+	suite.Contains(string(payload(c.Value)), id)
+
+	encID, encCookie := cookieValue(encrypted)
+	suite.NotContains(string(payload(encCookie.Value)), encID)
+
+	// Step 2 ------------------------------------------------------------------
+	// The sign only cookie still loads but tampering with it is detected.
+	r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	r.AddCookie(c)
+	sess, err := signed.New(r, "test-sess")
+	suite.NoError(err)
+	suite.Equal(id, sess.ID)
+
+	tampered := []byte(c.Value)
+	tampered[len(tampered)/2] ^= 1
+	r2, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	r2.AddCookie(&http.Cookie{Name: c.Name, Value: string(tampered)})
+	_, err = signed.New(r2, "test-sess")
+	suite.Error(err)
+}
+
+func (suite *testSuite) TestNameInKey() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	// Every session gets the same ID
+	id := gocql.TimeUUID().String()
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithNameInKey(),
+		cqlstore.WithIDGenerator(func() string { return id }),
+	)
+	suite.NoError(err)
+
+	// Save two differently named sessions with the same ID
+	req1, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+
+	w := httptest.NewRecorder()
+	for _, name := range []string{"a-sess", "b-sess"} {
+		sess, err := store.Get(req1, name)
+		suite.NoError(err)
+		sess.Values["name"] = name
+		suite.NoError(sess.Save(req1, w))
+		suite.Equal(id, sess.ID)
+	}
+
+	var count int
+	err = dbSess.Query(`SELECT count(*) FROM "sessions"`).Scan(&count)
+	suite.NoError(err)
+	suite.Equal(2, count)
+
+	// Each loads its own values
+	req2, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	resp := http.Response{Header: w.Header()}
+	for _, c := range resp.Cookies() {
+		req2.AddCookie(c)
+	}
+
+	for _, name := range []string{"a-sess", "b-sess"} {
+		sess, err := store.Get(req2, name)
+		suite.NoError(err)
+		suite.False(sess.IsNew)
+		suite.Equal(name, sess.Values["name"])
+	}
+}
+
+func (suite *testSuite) TestQueryTag() {
+	rec := &statementRecorder{}
+	cluster := *suite.cluster
+	cluster.QueryObserver = rec
+
+	dbSess, err := cluster.CreateSession()
+	suite.NoError(err)
+	defer dbSess.Close()
+
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithQueryTag("app=foo op=save"),
+	)
+	suite.NoError(err)
+
+	// Step 1 ------------------------------------------------------------------
+	// Tagged statements still run.
+	r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	sess, err := store.New(r, "test-sess")
+	suite.NoError(err)
+	sess.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	suite.NoError(sess.Save(r, w))
+
+	r2, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		r2.AddCookie(c)
+	}
+	sess2, err := store.New(r2, "test-sess")
+	suite.NoError(err)
+	suite.Equal("Foo", sess2.Values["foo"])
+
+	// Step 2 ------------------------------------------------------------------
+	// Every statement carried the tag.
+	stmts := rec.statements()
+	suite.NotEmpty(stmts)
+	for _, stmt := range stmts {
+		suite.True(strings.HasPrefix(stmt, "/* app=foo op=save */"), stmt)
+	}
+}
+
+func (suite *testSuite) TestRemainingTTL() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.New(dbSess, "sessions", testKeys...)
+	suite.NoError(err)
+	store.Options.MaxAge = 3600
+
+	r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	sess, err := store.New(r, "test-sess")
+	suite.NoError(err)
+	suite.NoError(sess.Save(r, httptest.NewRecorder()))
+
+	ttl, err := store.RemainingTTL(sess.ID)
+	suite.NoError(err)
+	suite.InDelta(time.Hour, ttl, float64(5*time.Second))
+
+	_, err = store.RemainingTTL(gocql.TimeUUID().String())
+	suite.Equal(cqlstore.ErrSessionNotFound, err)
+}
+
+func (suite *testSuite) TestRawQuery() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.New(dbSess, "sessions", testKeys...)
+	suite.NoError(err)
+	suite.Equal(`"sessions"`, store.TableExpr())
+
+	for i := 0; i < 2; i++ {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+		sess, err := store.New(r, "test-sess")
+		suite.NoError(err)
+		suite.NoError(sess.Save(r, httptest.NewRecorder()))
+	}
+
+	var count int
+	suite.NoError(store.RawQuery(`SELECT count(*) FROM ` + store.TableExpr()).Scan(&count))
+	suite.Equal(2, count)
+}
+
+func (suite *testSuite) TestDB() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.New(dbSess, "sessions", testKeys...)
+	suite.NoError(err)
+	suite.Same(dbSess, store.DB())
+}
+
+func (suite *testSuite) TestReplicationCheck() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	// Step 1 ------------------------------------------------------------------
+	// The test keyspace has a single replica which is warned about.
+	var logs bytes.Buffer
+	_, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithLogger(log.New(&logs, "", 0)),
+		cqlstore.WithReplicationCheck(suite.cluster.Keyspace),
+	)
+	suite.NoError(err)
+	suite.Equal(1, strings.Count(logs.String(), "\n"))
+	suite.Contains(logs.String(), "replication factor of 1")
+
+	// Step 2 ------------------------------------------------------------------
+	// Requiring more replicas fails.
+	_, err = cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithReplicationCheck(suite.cluster.Keyspace),
+		cqlstore.WithRequireReplication(3),
+	)
+	suite.Error(err)
+}
+
+func (suite *testSuite) TestMigrate() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	src, err := cqlstore.New(dbSess, "sessions", testKeys...)
+	suite.NoError(err)
+	dst, err := cqlstore.New(dbSess, "migrated", testKeys...)
+	suite.NoError(err)
+
+	// Step 1 ------------------------------------------------------------------
+	// Save a few sessions to the source table.
+	var cookies [][]*http.Cookie
+	for i := 0; i < 3; i++ {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+		sess, err := src.New(r, "test-sess")
+		suite.NoError(err)
+		sess.Values["i"] = i
+		w := httptest.NewRecorder()
+		suite.NoError(sess.Save(r, w))
+		cookies = append(cookies, (&http.Response{Header: w.Header()}).Cookies())
+	}
+
+	// Step 2 ------------------------------------------------------------------
+	// Migrate them.
+	n, err := src.Migrate(dst)
+	suite.NoError(err)
+	suite.Equal(3, n)
+
+	// Step 3 ------------------------------------------------------------------
+	// Every session loads from the destination with the same cookie.
+	for i, cs := range cookies {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+		for _, c := range cs {
+			r.AddCookie(c)
+		}
+		sess, err := dst.New(r, "test-sess")
+		suite.NoError(err)
+		suite.False(sess.IsNew)
+		suite.Equal(i, sess.Values["i"])
+	}
+}
+
+func (suite *testSuite) TestReconcileUserIndex() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithUserIndex("user"),
+	)
+	suite.NoError(err)
+
+	// Save two sessions for the same user
+	var ids []string
+	for i := 0; i < 2; i++ {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+		sess, err := store.New(r, "test-sess")
+		suite.NoError(err)
+		sess.Values["user"] = "jerry"
+		suite.NoError(sess.Save(r, httptest.NewRecorder()))
+		ids = append(ids, sess.ID)
+	}
+
+	// Remove one behind the store's back to orphan its index entry
+	suite.NoError(dbSess.Query(`DELETE FROM "sessions" WHERE "id" = ?`, ids[0]).Exec())
+
+	n, err := store.ReconcileUserIndex()
+	suite.NoError(err)
+	suite.Equal(1, n)
+
+	var remaining []string
+	iter := dbSess.Query(`SELECT "id" FROM "sessions_by_user" WHERE "user_id" = ?`, "jerry").Iter()
+	var id gocql.UUID
+	for iter.Scan(&id) {
+		remaining = append(remaining, id.String())
+	}
+	suite.NoError(iter.Close())
+	suite.Equal([]string{ids[1]}, remaining)
+
+	// Nothing is left to clean up
+	n, err = store.ReconcileUserIndex()
+	suite.NoError(err)
+	suite.Equal(0, n)
+}
+
+func (suite *testSuite) TestDeleteWhere() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithSessionName("test-sess"),
+	)
+	suite.NoError(err)
+
+	// Step 1 ------------------------------------------------------------------
+	// Save sessions for several users.
+	ids := make(map[string]string)
+	for _, user := range []string{"jerry", "elaine", "george", "kramer"} {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+		sess, err := store.Session(r)
+		suite.NoError(err)
+		sess.Values["user"] = user
+		suite.NoError(sess.Save(r, httptest.NewRecorder()))
+		ids[user] = sess.ID
+	}
+	garbage := gocql.TimeUUID()
+	suite.NoError(dbSess.Query(`INSERT INTO "sessions" ("id", "data") VALUES(?, ?)`, garbage, "garbage").Exec())
+
+	// Step 2 ------------------------------------------------------------------
+	// Delete the sessions of two of them. The one that can not be decoded is
+	// reported.
+	n, err := store.DeleteWhere(func(values map[interface{}]interface{}) bool {
+		return values["user"] == "jerry" || values["user"] == "kramer"
+	})
+	suite.Error(err)
+	suite.Contains(err.Error(), "1 sessions could not be decoded")
+	suite.Equal(2, n)
+
+	// Step 3 ------------------------------------------------------------------
+	// Only the others remain.
+	var remaining []string
+	iter := dbSess.Query(`SELECT "id" FROM "sessions"`).Iter()
+	var id gocql.UUID
+	for iter.Scan(&id) {
+		remaining = append(remaining, id.String())
+	}
+	suite.NoError(iter.Close())
+
+	suite.ElementsMatch([]string{ids["elaine"], ids["george"], garbage.String()}, remaining)
+}
+
+func (suite *testSuite) TestDeleteAll() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.New(dbSess, "sessions", testKeys...)
+	suite.NoError(err)
+
+	// Step 1 ------------------------------------------------------------------
+	// Save a few sessions.
+	var ids []string
+	for i := 0; i < 3; i++ {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+		sess, err := store.New(r, "test-sess")
+		suite.NoError(err)
+		sess.Values["i"] = i
+		suite.NoError(sess.Save(r, httptest.NewRecorder()))
+		ids = append(ids, sess.ID)
+	}
+	var deleted []string
+	store.AfterDelete = func(s *sessions.Session) {
+		deleted = append(deleted, s.ID)
+	}
+
+	// Step 2 ------------------------------------------------------------------
+	// The wrong confirmation deletes nothing.
+	n, err := store.DeleteAll("yes")
+	suite.True(errors.Is(err, cqlstore.ErrNotConfirmed))
+	suite.Equal(0, n)
+
+	var count int
+	suite.NoError(dbSess.Query(`SELECT COUNT(*) FROM "sessions"`).Scan(&count))
+	suite.Equal(3, count)
+
+	// Step 3 ------------------------------------------------------------------
+	// The right one deletes everything.
+	n, err = store.DeleteAll(cqlstore.DeleteAllConfirmation)
+	suite.NoError(err)
+	suite.Equal(3, n)
+
+	suite.NoError(dbSess.Query(`SELECT COUNT(*) FROM "sessions"`).Scan(&count))
+	suite.Equal(0, count)
+	suite.ElementsMatch(ids, deleted)
+}
+
+func (suite *testSuite) TestAutoMigrate() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	// Step 1 ------------------------------------------------------------------
+	// Create the table the way a store without any Options would.
+	_, err := cqlstore.New(dbSess, "old_sessions", testKeys...)
+	suite.NoError(err)
+
+	// Step 2 ------------------------------------------------------------------
+	// A store that needs more columns adds them.
+	store, err := cqlstore.NewWithOptions(dbSess, "old_sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithOptimisticLocking(),
+		cqlstore.WithAbsoluteTimeout(time.Hour),
+		cqlstore.WithAutoMigrate(),
+	)
+	suite.NoError(err)
+
+	var cols []string
+	iter := dbSess.Query(`SELECT column_name FROM system_schema.columns WHERE keyspace_name = ? AND table_name = ?`,
+		suite.cluster.Keyspace, "old_sessions").Iter()
+	var col string
+	for iter.Scan(&col) {
+		cols = append(cols, col)
+	}
+	suite.NoError(iter.Close())
+	suite.Subset(cols, []string{"id", "data", "version", "created_at"})
+
+	// Step 3 ------------------------------------------------------------------
+	// Sessions can be saved and creating the store again is fine.
+	r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	suite.NoError(err)
+	sess, err := store.New(r, "test-sess")
+	suite.NoError(err)
+	sess.Values["foo"] = "Foo"
+	suite.NoError(sess.Save(r, httptest.NewRecorder()))
+
+	_, err = cqlstore.NewWithOptions(dbSess, "old_sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithOptimisticLocking(),
+		cqlstore.WithAbsoluteTimeout(time.Hour),
+		cqlstore.WithAutoMigrate(),
+	)
+	suite.NoError(err)
+}
+
+func (suite *testSuite) TestTableComment() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	_, err := cqlstore.NewWithOptions(dbSess, "commented",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithTableComment("sessions for app 'X'"),
+	)
+	suite.NoError(err)
+
+	var comment string
+	suite.NoError(dbSess.Query(`SELECT comment FROM system_schema.tables WHERE keyspace_name = ? AND table_name = ?`,
+		suite.cluster.Keyspace, "commented").Scan(&comment))
+	suite.Equal("sessions for app 'X'", comment)
+}
+
+func (suite *testSuite) TestTableProperties() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	_, err := cqlstore.NewWithOptions(dbSess, "tuned",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithTableProperties(map[string]string{
+			"gc_grace_seconds": "3600",
+			"compaction":       "{'class': 'TimeWindowCompactionStrategy'}",
+		}),
+	)
+	suite.NoError(err)
+
+	var grace int
+	var compaction map[string]string
+	suite.NoError(dbSess.Query(`SELECT gc_grace_seconds, compaction FROM system_schema.tables WHERE keyspace_name = ? AND table_name = ?`,
+		suite.cluster.Keyspace, "tuned").Scan(&grace, &compaction))
+	suite.Equal(3600, grace)
+	suite.Contains(compaction["class"], "TimeWindowCompactionStrategy")
+}
+
+func (suite *testSuite) TestListSessions() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.New(dbSess, "sessions", testKeys...)
+	suite.NoError(err)
+
+	// Step 1 ------------------------------------------------------------------
+	// Save more sessions than fit on a page.
+	var saved []string
+	for i := 0; i < 5; i++ {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+		sess, err := store.New(r, "test-sess")
+		suite.NoError(err)
+		suite.NoError(sess.Save(r, httptest.NewRecorder()))
+		saved = append(saved, sess.ID)
+	}
+
+	// Step 2 ------------------------------------------------------------------
+	// Page through them.
+	var listed []string
+	var token []byte
+	pages := 0
+	for {
+		ids, next, err := store.ListSessions(token, 3)
+		suite.NoError(err)
+		suite.LessOrEqual(len(ids), 3)
+		listed = append(listed, ids...)
+		pages++
+		if len(next) == 0 {
+			break
+		}
+		token = next
+	}
+
+	suite.GreaterOrEqual(pages, 2)
+	suite.ElementsMatch(saved, listed)
+}
+
+func (suite *testSuite) TestGlobalMaxSessions() {
+	dbSess, _ := suite.cluster.CreateSession()
+	defer dbSess.Close()
+
+	store, err := cqlstore.NewWithOptions(dbSess, "sessions",
+		cqlstore.WithKeyPairs(testKeys...),
+		cqlstore.WithClusteringByUpdatedAt(2),
+		cqlstore.WithGlobalMaxSessions(3),
+	)
+	suite.NoError(err)
+	var evicted []string
+	store.AfterDelete = func(s *sessions.Session) {
+		evicted = append(evicted, s.ID)
+	}
+
+	// Step 1 ------------------------------------------------------------------
+	// Save one more session than the cap, oldest first.
+	var ids []string
+	for i := 0; i < 4; i++ {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		suite.NoError(err)
+		sess, err := store.New(r, "test-sess")
+		suite.NoError(err)
+		suite.NoError(sess.Save(r, httptest.NewRecorder()))
+		ids = append(ids, sess.ID)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Step 2 ------------------------------------------------------------------
+	// Only the oldest was evicted.
+	var remaining []string
+	iter := dbSess.Query(`SELECT "id" FROM "sessions"`).Iter()
+	var id gocql.UUID
+	for iter.Scan(&id) {
+		remaining = append(remaining, id.String())
+	}
+	suite.NoError(iter.Close())
+	suite.ElementsMatch(ids[1:], remaining)
+
+	// Step 3 ------------------------------------------------------------------
+	// The eviction was a delete like any other.
+	suite.Equal(ids[:1], evicted)
+	suite.Equal(uint64(1), store.Stats().Deleted)
+}
+
+// BenchmarkARoundTrip measures the time it takes to make a new session, save
+// it with some values, then make a new request that loads the same session.
+func BenchmarkARoundTrip(b *testing.B) {
+	cluster, err := doSetup()
+	if err != nil {
+		b.Error(err)
+	}
+	dbSess, err := cluster.CreateSession()
+	if err != nil {
+		b.Error(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store, _ := cqlstore.New(dbSess, "sessions", testKeys...)
+		req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, _ := store.Get(req1, "test-sess")
+
+		sess.Values["foo"] = "Foo"
+		sess.Values["bar"] = "Bar"
+
+		w := httptest.NewRecorder()
+		_ = sess.Save(req1, w)
+
+		req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+
+		// Filter the test recorder through a Response so we can get cookie values
+		resp := http.Response{Header: w.Header()}
+		for _, c := range resp.Cookies() {
+			req2.AddCookie(c)
+		}
+
+		_, _ = store.Get(req2, "test-sess")
+
+		// I want each pass to make the table but I don't want to count the
+		// time I spend dropping it between passes
+		b.StopTimer()
+		_ = dbSess.Query(`DROP TABLE "sessions"`).Exec()
+		b.StartTimer()
+	}
+	b.StopTimer()
+
+	err = doTearDown(cluster)
+	if err != nil {
 		b.Error(err)
 	}
 }
+
+// statementRecorder is a gocql.QueryObserver that remembers the statement of
+// every query it observes.
+type statementRecorder struct {
+	mu    sync.Mutex
+	stmts []string
+}
+
+func (r *statementRecorder) ObserveQuery(ctx context.Context, q gocql.ObservedQuery) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stmts = append(r.stmts, q.Statement)
+}
+
+func (r *statementRecorder) statements() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.stmts...)
+}
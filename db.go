@@ -0,0 +1,290 @@
+package cqlstore
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gocql/gocql"
+	"github.com/jcbwlkr/cqlstore/internal/storeq"
+)
+
+// query starts a query on the store's session with any per query settings
+// from the store's Options applied. It runs with ctx, which should be the one
+// from queryContext unless the caller was given its own.
+func (st *CQLStore) query(ctx context.Context, stmt string, values ...interface{}) query {
+	return st.wrap(ctx, st.db.Query(st.tag(stmt), values...))
+}
+
+// rowQuery is like query for statements on the row of session id. The query
+// is given id's partition as its routing key so token aware host selection
+// sends it straight to a replica holding the row.
+func (st *CQLStore) rowQuery(ctx context.Context, id, stmt string, values ...interface{}) query {
+	q := st.db.Query(st.tag(stmt), values...)
+	if st.textID {
+		q = q.RoutingKey([]byte(st.rowID(id)))
+	} else if u, err := gocql.ParseUUID(st.rowID(id)); err == nil {
+		q = q.RoutingKey(u.Bytes())
+	}
+	return st.wrap(ctx, q)
+}
+
+// queryContext returns the context queries run with when the caller has none
+// of its own, the one set with WithBaseContext if any.
+func (st *CQLStore) queryContext() context.Context {
+	if st.baseCtx != nil {
+		return st.baseCtx
+	}
+	return context.Background()
+}
+
+// tag adds the comment set with WithQueryTag to stmt.
+func (st *CQLStore) tag(stmt string) string {
+	if st.queryTag == "" {
+		return stmt
+	}
+	return "/* " + st.queryTag + " */ " + strings.TrimSpace(stmt)
+}
+
+// wrap applies ctx and the store's per query settings to q.
+func (st *CQLStore) wrap(ctx context.Context, q query) query {
+	q = q.WithContext(ctx)
+	if st.slowQuery > 0 {
+		q = q.Observer(slowQueryObserver{st})
+	}
+	if st.downgrade {
+		q = downgradeQuery{q, st.downgradeFrom, st.downgradeTo}
+	}
+	if st.breaker != nil {
+		q = breakerQuery{q, st.breaker}
+	}
+	return q
+}
+
+// batch starts a batch of the type set with WithBatchType on the store's
+// session, run with ctx and the same per query settings as query.
+func (st *CQLStore) batch(ctx context.Context) batch {
+	var b batch = taggedBatch{st.db.Batch(st.batchType).WithContext(ctx), st}
+	if st.slowQuery > 0 {
+		b = b.Observer(slowQueryObserver{st})
+	}
+	if st.breaker != nil {
+		b = breakerBatch{b, st.breaker}
+	}
+	return b
+}
+
+// taggedBatch adds the comment set with WithQueryTag to the statements of a
+// batch.
+type taggedBatch struct {
+	batch
+	st *CQLStore
+}
+
+func (b taggedBatch) Query(stmt string, values ...interface{}) {
+	b.batch.Query(b.st.tag(stmt), values...)
+}
+
+func (b taggedBatch) WithContext(ctx context.Context) batch {
+	return taggedBatch{b.batch.WithContext(ctx), b.st}
+}
+
+func (b taggedBatch) Observer(o gocql.BatchObserver) batch {
+	return taggedBatch{b.batch.Observer(o), b.st}
+}
+
+// slowQueryObserver logs queries that take longer than the store's
+// WithSlowQueryThreshold.
+type slowQueryObserver struct {
+	st *CQLStore
+}
+
+func (o slowQueryObserver) ObserveQuery(ctx context.Context, q gocql.ObservedQuery) {
+	took := q.End.Sub(q.Start)
+	if took <= o.st.slowQuery {
+		return
+	}
+
+	op := "query"
+	if f := strings.Fields(stripComment(q.Statement)); len(f) > 0 {
+		op = strings.ToLower(f[0])
+	}
+	o.st.logger.Printf("cqlstore: slow %s on table %s took %s", op, o.st.table, took)
+}
+
+func (o slowQueryObserver) ObserveBatch(ctx context.Context, b gocql.ObservedBatch) {
+	if took := b.End.Sub(b.Start); took > o.st.slowQuery {
+		o.st.logger.Printf("cqlstore: slow batch of %d statements on table %s took %s",
+			len(b.Statements), o.st.table, took)
+	}
+}
+
+// RawQuery returns a query for the store's gocql session, for running custom
+// maintenance queries against the sessions table. Use TableExpr to refer to
+// the table. None of the store's Options, such as WithQueryTag, are applied.
+func (st *CQLStore) RawQuery(cql string, args ...interface{}) *gocql.Query {
+	return st.DB().Query(cql, args...)
+}
+
+func init() {
+	storeq.New = func(st interface{}, key, stmt string, values ...interface{}) storeq.Query {
+		return st.(*CQLStore).keyQuery(key, stmt, values...)
+	}
+	storeq.ReadOnly = func(st interface{}) bool {
+		return st.(*CQLStore).readOnly
+	}
+}
+
+// keyQuery is query for statements on any table of the store's keyspace. If
+// key is not empty it is the text partition key of the row stmt is on and is
+// used as the routing key.
+func (st *CQLStore) keyQuery(key, stmt string, values ...interface{}) query {
+	q := st.db.Query(st.tag(stmt), values...)
+	if key != "" {
+		q = q.RoutingKey([]byte(key))
+	}
+	return st.wrap(st.queryContext(), q)
+}
+
+// DB returns the gocql session the store was created with so the same
+// connections can be used for other queries. The store does not own the
+// session: close it only when done with the store too, and only if it was not
+// shared with something else that still needs it.
+func (st *CQLStore) DB() *gocql.Session {
+	g, _ := st.db.(gocqlSession)
+	return g.s
+}
+
+// TableExpr returns the name of the sessions table quoted for use in CQL, for
+// example "SELECT count(*) FROM " + st.TableExpr().
+func (st *CQLStore) TableExpr() string {
+	return `"` + st.table + `"`
+}
+
+// stripComment removes the comment added by WithQueryTag from the start of a
+// statement.
+func stripComment(stmt string) string {
+	stmt = strings.TrimSpace(stmt)
+	if !strings.HasPrefix(stmt, "/*") {
+		return stmt
+	}
+	if i := strings.Index(stmt, "*/"); i >= 0 {
+		return strings.TrimSpace(stmt[i+2:])
+	}
+	return stmt
+}
+
+// session is the part of *gocql.Session the store needs. It lets tests run
+// the store against a fake database.
+type session interface {
+	Query(stmt string, values ...interface{}) query
+	Batch(typ gocql.BatchType) batch
+}
+
+// query is the part of *gocql.Query the store needs.
+type query interface {
+	Exec() error
+	Scan(dest ...interface{}) error
+	MapScanCAS(dest map[string]interface{}) (bool, error)
+	Iter() iter
+	Observer(o gocql.QueryObserver) query
+	RoutingKey(key []byte) query
+	WithContext(ctx context.Context) query
+	Consistency(c gocql.Consistency) query
+	PageSize(n int) query
+	PageState(state []byte) query
+}
+
+// batch is the part of *gocql.Batch the store needs.
+type batch interface {
+	Query(stmt string, values ...interface{})
+	WithContext(ctx context.Context) batch
+	Observer(o gocql.BatchObserver) batch
+	Exec() error
+}
+
+// iter is the part of *gocql.Iter the store needs.
+type iter interface {
+	Scan(dest ...interface{}) bool
+	PageState() []byte
+	Close() error
+}
+
+// gocqlSession adapts a *gocql.Session to session.
+type gocqlSession struct {
+	s *gocql.Session
+}
+
+func (g gocqlSession) Query(stmt string, values ...interface{}) query {
+	return gocqlQuery{g.s.Query(stmt, values...)}
+}
+
+func (g gocqlSession) Batch(typ gocql.BatchType) batch {
+	return gocqlBatch{g.s, g.s.NewBatch(typ)}
+}
+
+// gocqlQuery adapts a *gocql.Query to query.
+type gocqlQuery struct {
+	q *gocql.Query
+}
+
+func (g gocqlQuery) Exec() error {
+	return g.q.Exec()
+}
+
+func (g gocqlQuery) Scan(dest ...interface{}) error {
+	return g.q.Scan(dest...)
+}
+
+func (g gocqlQuery) MapScanCAS(dest map[string]interface{}) (bool, error) {
+	return g.q.MapScanCAS(dest)
+}
+
+func (g gocqlQuery) Iter() iter {
+	return g.q.Iter()
+}
+
+func (g gocqlQuery) Observer(o gocql.QueryObserver) query {
+	return gocqlQuery{g.q.Observer(o)}
+}
+
+func (g gocqlQuery) RoutingKey(key []byte) query {
+	return gocqlQuery{g.q.RoutingKey(key)}
+}
+
+func (g gocqlQuery) WithContext(ctx context.Context) query {
+	return gocqlQuery{g.q.WithContext(ctx)}
+}
+
+func (g gocqlQuery) Consistency(c gocql.Consistency) query {
+	return gocqlQuery{g.q.Consistency(c)}
+}
+
+func (g gocqlQuery) PageSize(n int) query {
+	return gocqlQuery{g.q.PageSize(n)}
+}
+
+func (g gocqlQuery) PageState(state []byte) query {
+	return gocqlQuery{g.q.PageState(state)}
+}
+
+// gocqlBatch adapts a *gocql.Batch to batch.
+type gocqlBatch struct {
+	s *gocql.Session
+	b *gocql.Batch
+}
+
+func (g gocqlBatch) Query(stmt string, values ...interface{}) {
+	g.b.Query(stmt, values...)
+}
+
+func (g gocqlBatch) WithContext(ctx context.Context) batch {
+	return gocqlBatch{g.s, g.b.WithContext(ctx)}
+}
+
+func (g gocqlBatch) Observer(o gocql.BatchObserver) batch {
+	return gocqlBatch{g.s, g.b.Observer(o)}
+}
+
+func (g gocqlBatch) Exec() error {
+	return g.s.ExecuteBatch(g.b)
+}
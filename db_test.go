@@ -0,0 +1,593 @@
+package cqlstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/jcbwlkr/cqlstore/internal/storeq"
+)
+
+// testKeys are valid keys for stores created in tests.
+var testKeys = [][]byte{[]byte("0123456789abcdef0123456789abcdef"), nil}
+
+// fakeDB is an in memory session that understands just enough of the
+// statements the store runs to test it without a cluster. Rows are kept per
+// table and keyed by id.
+type fakeDB struct {
+	mu     sync.Mutex
+	tables map[string]map[interface{}]map[string]interface{}
+	stmts  []string
+	routes [][]byte
+	cons   []gocql.Consistency
+	types  []gocql.BatchType
+	last   *fakeBatch
+
+	// fail, if set, is consulted before every query. A non-nil error is
+	// returned instead of running the query.
+	fail func(stmt string, args []interface{}) error
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{tables: make(map[string]map[interface{}]map[string]interface{})}
+}
+
+func (db *fakeDB) Query(stmt string, values ...interface{}) query {
+	return &fakeQuery{db: db, stmt: stripComment(stmt), raw: stmt, args: values}
+}
+
+func (db *fakeDB) Batch(typ gocql.BatchType) batch {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.last = &fakeBatch{db: db, typ: typ}
+	return db.last
+}
+
+// lastBatch returns the batch started last.
+func (db *fakeDB) lastBatch() *fakeBatch {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.last
+}
+
+// batchTypes returns the type of every batch run so far.
+func (db *fakeDB) batchTypes() []gocql.BatchType {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]gocql.BatchType(nil), db.types...)
+}
+
+// statements returns every statement run so far.
+func (db *fakeDB) statements() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string(nil), db.stmts...)
+}
+
+// routingKeys returns the routing key of every statement run so far.
+func (db *fakeDB) routingKeys() [][]byte {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([][]byte(nil), db.routes...)
+}
+
+// consistencies returns the consistency every statement run so far was set
+// to, or 0 if it was not set.
+func (db *fakeDB) consistencies() []gocql.Consistency {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]gocql.Consistency(nil), db.cons...)
+}
+
+// rows returns the rows of table.
+func (db *fakeDB) rows(table string) map[interface{}]map[string]interface{} {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.tables[table]
+}
+
+var (
+	fakeInsert = regexp.MustCompile(`^INSERT INTO "(\w+)" \(([^)]*)\) VALUES`)
+	fakeSelect = regexp.MustCompile(`^SELECT (.+) FROM "(\w+)" WHERE "id" = \?`)
+	fakeDelete = regexp.MustCompile(`^DELETE FROM "(\w+)" WHERE "id" = \?`)
+)
+
+// fakeBatch runs its statements one after the other when executed.
+type fakeBatch struct {
+	db       *fakeDB
+	typ      gocql.BatchType
+	qs       []*fakeQuery
+	ctx      context.Context
+	observer gocql.BatchObserver
+}
+
+func (b *fakeBatch) Query(stmt string, values ...interface{}) {
+	b.qs = append(b.qs, &fakeQuery{db: b.db, stmt: stripComment(stmt), raw: stmt, args: values})
+}
+
+func (b *fakeBatch) WithContext(ctx context.Context) batch {
+	b.ctx = ctx
+	return b
+}
+
+func (b *fakeBatch) Observer(o gocql.BatchObserver) batch {
+	b.observer = o
+	return b
+}
+
+func (b *fakeBatch) Exec() error {
+	b.db.mu.Lock()
+	b.db.types = append(b.db.types, b.typ)
+	b.db.mu.Unlock()
+
+	for _, q := range b.qs {
+		q.ctx = b.ctx
+		if err := q.Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fakeQuery struct {
+	db       *fakeDB
+	stmt     string
+	raw      string
+	args     []interface{}
+	observer gocql.QueryObserver
+	routing  []byte
+	ctx      context.Context
+	cons     gocql.Consistency
+}
+
+func (q *fakeQuery) run(dest []interface{}) error {
+	q.db.mu.Lock()
+	defer q.db.mu.Unlock()
+
+	q.db.stmts = append(q.db.stmts, q.raw)
+	q.db.routes = append(q.db.routes, q.routing)
+	q.db.cons = append(q.db.cons, q.cons)
+	if q.ctx != nil && q.ctx.Err() != nil {
+		return q.ctx.Err()
+	}
+	if q.db.fail != nil {
+		if err := q.db.fail(q.stmt, q.args); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(q.stmt, "CREATE"), strings.HasPrefix(q.stmt, "ALTER"):
+		return nil
+
+	case fakeInsert.MatchString(q.stmt):
+		m := fakeInsert.FindStringSubmatch(q.stmt)
+		cols := fakeColumns(m[2])
+		row := make(map[string]interface{})
+		for i, c := range cols {
+			row[c] = q.args[i]
+		}
+		row[`WRITETIME("data")`] = time.Now().UnixMicro()
+		args := q.args
+		if strings.Contains(q.stmt, "AND TIMESTAMP ?") {
+			row[`WRITETIME("data")`] = args[len(args)-1]
+			args = args[:len(args)-1]
+		}
+		if strings.Contains(q.stmt, "USING TTL ?") {
+			row[`TTL("data")`] = args[len(args)-1]
+		}
+		if q.db.tables[m[1]] == nil {
+			q.db.tables[m[1]] = make(map[interface{}]map[string]interface{})
+		}
+		if old, ok := q.db.tables[m[1]][row["id"]]; ok && old[`WRITETIME("data")`].(int64) > row[`WRITETIME("data")`].(int64) {
+			// Older writes lose
+			return nil
+		}
+		q.db.tables[m[1]][row["id"]] = row
+		return nil
+
+	case fakeSelect.MatchString(q.stmt):
+		m := fakeSelect.FindStringSubmatch(q.stmt)
+		row, ok := q.db.tables[m[2]][q.args[0]]
+		if !ok {
+			return gocql.ErrNotFound
+		}
+		for i, c := range fakeColumns(m[1]) {
+			if v, ok := row[c]; ok {
+				fakeScan(dest[i], v)
+			}
+		}
+		return nil
+
+	case fakeDelete.MatchString(q.stmt):
+		m := fakeDelete.FindStringSubmatch(q.stmt)
+		delete(q.db.tables[m[1]], q.args[0])
+		return nil
+	}
+
+	return errors.New("fakeDB does not understand " + q.stmt)
+}
+
+func (q *fakeQuery) Exec() error {
+	return q.run(nil)
+}
+
+func (q *fakeQuery) Scan(dest ...interface{}) error {
+	return q.run(dest)
+}
+
+func (q *fakeQuery) MapScanCAS(dest map[string]interface{}) (bool, error) {
+	return false, errors.New("fakeDB does not support lightweight transactions")
+}
+
+func (q *fakeQuery) Observer(o gocql.QueryObserver) query {
+	q.observer = o
+	return q
+}
+
+func (q *fakeQuery) RoutingKey(key []byte) query {
+	q.routing = key
+	return q
+}
+
+func (q *fakeQuery) WithContext(ctx context.Context) query {
+	q.ctx = ctx
+	return q
+}
+
+func (q *fakeQuery) Consistency(c gocql.Consistency) query {
+	q.cons = c
+	return q
+}
+
+func (q *fakeQuery) PageSize(n int) query {
+	return q
+}
+
+func (q *fakeQuery) PageState(state []byte) query {
+	return q
+}
+
+func (q *fakeQuery) Iter() iter {
+	return &fakeIter{err: errors.New("fakeDB does not support iterating")}
+}
+
+type fakeIter struct {
+	err error
+}
+
+func (i *fakeIter) Scan(dest ...interface{}) bool { return false }
+func (i *fakeIter) PageState() []byte             { return nil }
+func (i *fakeIter) Close() error                  { return i.err }
+
+// fakeScan stores v in dest. Like the driver, text and blob values are copied
+// out of the result, into the existing capacity of a []byte.
+func fakeScan(dest, v interface{}) {
+	switch d := dest.(type) {
+	case *string:
+		if s, ok := v.(string); ok {
+			*d = strings.Clone(s)
+			return
+		}
+	case *[]byte:
+		switch b := v.(type) {
+		case string:
+			*d = append((*d)[:0], b...)
+			return
+		case []byte:
+			*d = append((*d)[:0], b...)
+			return
+		}
+	}
+	reflect.ValueOf(dest).Elem().Set(reflect.ValueOf(v))
+}
+
+// fakeColumns splits a quoted column list like `"id", "data"`.
+func fakeColumns(list string) []string {
+	cols := strings.Split(list, ",")
+	for i, c := range cols {
+		c = strings.TrimSpace(c)
+		if !strings.HasSuffix(c, ")") {
+			c = strings.Trim(c, `"`)
+		}
+		cols[i] = c
+	}
+	return cols
+}
+
+// TestSaveLoadDeleteWithFakeDB runs a session through its whole life without a
+// Cassandra cluster.
+func TestSaveLoadDeleteWithFakeDB(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Save a new session
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, err := store.New(req1, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Values["foo"] = "Foo"
+
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(db.rows("sessions")); n != 1 {
+		t.Fatalf("expected 1 row after saving, got %d", n)
+	}
+
+	// Load it with the cookie from the first response
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	resp := http.Response{Header: w.Header()}
+	for _, c := range resp.Cookies() {
+		req2.AddCookie(c)
+	}
+
+	sess2, err := store.New(req2, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess2.IsNew {
+		t.Error("expected the session to be loaded")
+	}
+	if sess2.Values["foo"] != "Foo" {
+		t.Errorf("expected foo to be Foo, got %v", sess2.Values["foo"])
+	}
+
+	// Delete it
+	sess2.Options.MaxAge = -1
+	w2 := httptest.NewRecorder()
+	if err := sess2.Save(req2, w2); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(db.rows("sessions")); n != 0 {
+		t.Errorf("expected no rows after deleting, got %d", n)
+	}
+	if c := w2.Header().Get("Set-Cookie"); !strings.HasPrefix(c, "test-sess=; ") {
+		t.Errorf("expected the cookie to be cleared, got %q", c)
+	}
+}
+
+// logRecorder is a Logger that keeps what is logged.
+type logRecorder struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *logRecorder) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+}
+
+func (l *logRecorder) lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.logs...)
+}
+
+func TestSlowQueriesAreLogged(t *testing.T) {
+	db := newFakeDB()
+	logs := &logRecorder{}
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithLogger(logs),
+		WithSlowQueryThreshold(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The store attaches the observer to its queries
+	q := store.query(store.queryContext(), `SELECT "data" FROM "sessions" WHERE "id" = ?`, "x").(*fakeQuery)
+	if q.observer == nil {
+		t.Fatal("expected the query to have an observer")
+	}
+
+	start := time.Now()
+	q.observer.ObserveQuery(context.Background(), gocql.ObservedQuery{
+		Statement: q.stmt,
+		Start:     start,
+		End:       start.Add(time.Millisecond),
+	})
+	if n := len(logs.lines()); n != 0 {
+		t.Fatalf("expected fast queries not to be logged, got %d lines", n)
+	}
+
+	q.observer.ObserveQuery(context.Background(), gocql.ObservedQuery{
+		Statement: q.stmt,
+		Start:     start,
+		End:       start.Add(50 * time.Millisecond),
+	})
+	lines := logs.lines()
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line to be logged, got %d", len(lines))
+	}
+	for _, want := range []string{"select", "sessions", "50ms"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("expected %q to contain %q", lines[0], want)
+		}
+	}
+}
+
+func TestQueryTag(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithQueryTag("app=foo"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stmt := range db.statements() {
+		if !strings.HasPrefix(stmt, "/* app=foo */ ") {
+			t.Errorf("expected statement to be tagged, got %q", stmt)
+		}
+	}
+
+	if _, err := newStore(db, "sessions", WithKeyPairs(testKeys...), WithQueryTag("a */ DROP")); err == nil {
+		t.Error("expected a tag closing the comment to be rejected")
+	}
+}
+
+func TestBaseContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store, err := newStore(newFakeDB(), "sessions",
+		WithKeyPairs(testKeys...),
+		WithBaseContext(ctx),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := sess.Save(r, httptest.NewRecorder()); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled after cancelling the base context, got %v", err)
+	}
+}
+
+func TestRowQueriesHaveRoutingKeys(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := len(db.statements())
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(req1, "test-sess")
+	sess.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	if err := store.Logout(req2, httptest.NewRecorder(), "test-sess"); err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := gocql.ParseUUID(sess.ID)
+	stmts, keys := db.statements()[created:], db.routingKeys()[created:]
+	if len(stmts) != 3 {
+		t.Fatalf("expected an insert, a select and a delete, got %v", stmts)
+	}
+	for i, stmt := range stmts {
+		if !bytes.Equal(keys[i], id.Bytes()) {
+			t.Errorf("expected %q to be routed by the session ID, got %x", stmt, keys[i])
+		}
+	}
+}
+
+func TestQueryAppliesOptions(t *testing.T) {
+	db := newFakeDB()
+	ctx, cancel := context.WithCancel(context.Background())
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithTextID(),
+		WithQueryTag("app=foo"),
+		WithBaseContext(ctx),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := len(db.statements())
+
+	var data string
+	err = storeq.New(store, "abc", `SELECT "data" FROM "sessions" WHERE "id" = ?`, "abc").Scan(&data)
+	if err != gocql.ErrNotFound {
+		t.Errorf("expected gocql.ErrNotFound, got %v", err)
+	}
+	stmts, keys := db.statements()[created:], db.routingKeys()[created:]
+	if len(stmts) != 1 || !strings.HasPrefix(stmts[0], "/* app=foo */ ") {
+		t.Errorf("expected the statement to be tagged, got %v", stmts)
+	}
+	if len(keys) != 1 || string(keys[0]) != "abc" {
+		t.Errorf("expected the query to be routed by its key, got %q", keys)
+	}
+
+	cancel()
+	err = storeq.New(store, "", `DELETE FROM "sessions" WHERE "id" = ?`, "abc").Exec()
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled after cancelling the base context, got %v", err)
+	}
+}
+
+func TestBatchesApplyOptions(t *testing.T) {
+	db := newFakeDB()
+	logs := &logRecorder{}
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithLogger(logs),
+		WithQueryTag("app=foo"),
+		WithSlowQueryThreshold(10*time.Millisecond),
+		WithCircuitBreaker(1, time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := len(db.statements())
+
+	id := "00000000-0000-0000-0000-000000000001"
+	if err := store.DeleteBatch(id); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range db.statements()[created:] {
+		if !strings.HasPrefix(stmt, "/* app=foo */ ") {
+			t.Errorf("expected batch statement to be tagged, got %q", stmt)
+		}
+	}
+
+	b := db.lastBatch()
+	if b.observer == nil {
+		t.Fatal("expected the batch to have an observer")
+	}
+	start := time.Now()
+	b.observer.ObserveBatch(context.Background(), gocql.ObservedBatch{
+		Statements: []string{b.qs[0].raw},
+		Start:      start,
+		End:        start.Add(50 * time.Millisecond),
+	})
+	if lines := logs.lines(); len(lines) != 1 || !strings.Contains(lines[0], "batch") {
+		t.Errorf("expected the slow batch to be logged, got %v", lines)
+	}
+
+	errDown := errors.New("node is down")
+	db.fail = func(stmt string, args []interface{}) error { return errDown }
+	if err := store.DeleteBatch(id); !errors.Is(err, errDown) {
+		t.Fatalf("expected the database error, got %v", err)
+	}
+	if err := store.DeleteBatch(id); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected batches to be stopped by the open breaker, got %v", err)
+	}
+}
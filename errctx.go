@@ -0,0 +1,107 @@
+package cqlstore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// ContextError is returned by NewContext and SaveContext in place of the
+// error New or Save returned. It carries the values found in the context
+// under the keys given to WithErrorContextKeys, such as a request ID, so
+// failures can be correlated in logs. Use errors.As to get at it.
+type ContextError struct {
+	Err error
+	// Fields maps each configured context key to its value. Keys missing
+	// from the context are left out.
+	Fields map[interface{}]interface{}
+}
+
+func (e ContextError) Error() string {
+	if len(e.Fields) == 0 {
+		return e.Err.Error()
+	}
+
+	fields := make([]string, 0, len(e.Fields))
+	for k, v := range e.Fields {
+		fields = append(fields, fmt.Sprintf("%v=%v", k, v))
+	}
+	sort.Strings(fields)
+	return e.Err.Error() + " [" + strings.Join(fields, " ") + "]"
+}
+
+func (e ContextError) Unwrap() error {
+	return e.Err
+}
+
+// NewContext is like New but its queries are cancelled once ctx or the
+// context set with WithBaseContext is done, whichever comes first, and errors
+// are returned as a ContextError with the fields of ctx. The store never uses
+// the context of r, so New and Save keep working for requests that were
+// cancelled. Pass r.Context() to give up along with the request, or another
+// context to bound the queries differently.
+func (st *CQLStore) NewContext(ctx context.Context, r *http.Request, name string) (*sessions.Session, error) {
+	qctx, cancel := st.mergeContext(ctx)
+	defer cancel()
+	s, err := st.newSession(qctx, r, name)
+	return s, st.contextError(ctx, err)
+}
+
+// SaveContext is like Save but uses ctx like NewContext does.
+func (st *CQLStore) SaveContext(ctx context.Context, r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
+	qctx, cancel := st.mergeContext(ctx)
+	defer cancel()
+	return st.contextError(ctx, st.saveSession(qctx, r, w, s))
+}
+
+// mergeContext returns a context that is done once ctx or the store's base
+// context is, with the earlier of their deadlines. cancel must be called once
+// it is no longer needed.
+func (st *CQLStore) mergeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if st.baseCtx == nil {
+		return context.WithCancel(ctx)
+	}
+
+	merged, cancel := context.WithCancel(ctx)
+	if d, ok := st.baseCtx.Deadline(); ok {
+		// WithDeadline keeps the earlier deadline if ctx already has one
+		var cancelDeadline context.CancelFunc
+		merged, cancelDeadline = context.WithDeadline(merged, d)
+		cancelParent := cancel
+		cancel = func() {
+			cancelDeadline()
+			cancelParent()
+		}
+	}
+	if st.baseCtx.Err() != nil {
+		cancel()
+		return merged, cancel
+	}
+	go func() {
+		select {
+		case <-st.baseCtx.Done():
+			cancel()
+		case <-merged.Done():
+		}
+	}()
+	return merged, cancel
+}
+
+// contextError wraps err in a ContextError with the fields of ctx.
+func (st *CQLStore) contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	fields := make(map[interface{}]interface{}, len(st.errorKeys))
+	for _, k := range st.errorKeys {
+		if v := ctx.Value(k); v != nil {
+			fields[k] = v
+		}
+	}
+	return ContextError{Err: err, Fields: fields}
+}
@@ -0,0 +1,122 @@
+package cqlstore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type requestIDKey struct{}
+
+func (requestIDKey) String() string { return "request_id" }
+
+func TestContextError(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...), WithErrorContextKeys(requestIDKey{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-123")
+
+	// A cookie that can not be loaded
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	r.AddCookie(&http.Cookie{Name: "test-sess", Value: "bogus"})
+	sess, err := store.NewContext(ctx, r, "test-sess")
+
+	var ctxErr ContextError
+	if !errors.As(err, &ctxErr) {
+		t.Fatalf("expected a ContextError, got %v", err)
+	}
+	if id := ctxErr.Fields[requestIDKey{}]; id != "req-123" {
+		t.Errorf("expected the request ID in the fields, got %v", ctxErr.Fields)
+	}
+	if !strings.Contains(err.Error(), "[request_id=req-123]") {
+		t.Errorf("expected the request ID in the message, got %q", err)
+	}
+	var load loadError
+	if !errors.As(err, &load) {
+		t.Errorf("expected the load error to be wrapped, got %v", err)
+	}
+
+	// Save errors get the fields too
+	db.fail = func(stmt string, args []interface{}) error {
+		return errors.New("node is down")
+	}
+	err = store.SaveContext(ctx, r, httptest.NewRecorder(), sess)
+	if !errors.As(err, &ctxErr) || ctxErr.Fields[requestIDKey{}] != "req-123" {
+		t.Errorf("expected a ContextError with the request ID, got %v", err)
+	}
+
+	// Success is still nil
+	db.fail = nil
+	if err := store.SaveContext(ctx, r, httptest.NewRecorder(), sess); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestContextQueries(t *testing.T) {
+	base, cancelBase := context.WithCancel(context.Background())
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...), WithBaseContext(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	w := httptest.NewRecorder()
+	if err := store.SaveContext(context.Background(), r, w, sess); err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie((&http.Response{Header: w.Header()}).Cookies()[0])
+
+	// The queries of NewContext and SaveContext run with ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.NewContext(ctx, r, "test-sess"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected NewContext to fail with context.Canceled, got %v", err)
+	}
+	if err := store.SaveContext(ctx, r, httptest.NewRecorder(), sess); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected SaveContext to fail with context.Canceled, got %v", err)
+	}
+
+	// and with the base context
+	if _, err := store.NewContext(context.Background(), r, "test-sess"); err != nil {
+		t.Fatal(err)
+	}
+	cancelBase()
+	if err := store.SaveContext(context.Background(), r, httptest.NewRecorder(), sess); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected SaveContext to fail once the base context is cancelled, got %v", err)
+	}
+}
+
+func TestMergeContextDeadline(t *testing.T) {
+	early := time.Now().Add(time.Minute)
+	late := early.Add(time.Hour)
+
+	tests := map[string]struct {
+		base, ctx time.Time
+	}{
+		"base first": {early, late},
+		"ctx first":  {late, early},
+	}
+	for name, test := range tests {
+		base, cancelBase := context.WithDeadline(context.Background(), test.base)
+		store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...), WithBaseContext(base))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancelCtx := context.WithDeadline(context.Background(), test.ctx)
+
+		merged, cancel := store.mergeContext(ctx)
+		if d, ok := merged.Deadline(); !ok || !d.Equal(early) {
+			t.Errorf("%s: expected the deadline %v, got %v", name, early, d)
+		}
+		cancel()
+		cancelCtx()
+		cancelBase()
+	}
+}
@@ -22,8 +22,9 @@ func Example_basic() {
 	}
 	defer dbSess.Close()
 
-	// Create the CQLStore
-	store, err := cqlstore.New(dbSess, "sessions", []byte("something-secret"))
+	// Create the CQLStore with a 32 byte hash key and no block key. Pass a
+	// 16, 24 or 32 byte block key instead of nil to also encrypt sessions.
+	store, err := cqlstore.New(dbSess, "sessions", []byte("something-secret-something-secre"), nil)
 	if err != nil {
 		log.Fatalln(err)
 	}
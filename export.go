@@ -0,0 +1,275 @@
+package cqlstore
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// ExportSession returns the encoded data stored for the session id exactly as
+// it is in the database. It can be written to another table or cluster with
+// ImportSession. The data is still encrypted and/or authenticated so it is
+// only useful to a store with the same keys.
+func (st *CQLStore) ExportSession(id string) ([]byte, error) {
+	if st.fieldEncryption {
+		return nil, errFieldEncryption
+	}
+
+	r, err := st.load(st.queryContext(), id, "")
+	if err != nil {
+		return nil, loadError{err}
+	}
+
+	return []byte(r.data), nil
+}
+
+// ImportSession writes data previously returned by ExportSession as the
+// session id. The row expires after ttl. The data is written verbatim so the
+// session can only be loaded by a store with the same keys as the store it was
+// exported from. With WithOptimisticLocking an existing session is never
+// overwritten. It can not be used with WithNameInKey or WithTenant since the
+// blob holds neither the session's name nor its tenant.
+func (st *CQLStore) ImportSession(id string, blob []byte, ttl time.Duration) error {
+	if st.readOnly {
+		return saveError{ErrReadOnly}
+	}
+	if st.fieldEncryption {
+		return saveError{errFieldEncryption}
+	}
+	if st.nameInKey || st.tenant != nil {
+		return saveError{errors.New("ImportSession can not be used with WithNameInKey or WithTenant")}
+	}
+
+	s := sessions.NewSession(st, "")
+	s.ID = id
+
+	if err := st.save(st.queryContext(), s, string(blob), int(ttl/time.Second)); err != nil {
+		return saveError{err}
+	}
+
+	return nil
+}
+
+// Migrate copies every session in the store's table to dst, which may use
+// another table or keyspace, and returns how many were copied. Each keeps its
+// ID, remaining time to live, tenant and creation time. If the stores encode
+// data the same way, with the same keys, serializer, compression and
+// SetEncryption setting for the session's name, the stored data is copied as
+// is. Otherwise it is decoded and encoded again with dst's Codecs. Since data
+// is encoded with the session's name that requires the names to be stored,
+// with WithNameInKey, or all sessions to have the name set with
+// WithSessionName. The same goes for copying to a store using WithNameInKey,
+// or WithUserIndex, whose index is filled from the decoded values. Sessions
+// can not be copied from a store using WithNameInKey to one without it, where
+// sessions with different names sharing an ID would overwrite each other, nor
+// to a store using WithTenant or WithAbsoluteTimeout from one without it,
+// which has no tenants or creation times to copy.
+//
+// Migrate reads the whole table so it should be run as a maintenance task.
+// Sessions saved to the store while it runs may not be copied. It does not
+// support WithHashedKey or WithFieldEncryption, or WithChunking on the store
+// being copied from.
+func (st *CQLStore) Migrate(dst *CQLStore) (int, error) {
+	if dst.readOnly {
+		return 0, saveError{ErrReadOnly}
+	}
+	if st.hashedKey || dst.hashedKey || st.fieldEncryption || dst.fieldEncryption || st.chunkSize > 0 {
+		return 0, errors.New("Migrate does not support WithHashedKey, WithFieldEncryption or WithChunking")
+	}
+	if st.nameInKey && !dst.nameInKey {
+		return 0, errors.New("Migrate can not copy sessions from a store using WithNameInKey to one without it")
+	}
+	if (dst.tenant != nil && st.tenant == nil) || (dst.absoluteTimeout > 0 && st.absoluteTimeout == 0) {
+		return 0, errors.New("Migrate can not copy sessions to a store using WithTenant or " +
+			"WithAbsoluteTimeout from one without it")
+	}
+	needName := dst.nameInKey || dst.userKey != nil || !st.sameEncoding(dst) || !st.sameEncryption(dst)
+	if needName && !st.nameInKey && st.sessionName == "" {
+		return 0, errors.New("Migrating to a store with different codecs, WithNameInKey or WithUserIndex " +
+			"requires WithNameInKey or WithSessionName")
+	}
+
+	m := migrateRow{name: st.sessionName}
+	cols := `"id", "data", TTL("data")`
+	dest := []interface{}{&m.id, &m.data, &m.ttl}
+	if st.binary {
+		dest[1] = &m.raw
+	}
+	if st.nameInKey {
+		cols += `, "name"`
+		dest = append(dest, &m.name)
+	}
+	if st.tenant != nil {
+		cols += `, "tenant"`
+		dest = append(dest, &m.tenant)
+	}
+	if st.absoluteTimeout > 0 {
+		cols += `, "created_at"`
+		dest = append(dest, &m.createdAt)
+	}
+
+	n := 0
+	iter := st.query(st.queryContext(), `SELECT `+cols+` FROM "`+st.table+`"`).Iter()
+	for iter.Scan(dest...) {
+		s, encData, err := st.migrated(dst, m)
+		if err != nil {
+			iter.Close()
+			return n, err
+		}
+		if s == nil {
+			// Deleted with WithExpireDelete
+			continue
+		}
+
+		if err := dst.save(dst.queryContext(), s, encData, m.ttl); err != nil {
+			iter.Close()
+			return n, saveError{err}
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return n, loadError{err}
+	}
+
+	return n, nil
+}
+
+// migrateRow is a row of the table Migrate copies from.
+type migrateRow struct {
+	id, name, data string
+	raw            []byte
+	ttl            int
+	tenant         string
+	createdAt      time.Time
+}
+
+// sameEncoding reports whether data encoded by st can be decoded by dst, for
+// sessions whose names both stores encrypt or both do not. That is only
+// known for codecs made from the keys given to WithKeyPairs or AddKeyPair.
+func (st *CQLStore) sameEncoding(dst *CQLStore) bool {
+	a, b := st.encoding(), dst.encoding()
+	return a.fromKeys && b.fromKeys && sameKeys(a.keyPairs, b.keyPairs) &&
+		reflect.DeepEqual(a.serializer, b.serializer)
+}
+
+// encoding is what decides how a store encodes session data, apart from
+// SetEncryption.
+type encoding struct {
+	fromKeys   bool
+	keyPairs   [][]byte
+	serializer securecookie.Serializer
+}
+
+// encoding returns the store's encoding. Each store is locked on its own so
+// comparing two can not deadlock.
+func (st *CQLStore) encoding() encoding {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	e := encoding{
+		fromKeys:   len(st.Codecs) == len(st.keyPairs)/2 && len(st.signedCodecs) == len(st.Codecs),
+		keyPairs:   st.keyPairs,
+		serializer: st.serializer,
+	}
+	if e.serializer == nil {
+		e.serializer = securecookie.GobEncoder{}
+	}
+	return e
+}
+
+// sameEncryption reports whether st and dst encrypt the sessions of the same
+// names, as set with SetEncryption.
+func (st *CQLStore) sameEncryption(dst *CQLStore) bool {
+	for _, name := range append(st.unencryptedNames(), dst.unencryptedNames()...) {
+		if st.encrypted(name) != dst.encrypted(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// unencryptedNames returns the names of the sessions SetEncryption was called
+// for.
+func (st *CQLStore) unencryptedNames() []string {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	names := make([]string, 0, len(st.unencrypted))
+	for name := range st.unencrypted {
+		names = append(names, name)
+	}
+	return names
+}
+
+// encrypted reports whether the data of sessions with the given name is
+// encrypted, as set with SetEncryption.
+func (st *CQLStore) encrypted(name string) bool {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return !st.unencrypted[name]
+}
+
+// migrated converts a row read by Migrate to the session and data to save to
+// dst. The session is nil if the row was deleted.
+func (st *CQLStore) migrated(dst *CQLStore, m migrateRow) (*sessions.Session, string, error) {
+	data := m.data
+	var err error
+	if st.binary {
+		data = encodeBinary(m.raw)
+	} else if data, err = decodeText(data); err != nil {
+		return nil, "", loadError{err}
+	}
+	if data == "" {
+		return nil, "", nil
+	}
+
+	s := sessions.NewSession(dst, m.name)
+	s.ID = m.id
+	if dst.tenant != nil {
+		s.Values[metaTenant] = m.tenant
+	}
+	if dst.absoluteTimeout > 0 {
+		s.Values[metaCreatedAt] = m.createdAt
+	}
+
+	reencode := !st.sameEncoding(dst) || st.encrypted(m.name) != dst.encrypted(m.name)
+	if !reencode && dst.userKey == nil {
+		return s, data, nil
+	}
+
+	values := make(map[interface{}]interface{})
+	if err := st.decodeData(m.name, data, &values); err != nil {
+		return nil, "", loadError{err}
+	}
+	if dst.userKey != nil {
+		// Only so the session is indexed, what is saved is the data
+		if user, ok := values[dst.userKey]; ok {
+			s.Values[dst.userKey] = user
+		}
+	}
+	if !reencode {
+		return s, data, nil
+	}
+	encData, err := dst.encodeData(m.name, values)
+	if err != nil {
+		return nil, "", saveError{err}
+	}
+	return s, encData, nil
+}
+
+// sameKeys reports whether a and b hold the same keys.
+func sameKeys(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) || (a[i] == nil) != (b[i] == nil) {
+			return false
+		}
+	}
+	return true
+}
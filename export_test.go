@@ -0,0 +1,182 @@
+package cqlstore
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestSameKeys(t *testing.T) {
+	a := []byte("0123456789abcdef0123456789abcdef")
+	b := []byte("fedcba9876543210fedcba9876543210")
+
+	tests := []struct {
+		x, y [][]byte
+		same bool
+	}{
+		{[][]byte{a, nil}, [][]byte{a, nil}, true},
+		{[][]byte{a, b}, [][]byte{a, b}, true},
+		{[][]byte{a, nil}, [][]byte{b, nil}, false},
+		{[][]byte{a, nil}, [][]byte{a, b}, false},
+		{[][]byte{a, nil}, [][]byte{a, nil, b, nil}, false},
+	}
+
+	for i, test := range tests {
+		if same := sameKeys(test.x, test.y); same != test.same {
+			t.Errorf("%d: expected %v, got %v", i, test.same, same)
+		}
+	}
+}
+
+func TestImportSessionNeedsNameAndTenant(t *testing.T) {
+	opts := map[string]Option{
+		"WithNameInKey": WithNameInKey(),
+		"WithTenant":    WithTenant(func(r *http.Request) string { return r.Host }),
+	}
+	for name, opt := range opts {
+		store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...), WithTextID(), opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.ImportSession("abc", []byte("data"), time.Hour); err == nil {
+			t.Errorf("%s: expected ImportSession to fail", name)
+		}
+	}
+}
+
+func TestSameEncoding(t *testing.T) {
+	other := [][]byte{[]byte("fedcba9876543210fedcba9876543210"), nil}
+
+	tests := map[string]struct {
+		opts []Option
+		same bool
+	}{
+		"same":        {nil, true},
+		"keys":        {[]Option{WithKeyPairs(other...)}, false},
+		"serializer":  {[]Option{WithCodecSerializer(securecookie.JSONEncoder{})}, false},
+		"compression": {[]Option{WithCompressionThreshold(1024)}, false},
+	}
+
+	src, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, test := range tests {
+		opts := append([]Option{WithKeyPairs(testKeys...)}, test.opts...)
+		dst, err := newStore(newFakeDB(), "sessions", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if same := src.sameEncoding(dst); same != test.same {
+			t.Errorf("%s: expected %v, got %v", name, test.same, same)
+		}
+	}
+
+	dst, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.AddCodec(securecookie.New(other[0], nil))
+	if src.sameEncoding(dst) {
+		t.Error("expected a store with an added codec to encode differently")
+	}
+}
+
+func TestMigrateNeedsName(t *testing.T) {
+	other := [][]byte{[]byte("fedcba9876543210fedcba9876543210"), nil}
+
+	tests := map[string]struct {
+		src, dst []Option
+	}{
+		"name in key to without": {[]Option{WithNameInKey()}, nil},
+		"to name in key":         {nil, []Option{WithNameInKey()}},
+		"other keys":             {nil, []Option{WithKeyPairs(other...)}},
+		"to user index":          {nil, []Option{WithUserIndex("user")}},
+		"to tenant":              {[]Option{WithSessionName("test-sess")}, []Option{WithTenant(tenantOf)}},
+		"to absolute timeout":    {[]Option{WithSessionName("test-sess")}, []Option{WithAbsoluteTimeout(time.Hour)}},
+	}
+	for name, test := range tests {
+		src, err := newStore(newFakeDB(), "sessions", append([]Option{WithKeyPairs(testKeys...)}, test.src...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst, err := newStore(newFakeDB(), "sessions", append([]Option{WithKeyPairs(testKeys...)}, test.dst...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := src.Migrate(dst); err == nil {
+			t.Errorf("%s: expected Migrate to fail", name)
+		}
+	}
+
+	src, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.SetEncryption("test-sess", false)
+	if _, err := src.Migrate(dst); err == nil {
+		t.Error("expected Migrate to fail between stores encrypting different sessions")
+	}
+}
+
+func tenantOf(r *http.Request) string { return r.Host }
+
+func TestMigratedKeepsTenantCreationAndUser(t *testing.T) {
+	opts := []Option{
+		WithKeyPairs(testKeys...),
+		WithSessionName("test-sess"),
+		WithTenant(tenantOf),
+		WithAbsoluteTimeout(time.Hour),
+	}
+	src, err := newStore(newFakeDB(), "sessions", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := newFakeDB()
+	dst, err := newStore(db, "sessions", append(opts, WithUserIndex("user"))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encData, err := src.encodeData("test-sess", map[interface{}]interface{}{"user": "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now().Add(-time.Minute).Truncate(time.Second)
+	m := migrateRow{
+		id:        "00000000-0000-0000-0000-000000000001",
+		name:      "test-sess",
+		data:      encodeText(encData),
+		ttl:       3600,
+		tenant:    "example.com",
+		createdAt: created,
+	}
+
+	s, data, err := src.migrated(dst, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != encData {
+		t.Error("expected data encoded the same way to be copied as is")
+	}
+	if err := dst.save(dst.queryContext(), s, data, m.ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	row := db.rows("sessions")[m.id]
+	if row["tenant"] != "example.com" {
+		t.Errorf("expected the tenant to be copied, got %v", row["tenant"])
+	}
+	if c, _ := row["created_at"].(time.Time); !c.Equal(created) {
+		t.Errorf("expected the creation time %v to be copied, got %v", created, row["created_at"])
+	}
+	if _, ok := db.rows(dst.userTable())[m.id]; !ok {
+		t.Error("expected the session to be added to the user index")
+	}
+}
@@ -0,0 +1,85 @@
+package cqlstore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/securecookie"
+)
+
+// fieldsMarker is stored in the data column of sessions saved with
+// WithFieldEncryption so the row is not mistaken for a deleted one.
+const fieldsMarker = "fields"
+
+// encodeFields encodes each of values separately for the fields column used
+// by WithFieldEncryption. Plaintext fields are stored as their raw text and
+// every other field is encoded with the store's codecs.
+func (st *CQLStore) encodeFields(name string, values map[interface{}]interface{}) (map[string][]byte, error) {
+	fields := make(map[string][]byte, len(values))
+	codecs, _ := st.dataCodecs(name)
+	for k, v := range values {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("WithFieldEncryption requires string keys but got %T", k)
+		}
+
+		if st.plainFields[key] {
+			text, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("Plaintext field %s must be a string but got %T", key, v)
+			}
+			fields[key] = []byte(text)
+			continue
+		}
+
+		enc, err := securecookie.EncodeMulti(fieldName(name, key), fieldValue{v}, codecs...)
+		if err != nil {
+			return nil, explainGobError(err)
+		}
+		fields[key] = []byte(enc)
+	}
+	return fields, nil
+}
+
+// decodeFields reverses encodeFields.
+func (st *CQLStore) decodeFields(name string, fields map[string][]byte, values *map[interface{}]interface{}) error {
+	codecs, pairs := st.dataCodecs(name)
+	for key, b := range fields {
+		if st.plainFields[key] {
+			(*values)[key] = string(b)
+			continue
+		}
+
+		var v fieldValue
+		if err := st.decodeMulti(fieldName(name, key), string(b), &v, codecs, pairs); err != nil {
+			return explainGobError(err)
+		}
+		(*values)[key] = v.V
+	}
+	return nil
+}
+
+// fieldValue wraps each encrypted field so its type is encoded along with it,
+// the same as values in the Values map.
+type fieldValue struct {
+	V interface{}
+}
+
+// fieldName is the name a field is authenticated with. Including the key
+// stops an encrypted field from being moved to another key.
+func fieldName(name, key string) string {
+	return name + "/" + key
+}
+
+// decodeRow decodes the stored values of a session from r.
+func (st *CQLStore) decodeRow(name string, r row, values *map[interface{}]interface{}) error {
+	if st.fieldEncryption {
+		return st.decodeFields(name, r.fields, values)
+	}
+	return st.decodeData(name, r.data, values)
+}
+
+// errFieldEncryption is returned by operations that move a session's data
+// around as a single value, which sessions stored with WithFieldEncryption do
+// not have.
+var errFieldEncryption = errors.New("Not supported with WithFieldEncryption")
@@ -0,0 +1,97 @@
+package cqlstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFieldEncryption(t *testing.T) {
+	hashKey := []byte("0123456789abcdef0123456789abcdef")
+	blockKey := []byte("fedcba9876543210fedcba9876543210")
+
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(hashKey, blockKey),
+		WithFieldEncryption("theme"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(req1, "test-sess")
+	sess.Values["theme"] = "dark"
+	sess.Values["email"] = "bob@example.com"
+	sess.Values["visits"] = 3
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+
+	// The plaintext field can be read straight from the row while the others
+	// are encrypted one by one
+	fields := db.rows("sessions")[sess.ID]["fields"].(map[string][]byte)
+	if string(fields["theme"]) != "dark" {
+		t.Errorf("expected theme to be stored as plain text, got %q", fields["theme"])
+	}
+	if len(fields["email"]) == 0 || strings.Contains(string(fields["email"]), "bob") {
+		t.Errorf("expected email to be encrypted, got %q", fields["email"])
+	}
+	if string(fields["email"]) == string(fields["visits"]) {
+		t.Error("expected fields to be encrypted separately")
+	}
+
+	// Everything loads back as it was
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	sess2, err := store.New(req2, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess2.Values["theme"] != "dark" || sess2.Values["email"] != "bob@example.com" || sess2.Values["visits"] != 3 {
+		t.Errorf("expected values to round trip, got %v", sess2.Values)
+	}
+
+	// Plaintext fields must be strings
+	sess2.Values["theme"] = 42
+	if err := sess2.Save(req2, httptest.NewRecorder()); err == nil {
+		t.Error("expected a non-string plaintext field to be rejected")
+	}
+}
+
+func TestFieldEncryptionExpireDelete(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithFieldEncryption(),
+		WithExpireDelete(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	sess.Values["email"] = "bob@example.com"
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	sess.Options.MaxAge = -1
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewriting the row would leave the encrypted fields behind
+	stmts := db.statements()
+	if last := stmts[len(stmts)-1]; !strings.HasPrefix(last, "DELETE") {
+		t.Errorf("expected the row to be deleted, got %s", last)
+	}
+	if n := len(db.rows("sessions")); n != 0 {
+		t.Errorf("expected no rows, got %d", n)
+	}
+}
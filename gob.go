@@ -0,0 +1,67 @@
+package cqlstore
+
+import (
+	"encoding/gob"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func init() {
+	// Types commonly kept in sessions. Without registering them they can not
+	// be stored in Values which is an interface map.
+	Register(
+		time.Time{},
+		[]string{},
+		map[string]string{},
+		map[string]interface{}{},
+	)
+}
+
+// Register records the concrete types of values so they can be stored in
+// session Values. Values is a map of interface{} so, like anything encoded
+// with encoding/gob through an interface, every custom type stored in it must
+// be registered before it is saved or loaded. Call Register from an init
+// function with a zero value of each type:
+//
+//	func init() {
+//		cqlstore.Register(User{}, &Cart{})
+//	}
+//
+// Register is gob.Register with a clearer panic message. Types registered with
+// gob.Register directly work just as well.
+func Register(values ...interface{}) {
+	for _, v := range values {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					panic(fmt.Sprintf("cqlstore: could not register type %T: %v", v, r))
+				}
+			}()
+			gob.Register(v)
+		}()
+	}
+}
+
+// unregisteredTypeError explains a gob error caused by storing a value whose
+// type was never registered.
+type unregisteredTypeError struct {
+	err error
+}
+
+func (e unregisteredTypeError) Error() string {
+	return e.err.Error() + ". Types stored in session Values must be registered with cqlstore.Register"
+}
+
+func (e unregisteredTypeError) Unwrap() error {
+	return e.err
+}
+
+// explainGobError wraps err in an unregisteredTypeError if it was caused by an
+// unregistered type.
+func explainGobError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "not registered for interface") {
+		return unregisteredTypeError{err}
+	}
+	return err
+}
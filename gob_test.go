@@ -0,0 +1,60 @@
+package cqlstore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type registeredCart struct {
+	Items []string
+}
+
+type unregisteredCart struct {
+	Items []string
+}
+
+func init() {
+	Register(registeredCart{})
+}
+
+func TestRegisteredTypesRoundTrip(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(req1, "test-sess")
+	sess.Values["cart"] = registeredCart{Items: []string{"apple"}}
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	sess2, err := store.New(req2, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cart, ok := sess2.Values["cart"].(registeredCart)
+	if !ok || len(cart.Items) != 1 || cart.Items[0] != "apple" {
+		t.Errorf("expected the cart to round trip, got %#v", sess2.Values["cart"])
+	}
+
+	// Unregistered types fail with an explanation
+	sess2.Values["cart"] = unregisteredCart{}
+	err = sess2.Save(req2, httptest.NewRecorder())
+	var unregistered unregisteredTypeError
+	if !errors.As(err, &unregistered) {
+		t.Fatalf("expected an unregisteredTypeError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "cqlstore.Register") {
+		t.Errorf("expected the error to mention cqlstore.Register, got %q", err)
+	}
+}
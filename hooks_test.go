@@ -0,0 +1,165 @@
+package cqlstore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestHooksFireInOrder(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []string
+	store.BeforeSave = func(s *sessions.Session) error {
+		calls = append(calls, "before save")
+		return nil
+	}
+	store.AfterSave = func(s *sessions.Session) {
+		calls = append(calls, "after save")
+	}
+	store.AfterDelete = func(s *sessions.Session) {
+		calls = append(calls, "after delete")
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, err := store.New(r, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	sess.Options.MaxAge = -1
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"before save", "after save", "after delete"}
+	if !reflect.DeepEqual(want, calls) {
+		t.Errorf("expected hooks %v, got %v", want, calls)
+	}
+}
+
+func TestBeforeSaveErrorAbortsSave(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errNope := errors.New("nope")
+	afterCalled := false
+	store.BeforeSave = func(s *sessions.Session) error { return errNope }
+	store.AfterSave = func(s *sessions.Session) { afterCalled = true }
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, err := store.New(r, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := sess.Save(r, w); !errors.Is(err, errNope) {
+		t.Errorf("expected the hook's error, got %v", err)
+	}
+	if n := len(db.rows("sessions")); n != 0 {
+		t.Errorf("expected nothing to be written, got %d rows", n)
+	}
+	if afterCalled {
+		t.Error("AfterSave should not be called when the save is aborted")
+	}
+	if c := w.Header().Get("Set-Cookie"); c != "" {
+		t.Errorf("expected no cookie, got %q", c)
+	}
+}
+
+func TestValuesValidatorAbortsSave(t *testing.T) {
+	db := newFakeDB()
+	errForbidden := errors.New("password must not be stored in the session")
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithValuesValidator(func(values map[interface{}]interface{}) error {
+			if _, ok := values["password"]; ok {
+				return errForbidden
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	sess.Values["password"] = "hunter2"
+
+	w := httptest.NewRecorder()
+	err = sess.Save(r, w)
+	if !errors.Is(err, ErrValidation) || !errors.Is(err, errForbidden) {
+		t.Errorf("expected ErrValidation wrapping the validator's error, got %v", err)
+	}
+	if n := len(db.rows("sessions")); n != 0 {
+		t.Errorf("expected nothing to be written, got %d rows", n)
+	}
+	if c := w.Header().Get("Set-Cookie"); c != "" {
+		t.Errorf("expected no cookie, got %q", c)
+	}
+
+	delete(sess.Values, "password")
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Errorf("expected valid values to be saved, got %v", err)
+	}
+}
+
+func TestEvictedSessionsAreDeletes(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...), WithSessionName("test-sess"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deleted []*sessions.Session
+	store.AfterDelete = func(s *sessions.Session) {
+		deleted = append(deleted, s)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, err := store.New(r, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Values["foo"] = "bar"
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := store.queryContext()
+	if err := store.evict(ctx, sess.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].ID != sess.ID || deleted[0].Values["foo"] != "bar" {
+		t.Fatalf("expected AfterDelete with the evicted session, got %v", deleted)
+	}
+	if got := store.Stats().Deleted; got != 1 {
+		t.Errorf("expected 1 deleted session, got %d", got)
+	}
+	if rows := db.rows("sessions"); len(rows) != 0 {
+		t.Errorf("expected the row to be deleted, got %v", rows)
+	}
+
+	// A session already gone is not deleted again
+	if err := store.evict(ctx, sess.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 {
+		t.Errorf("expected no AfterDelete for a missing session, got %d calls", len(deleted))
+	}
+}
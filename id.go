@@ -0,0 +1,65 @@
+package cqlstore
+
+import (
+	"crypto/rand"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// base62 is the alphabet of Base62ID. Every character is safe to use in URLs
+// without escaping.
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Base62ID returns an ID generator for WithIDGenerator which makes random IDs
+// of length characters from [0-9A-Za-z]. Each character carries almost 6 bits
+// of randomness so a length of 22 is about as hard to guess as a random UUID.
+// The IDs are not UUIDs so the store must use WithTextID.
+func Base62ID(length int) func() string {
+	return func() string {
+		id := make([]byte, 0, length)
+		buf := make([]byte, length)
+		for len(id) < length {
+			if _, err := rand.Read(buf); err != nil {
+				panic("cqlstore: reading random bytes: " + err.Error())
+			}
+			for _, b := range buf {
+				// Skip bytes past the largest multiple of 62 so every
+				// character is equally likely.
+				if b >= 248 {
+					continue
+				}
+				id = append(id, base62[b%62])
+				if len(id) == length {
+					break
+				}
+			}
+		}
+		return string(id)
+	}
+}
+
+// deterministicTime is the time the clock of WithDeterministic stores is
+// stuck at.
+var deterministicTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// seededUUIDs returns an ID generator making random UUIDs from a pseudo random
+// generator seeded with seed, for WithDeterministic.
+func seededUUIDs(seed int64) func() string {
+	var mu sync.Mutex
+	rnd := mathrand.New(mathrand.NewSource(seed))
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var b [16]byte
+		rnd.Read(b[:])
+		// Mark it as a version 4 (random) UUID
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		u, _ := gocql.UUIDFromBytes(b[:])
+		return u.String()
+	}
+}
@@ -0,0 +1,107 @@
+package cqlstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBase62ID(t *testing.T) {
+	generate := Base62ID(22)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := generate()
+		if len(id) != 22 {
+			t.Fatalf("expected 22 characters, got %q", id)
+		}
+		if strings.Trim(id, base62) != "" {
+			t.Fatalf("expected only base62 characters, got %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("generated %q twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestTextID(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithIDGenerator(Base62ID(22)),
+		WithTextID(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stmt := range store.schema() {
+		if strings.Contains(stmt, "uuid") {
+			t.Errorf("expected text ID columns, got %s", stmt)
+		}
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(req1, "test-sess")
+	sess.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+	if len(sess.ID) != 22 {
+		t.Errorf("expected a base62 ID, got %q", sess.ID)
+	}
+	if _, ok := db.rows("sessions")[sess.ID]; !ok {
+		t.Errorf("expected row %s to be stored", sess.ID)
+	}
+
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	sess2, err := store.New(req2, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess2.ID != sess.ID || sess2.Values["foo"] != "Foo" {
+		t.Errorf("expected to load session %s, got %s with %v", sess.ID, sess2.ID, sess2.Values)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	// ids saves a few sessions with a store using seed and returns their IDs.
+	ids := func(seed int64) []string {
+		db := newFakeDB()
+		store, err := newStore(db, "sessions", WithKeyPairs(testKeys...), WithDeterministic(seed))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []string
+		for i := 0; i < 3; i++ {
+			r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+			sess, _ := store.New(r, "test-sess")
+			if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, sess.ID)
+		}
+		if now := store.now(); !now.Equal(deterministicTime) {
+			t.Errorf("expected the clock to be stopped, got %s", now)
+		}
+		return ids
+	}
+
+	a, b := ids(42), ids(42)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("expected the same IDs for the same seed, got %v and %v", a, b)
+	}
+	if a[0] == a[1] {
+		t.Errorf("expected different IDs for each session, got %v", a)
+	}
+	if c := ids(7); reflect.DeepEqual(a, c) {
+		t.Errorf("expected different IDs for a different seed, got %v", c)
+	}
+}
@@ -0,0 +1,46 @@
+package cqlstore
+
+import (
+	"context"
+
+	"github.com/gorilla/sessions"
+)
+
+// touch writes the row r that s was just loaded from back to the database with
+// a fresh time to live and the current time as last_accessed, for
+// WithMaxIdle.
+func (st *CQLStore) touch(ctx context.Context, s *sessions.Session, r row) error {
+	data, err := st.dataValue(r.data)
+	if err != nil {
+		return err
+	}
+
+	now := st.now()
+	cols := []string{"data", "last_accessed"}
+	vals := []interface{}{data, now}
+	if st.fieldEncryption {
+		cols = append(cols, "fields")
+		vals = append(vals, r.fields)
+	}
+	if st.tenant != nil {
+		cols = append(cols, "tenant")
+		vals = append(vals, r.tenant)
+	}
+	if st.appTag != "" {
+		cols = append(cols, "app_tag")
+		vals = append(vals, r.appTag)
+	}
+	if st.absoluteTimeout > 0 {
+		cols = append(cols, "created_at")
+		vals = append(vals, r.createdAt)
+	}
+
+	if err := st.write(ctx, s, cols, vals, st.maxIdle); err != nil {
+		return err
+	}
+
+	if st.userKey != nil {
+		return st.indexUser(ctx, s, now, st.maxIdle)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package cqlstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMaxIdle(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithClock(func() time.Time { return now }),
+		WithMaxIdle(15*time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(req1, "test-sess")
+	sess.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	if err := sess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+
+	if ttl := db.rows("sessions")[sess.ID][`TTL("data")`]; ttl != 900 {
+		t.Errorf("expected saving to set a TTL of 900, got %v", ttl)
+	}
+
+	for i := 0; i < 3; i++ {
+		// Time passes and the row gets closer to expiring
+		now = now.Add(10 * time.Minute)
+		db.rows("sessions")[sess.ID][`TTL("data")`] = 300
+
+		sess2, err := store.New(req2, "test-sess")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sess2.Values["foo"] != "Foo" {
+			t.Fatalf("expected to load the session, got %v", sess2.Values)
+		}
+
+		row := db.rows("sessions")[sess.ID]
+		if ttl := row[`TTL("data")`]; ttl != 900 {
+			t.Errorf("%d: expected loading to refresh the TTL to 900, got %v", i, ttl)
+		}
+		if accessed := row["last_accessed"]; accessed != now {
+			t.Errorf("%d: expected last_accessed %s, got %v", i, now, accessed)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package cqlstore
+
+import (
+	"encoding/base64"
+	"sync"
+	"unsafe"
+)
+
+// loadBuffer holds the data of a session loaded with WithInPlaceDecode. The
+// driver appends to raw so once it has grown to the size of the sessions
+// being loaded nothing more is allocated for them.
+type loadBuffer struct {
+	raw []byte
+	enc []byte
+}
+
+// loadBuffers are shared by every store using WithInPlaceDecode.
+var loadBuffers = sync.Pool{
+	New: func() interface{} { return new(loadBuffer) },
+}
+
+// view returns b as a string without copying it. The string changes whenever
+// b does so it must not be kept once the buffer is reused.
+func (buf *loadBuffer) view(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(&b[0], len(b))
+}
+
+// encodeBinary is like the function encodeBinary but encodes into the buffer
+// and returns a view of it.
+func (buf *loadBuffer) encodeBinary(raw []byte) string {
+	n := base64.URLEncoding.EncodedLen(len(raw))
+	if cap(buf.enc) < n {
+		buf.enc = make([]byte, n)
+	}
+	buf.enc = buf.enc[:n]
+	base64.URLEncoding.Encode(buf.enc, raw)
+	return buf.view(buf.enc)
+}
@@ -0,0 +1,23 @@
+// Package storeq lets the packages of this module that keep their own tables
+// next to a CQLStore's, like scsadapter, run queries the way the store runs
+// its own without making that part of the store's API.
+package storeq
+
+// Query is a query run with the settings of the store it came from.
+type Query interface {
+	Exec() error
+	Scan(dest ...interface{}) error
+}
+
+// These are set by the cqlstore package when it is initialized. st is always
+// a *cqlstore.CQLStore, which can not be named here without an import cycle.
+var (
+	// New returns a Query for stmt with the settings of Options such as
+	// WithQueryTag, WithBaseContext and WithCircuitBreaker applied. If key is
+	// not empty it is the text partition key of the row stmt is on and is
+	// used to send the query straight to a replica holding it.
+	New func(st interface{}, key, stmt string, values ...interface{}) Query
+
+	// ReadOnly reports whether st was created with WithReadOnlyStore.
+	ReadOnly func(st interface{}) bool
+)
@@ -0,0 +1,51 @@
+package cqlstore
+
+import (
+	"fmt"
+
+	"github.com/gorilla/securecookie"
+)
+
+// JSONSerializer is a serializer for WithCodecSerializer that encodes with
+// encoding/json like securecookie.JSONEncoder, so the structure of the
+// decrypted data can be read from other languages. Unlike JSONEncoder it can
+// handle session Values, whose keys have the type interface{}, as long as
+// every key is a string. Values come back as the types encoding/json decodes
+// into, such as float64 for every number, so only store simple values.
+type JSONSerializer struct{}
+
+// Serialize encodes src as JSON.
+func (JSONSerializer) Serialize(src interface{}) ([]byte, error) {
+	if values, ok := src.(map[interface{}]interface{}); ok {
+		m := make(map[string]interface{}, len(values))
+		for k, v := range values {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("cqlstore: JSONSerializer needs string keys, got %T", k)
+			}
+			m[key] = v
+		}
+		src = m
+	}
+	return securecookie.JSONEncoder{}.Serialize(src)
+}
+
+// Deserialize decodes the JSON in src into dst.
+func (JSONSerializer) Deserialize(src []byte, dst interface{}) error {
+	values, ok := dst.(*map[interface{}]interface{})
+	if !ok {
+		return securecookie.JSONEncoder{}.Deserialize(src, dst)
+	}
+
+	var m map[string]interface{}
+	if err := (securecookie.JSONEncoder{}).Deserialize(src, &m); err != nil {
+		return err
+	}
+	if *values == nil {
+		*values = make(map[interface{}]interface{}, len(m))
+	}
+	for k, v := range m {
+		(*values)[k] = v
+	}
+	return nil
+}
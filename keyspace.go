@@ -0,0 +1,111 @@
+package cqlstore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+// EnsureKeyspace creates the keyspace name if it does not already exist. The
+// replication map holds the keyspace's replication options such as
+//
+//	map[string]interface{}{
+//		"class":              "SimpleStrategy",
+//		"replication_factor": 3,
+//	}
+//
+// Strings are quoted and numbers are used as is. If the keyspace already
+// exists its replication is left unchanged.
+func EnsureKeyspace(session *gocql.Session, name string, replication map[string]interface{}) error {
+	stmt, err := keyspaceDDL(name, replication)
+	if err != nil {
+		return err
+	}
+
+	return session.Query(stmt).Exec()
+}
+
+// keyspaceDDL builds the statement run by EnsureKeyspace.
+func keyspaceDDL(name string, replication map[string]interface{}) (string, error) {
+	if !validName.MatchString(name) {
+		return "", errors.New("Invalid keyspace name " + name)
+	}
+	if len(replication) == 0 {
+		return "", errors.New("Keyspace replication must not be empty")
+	}
+
+	keys := make([]string, 0, len(replication))
+	for k := range replication {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	opts := make([]string, len(keys))
+	for i, k := range keys {
+		var v string
+		switch val := replication[k].(type) {
+		case string:
+			v = cqlString(val)
+		case int, int32, int64, uint, uint32, uint64, float32, float64:
+			v = fmt.Sprint(val)
+		default:
+			return "", fmt.Errorf("Unsupported replication value %v for %s", val, k)
+		}
+		opts[i] = cqlString(k) + ": " + v
+	}
+
+	return `CREATE KEYSPACE IF NOT EXISTS "` + name + `" WITH REPLICATION = {` +
+		strings.Join(opts, ", ") + `}`, nil
+}
+
+// cqlString quotes s as a CQL string literal.
+func cqlString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// checkReplication looks up the replication factor of the keyspace given to
+// WithReplicationCheck. It fails if it is below the minimum given to
+// WithRequireReplication and otherwise warns if sessions only have a single
+// replica.
+func (st *CQLStore) checkReplication() error {
+	var replication map[string]string
+	err := st.query(st.queryContext(), `SELECT "replication" FROM system_schema.keyspaces WHERE "keyspace_name" = ?`,
+		st.replicationKeyspace).Scan(&replication)
+	if err != nil {
+		return fmt.Errorf("Could not check replication of keyspace %s. Error: %v", st.replicationKeyspace, err)
+	}
+
+	rf := replicationFactor(replication)
+	if rf < st.minReplication {
+		return fmt.Errorf("Keyspace %s has a replication factor of %d but at least %d is required",
+			st.replicationKeyspace, rf, st.minReplication)
+	}
+	if rf < 2 {
+		st.logger.Printf("cqlstore: keyspace %s has a replication factor of %d, sessions will be lost if a node fails",
+			st.replicationKeyspace, rf)
+	}
+	return nil
+}
+
+// replicationFactor returns the smallest number of replicas a keyspace with
+// the given replication options keeps in any data center.
+func replicationFactor(replication map[string]string) int {
+	rf := 0
+	for k, v := range replication {
+		if k == "class" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		if rf == 0 || n < rf {
+			rf = n
+		}
+	}
+	return rf
+}
@@ -0,0 +1,20 @@
+package cqlstore
+
+import "testing"
+
+func TestReplicationFactor(t *testing.T) {
+	tests := []struct {
+		replication map[string]string
+		rf          int
+	}{
+		{map[string]string{"class": "org.apache.cassandra.locator.SimpleStrategy", "replication_factor": "1"}, 1},
+		{map[string]string{"class": "org.apache.cassandra.locator.SimpleStrategy", "replication_factor": "3"}, 3},
+		{map[string]string{"class": "org.apache.cassandra.locator.NetworkTopologyStrategy", "dc1": "3", "dc2": "2"}, 2},
+	}
+
+	for _, test := range tests {
+		if rf := replicationFactor(test.replication); rf != test.rf {
+			t.Errorf("expected %v to have a replication factor of %d, got %d", test.replication, test.rf, rf)
+		}
+	}
+}
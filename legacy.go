@@ -0,0 +1,27 @@
+package cqlstore
+
+import (
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// importLegacy fills s with the values held by value if it is a cookie made by
+// another gorilla store and can be decoded with the codecs given to
+// WithLegacyCookieImport. s is left new so saving it writes the values to the
+// database and replaces the cookie with a session ID cookie.
+func (st *CQLStore) importLegacy(s *sessions.Session, value string) bool {
+	if len(st.legacyCodecs) == 0 {
+		return false
+	}
+
+	values := make(map[interface{}]interface{})
+	if err := securecookie.DecodeMulti(s.Name(), value, &values, st.legacyCodecs...); err != nil {
+		return false
+	}
+
+	s.ID = ""
+	for k, v := range values {
+		s.Values[k] = v
+	}
+	return true
+}
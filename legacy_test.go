@@ -0,0 +1,69 @@
+package cqlstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+func TestLegacyCookieImport(t *testing.T) {
+	legacyKey := []byte("fedcba9876543210fedcba9876543210")
+
+	// A cookie as issued before the migration
+	old := sessions.NewCookieStore(legacyKey)
+	req1, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	oldSess, _ := old.New(req1, "test-sess")
+	oldSess.Values["foo"] = "Foo"
+	w := httptest.NewRecorder()
+	if err := oldSess.Save(req1, w); err != nil {
+		t.Fatal(err)
+	}
+
+	db := newFakeDB()
+	store, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithLegacyCookieImport(securecookie.New(legacyKey, nil)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req2, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req2.AddCookie(c)
+	}
+	sess, err := store.New(req2, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sess.IsNew || sess.Values["foo"] != "Foo" {
+		t.Fatalf("expected a new session with the legacy values, got %v", sess.Values)
+	}
+	if n := store.DecodeFailures(); n != 0 {
+		t.Errorf("expected no decode failures, got %d", n)
+	}
+
+	// Saving imports it and replaces the cookie
+	w = httptest.NewRecorder()
+	if err := sess.Save(req2, w); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.rows("sessions")[sess.ID]; !ok {
+		t.Fatal("expected the session to be imported")
+	}
+
+	req3, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		req3.AddCookie(c)
+	}
+	sess2, err := store.New(req3, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess2.IsNew || sess2.ID != sess.ID || sess2.Values["foo"] != "Foo" {
+		t.Errorf("expected to load imported session %s, got %s with %v", sess.ID, sess2.ID, sess2.Values)
+	}
+}
@@ -0,0 +1,132 @@
+package cqlstore
+
+import (
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// metaKey is the type of the keys the store uses to keep bookkeeping data
+// about a session in its Values. Entries with these keys are never written to
+// the database.
+type metaKey int
+
+const (
+	// metaVersion holds the version of a session's row when it was loaded
+	// with optimistic locking enabled.
+	metaVersion metaKey = iota
+
+	// metaTenant holds the tenant of the request that is saving a session
+	// when WithTenant is used.
+	metaTenant
+
+	// metaCreatedAt holds the time a session was first saved when
+	// WithAbsoluteTimeout is used.
+	metaCreatedAt
+
+	// metaStored holds the row a session was loaded from, or last saved as,
+	// for SaveIfChanged.
+	metaStored
+
+	// metaIssued holds the time the cookie of a session was issued when
+	// WithMinReissueAge is used.
+	metaIssued
+
+	// metaBadCookie is set on fresh sessions whose cookie could not be
+	// decoded, for ClearBadCookie.
+	metaBadCookie
+
+	// metaTimestamp holds the write timestamp of a session being saved with
+	// SaveWithTimestamp.
+	metaTimestamp
+)
+
+// storedValues returns a copy of values without the store's bookkeeping
+// entries.
+func storedValues(values map[interface{}]interface{}) map[interface{}]interface{} {
+	stored := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		if _, ok := k.(metaKey); !ok {
+			stored[k] = v
+		}
+	}
+	return stored
+}
+
+// SessionMeta describes a stored session without decoding it.
+type SessionMeta struct {
+	// CreatedAt is when the session was first saved. It is only known with
+	// WithAbsoluteTimeout and is the zero time otherwise.
+	CreatedAt time.Time
+	// UpdatedAt is when the session's data was last written, taken from the
+	// write timestamp Cassandra keeps for it rather than a column of its own.
+	// It is the clock of the client that wrote it, not the one set with
+	// WithClock. Loading a session with WithMaxIdle writes the data again, so
+	// there it is the last time the session was used rather than saved, and
+	// after SaveWithTimestamp it is the timestamp that was given.
+	UpdatedAt time.Time
+	// TTL is how long the session has left before it expires or 0 if it was
+	// saved without a time to live.
+	TTL time.Duration
+	// Size is the number of bytes of encoded data stored for the session,
+	// including values stored separately with WithFieldEncryption or
+	// WithChunking. It is the size MaxLoadSize is compared with.
+	Size int
+}
+
+// Meta returns information about the session id for admin tools, reading it
+// with a single query. It returns ErrSessionNotFound if the session does not
+// exist. With WithNameInKey the first session using the ID is described.
+func (st *CQLStore) Meta(id string) (SessionMeta, error) {
+	var m SessionMeta
+	var data string
+	var raw []byte
+	var ttl int
+	var written int64
+
+	cols := `"data", TTL("data"), WRITETIME("data")`
+	dest := []interface{}{&data, &ttl, &written}
+	if st.binary {
+		dest[0] = &raw
+	}
+	if st.absoluteTimeout > 0 {
+		cols += `, "created_at"`
+		dest = append(dest, &m.CreatedAt)
+	}
+	var fields map[string][]byte
+	if st.fieldEncryption {
+		cols += `, "fields"`
+		dest = append(dest, &fields)
+	}
+	var chunks map[int][]byte
+	if st.chunkSize > 0 {
+		cols += `, "chunks"`
+		dest = append(dest, &chunks)
+	}
+
+	where, args := st.where(id, "")
+	err := st.rowQuery(st.queryContext(), id, `SELECT `+cols+` FROM "`+st.table+`" WHERE `+where, args...).Scan(dest...)
+	if err == nil && data == "" && len(raw) == 0 {
+		err = gocql.ErrNotFound
+	}
+	if err == gocql.ErrNotFound {
+		return SessionMeta{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return SessionMeta{}, loadError{err}
+	}
+
+	// Measure it the way MaxLoadSize does
+	r := row{fields: fields}
+	data, raw = st.unchunkData(data, raw, chunks)
+	if st.binary {
+		r.data = encodeBinary(raw)
+	} else if r.data, err = decodeText(data); err != nil {
+		return SessionMeta{}, loadError{err}
+	}
+
+	m.UpdatedAt = time.Unix(0, written*int64(time.Microsecond))
+	m.TTL = time.Duration(ttl) * time.Second
+	m.Size = r.size()
+	return m, nil
+}
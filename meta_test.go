@@ -0,0 +1,83 @@
+package cqlstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+func TestMeta(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond)
+	store, err := newStore(newFakeDB(), "sessions",
+		WithKeyPairs(testKeys...),
+		WithClock(func() time.Time { return now }),
+		WithAbsoluteTimeout(24*time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	sess.Values["foo"] = "Foo"
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := store.Meta(sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.CreatedAt.Equal(now) {
+		t.Errorf("expected created at %s, got %s", now, m.CreatedAt)
+	}
+	if d := time.Since(m.UpdatedAt); d < 0 || d > time.Minute {
+		t.Errorf("expected updated at to be recent, got %s", m.UpdatedAt)
+	}
+	if m.TTL <= 0 {
+		t.Errorf("expected a positive TTL, got %s", m.TTL)
+	}
+	if m.Size == 0 {
+		t.Error("expected a nonzero size")
+	}
+
+	if _, err := store.Meta(gocql.TimeUUID().String()); err != ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestMetaSizeMatchesLoad(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"binary":           WithBinaryData(),
+		"chunking":         WithChunking(64),
+		"field encryption": WithFieldEncryption(),
+	} {
+		store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...), opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, _ := store.New(r, "test-sess")
+		sess.Values["foo"] = strings.Repeat("Foo", 100)
+		if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := store.Meta(sess.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		row, err := store.load(store.queryContext(), sess.ID, "test-sess")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Size != row.size() {
+			t.Errorf("%s: expected size %d, got %d", name, row.size(), m.Size)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package cqlstore
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path"
+
+	"github.com/gorilla/sessions"
+)
+
+// contextKey is the type of the keys the store puts in request contexts.
+type contextKey int
+
+// sessionKey is the context key Middleware stores the session under.
+const sessionKey contextKey = 0
+
+// MiddlewareOption configures the handler returned by Middleware.
+type MiddlewareOption func(*middleware)
+
+// WithSkipPaths makes Middleware pass requests whose URL path matches any of
+// the patterns straight to the next handler without touching the session.
+// Patterns use the syntax of path.Match, for example "/static/*" or
+// "/favicon.ico". Use it for asset requests that would otherwise load and
+// save a session for nothing.
+func WithSkipPaths(patterns ...string) MiddlewareOption {
+	return func(m *middleware) {
+		m.skip = append(m.skip, patterns...)
+	}
+}
+
+// WithContextKey makes Middleware store the session in the request context
+// under key instead of its own unexported key. Handlers then retrieve it with
+// FromContextKey. Like any context key it should be of a type specific to
+// the app to avoid collisions. A nil key is ignored, leaving the session under
+// the key FromContext uses.
+func WithContextKey(key interface{}) MiddlewareOption {
+	return func(m *middleware) {
+		if key != nil {
+			m.key = key
+		}
+	}
+}
+
+type middleware struct {
+	st   *CQLStore
+	name string
+	skip []string
+	key  interface{}
+	next http.Handler
+}
+
+// Middleware returns net/http middleware that gets the named session before
+// calling the next handler. Handlers retrieve it with FromContext. Handlers
+// must still call Save before writing their response.
+//
+// The session is loaded with Get so if it could not be loaded the handler
+// gets a fresh session. Calling Get again with the same request returns the
+// same session along with the error from loading it.
+//
+// With WithClearBadCookies a cookie that could not be decoded is deleted
+// before the next handler is called.
+//
+// The next handler gets a ResponseWriter that notices when the response has
+// started so Save can fail with ErrHeadersAlreadySent when it is too late to
+// set the cookie. It implements http.Flusher, http.Hijacker and io.ReaderFrom
+// whenever the original ResponseWriter does.
+func (st *CQLStore) Middleware(name string, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		m := &middleware{st: st, name: name, key: sessionKey, next: next}
+		for _, opt := range opts {
+			opt(m)
+		}
+		return m
+	}
+}
+
+func (m *middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.skipped(r.URL.Path) {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	s, _ := m.st.Get(r, m.name)
+	if m.st.clearBad {
+		m.st.ClearBadCookie(w, s)
+	}
+	ctx := context.WithValue(r.Context(), m.key, s)
+	m.next.ServeHTTP(wrapWriter(w), r.WithContext(ctx))
+}
+
+// responseWriter tracks whether the response headers were sent so Save can
+// fail with ErrHeadersAlreadySent instead of silently losing the cookie.
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the original ResponseWriter for http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *responseWriter) headersSent() bool {
+	return w.wroteHeader
+}
+
+// flusher, hijacker and readerFrom add the optional interfaces of the
+// original ResponseWriter to a responseWriter. They are separate types since
+// handlers check for them with type assertions, so the wrapper must only
+// have the ones the original has.
+type flusher struct{ w *responseWriter }
+
+func (f flusher) Flush() {
+	f.w.wroteHeader = true
+	f.w.ResponseWriter.(http.Flusher).Flush()
+}
+
+type hijacker struct{ w *responseWriter }
+
+func (h hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.w.wroteHeader = true
+	return h.w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+type readerFrom struct{ w *responseWriter }
+
+func (r readerFrom) ReadFrom(src io.Reader) (int64, error) {
+	r.w.wroteHeader = true
+	return r.w.ResponseWriter.(io.ReaderFrom).ReadFrom(src)
+}
+
+// wrapWriter wraps w in a responseWriter that implements the same of
+// http.Flusher, http.Hijacker and io.ReaderFrom as w.
+func wrapWriter(w http.ResponseWriter) http.ResponseWriter {
+	rw := &responseWriter{ResponseWriter: w}
+	_, canFlush := w.(http.Flusher)
+	_, canHijack := w.(http.Hijacker)
+	_, canReadFrom := w.(io.ReaderFrom)
+
+	switch {
+	case canFlush && canHijack && canReadFrom:
+		return struct {
+			*responseWriter
+			flusher
+			hijacker
+			readerFrom
+		}{rw, flusher{rw}, hijacker{rw}, readerFrom{rw}}
+	case canFlush && canHijack:
+		return struct {
+			*responseWriter
+			flusher
+			hijacker
+		}{rw, flusher{rw}, hijacker{rw}}
+	case canFlush && canReadFrom:
+		return struct {
+			*responseWriter
+			flusher
+			readerFrom
+		}{rw, flusher{rw}, readerFrom{rw}}
+	case canHijack && canReadFrom:
+		return struct {
+			*responseWriter
+			hijacker
+			readerFrom
+		}{rw, hijacker{rw}, readerFrom{rw}}
+	case canFlush:
+		return struct {
+			*responseWriter
+			flusher
+		}{rw, flusher{rw}}
+	case canHijack:
+		return struct {
+			*responseWriter
+			hijacker
+		}{rw, hijacker{rw}}
+	case canReadFrom:
+		return struct {
+			*responseWriter
+			readerFrom
+		}{rw, readerFrom{rw}}
+	}
+	return rw
+}
+
+// headersSent reports whether w is known to have sent its headers already.
+func headersSent(w http.ResponseWriter) bool {
+	rw, ok := w.(interface{ headersSent() bool })
+	return ok && rw.headersSent()
+}
+
+// skipped reports if p matches any of the paths to skip.
+func (m *middleware) skipped(p string) bool {
+	for _, pattern := range m.skip {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// FromContext returns the session stored in ctx by Middleware. The boolean is
+// false if there is none, such as for requests to skipped paths.
+func FromContext(ctx context.Context) (*sessions.Session, bool) {
+	return FromContextKey(ctx, sessionKey)
+}
+
+// FromContextKey is like FromContext for sessions stored under the key given
+// to WithContextKey. Like WithContextKey it treats a nil key as the key
+// FromContext uses.
+func FromContextKey(ctx context.Context, key interface{}) (*sessions.Session, bool) {
+	if key == nil {
+		key = sessionKey
+	}
+	s, ok := ctx.Value(key).(*sessions.Session)
+	return s, ok
+}
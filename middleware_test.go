@@ -0,0 +1,223 @@
+package cqlstore
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareSkipPaths(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Save a session so requests have a cookie to load
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, err := store.New(r, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := sess.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	cookies := (&http.Response{Header: w.Header()}).Cookies()
+
+	var found bool
+	handler := store.Middleware("test-sess", WithSkipPaths("/favicon.ico", "/static/*"))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, found = FromContext(r.Context())
+		}),
+	)
+
+	tests := []struct {
+		path  string
+		found bool
+	}{
+		{"/favicon.ico", false},
+		{"/static/app.css", false},
+		{"/", true},
+	}
+
+	for _, test := range tests {
+		before := len(db.statements())
+
+		r, _ := http.NewRequest("GET", "http://www.example.com"+test.path, nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		queried := len(db.statements()) > before
+		if found != test.found || queried != test.found {
+			t.Errorf("%s: expected session %v and queries %v, got %v and %v",
+				test.path, test.found, test.found, found, queried)
+		}
+	}
+}
+
+type appContextKey string
+
+func TestMiddlewareContextKey(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := appContextKey("session")
+	var custom, standard bool
+	handler := store.Middleware("test-sess", WithContextKey(key))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, custom = FromContextKey(r.Context(), key)
+			_, standard = FromContext(r.Context())
+		}),
+	)
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if !custom {
+		t.Error("expected the session under the custom key")
+	}
+	if standard {
+		t.Error("expected no session under the default key")
+	}
+}
+
+func TestMiddlewareNilContextKey(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	handler := store.Middleware("test-sess", WithContextKey(nil))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, found = FromContext(r.Context())
+		}),
+	)
+
+	// context.WithValue panics on a nil key
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if !found {
+		t.Error("expected the session under the default key")
+	}
+}
+
+func TestSaveAfterHeadersSent(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var early, late error
+	handler := store.Middleware("test-sess")(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s, _ := FromContext(r.Context())
+			early = s.Save(r, w)
+			w.Write([]byte("hello"))
+			late = s.Save(r, w)
+		}),
+	)
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if early != nil {
+		t.Errorf("expected saving before writing to work, got %v", early)
+	}
+	if !errors.Is(late, ErrHeadersAlreadySent) {
+		t.Errorf("expected ErrHeadersAlreadySent, got %v", late)
+	}
+}
+
+// hijackingRecorder is a ResponseRecorder that can also be hijacked and read
+// from, like the ResponseWriter of net/http's server.
+type hijackingRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (hijackingRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("not supported")
+}
+
+func (r hijackingRecorder) ReadFrom(src io.Reader) (int64, error) {
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestMiddlewareKeepsWriterInterfaces(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                    string
+		w                       http.ResponseWriter
+		flush, hijack, readFrom bool
+	}{
+		{"recorder", httptest.NewRecorder(), true, false, false},
+		{"server", hijackingRecorder{httptest.NewRecorder()}, true, true, true},
+	}
+	for _, test := range tests {
+		var flush, hijack, readFrom bool
+		var saveErr error
+		handler := store.Middleware("test-sess")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, flush = w.(http.Flusher)
+			_, hijack = w.(http.Hijacker)
+			_, readFrom = w.(io.ReaderFrom)
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			s, _ := FromContext(r.Context())
+			saveErr = s.Save(r, w)
+		}))
+
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		handler.ServeHTTP(test.w, r)
+
+		if flush != test.flush || hijack != test.hijack || readFrom != test.readFrom {
+			t.Errorf("%s: expected Flusher %v, Hijacker %v and ReaderFrom %v, got %v, %v and %v",
+				test.name, test.flush, test.hijack, test.readFrom, flush, hijack, readFrom)
+		}
+		if !errors.Is(saveErr, ErrHeadersAlreadySent) {
+			t.Errorf("%s: expected saving after a flush to fail with ErrHeadersAlreadySent, got %v", test.name, saveErr)
+		}
+	}
+}
+
+func TestMiddlewareClearBadCookies(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...), WithClearBadCookies())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := store.Middleware("test-sess")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	r.AddCookie(&http.Cookie{Name: "test-sess", Value: "bogus"})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	cookies := (&http.Response{Header: w.Header()}).Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "test-sess" || cookies[0].Value != "" || cookies[0].MaxAge >= 0 {
+		t.Errorf("expected a cookie clearing test-sess, got %v", w.Header()["Set-Cookie"])
+	}
+
+	// Requests without a cookie are left alone
+	r, _ = http.NewRequest("GET", "http://www.example.com/", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if c := w.Header().Get("Set-Cookie"); c != "" {
+		t.Errorf("expected no cookie, got %q", c)
+	}
+}
@@ -0,0 +1,30 @@
+// Package msgpack provides a securecookie.Serializer using MessagePack, for use
+// with cqlstore.WithCodecSerializer. It is a separate package so only apps
+// that use it depend on the MessagePack library.
+//
+// MessagePack is usually smaller and faster than gob for the simple maps of
+// strings and numbers sessions tend to hold. Unlike gob it does not keep Go
+// types: numbers come back as the smallest type that fits them, such as int8,
+// and structs as maps, unless they are decoded into a value of the right
+// type.
+package msgpack
+
+import (
+	"github.com/gorilla/securecookie"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Serializer encodes values with MessagePack.
+type Serializer struct{}
+
+var _ securecookie.Serializer = Serializer{}
+
+// Serialize encodes src.
+func (Serializer) Serialize(src interface{}) ([]byte, error) {
+	return msgpack.Marshal(src)
+}
+
+// Deserialize decodes src into dst, which must be a pointer.
+func (Serializer) Deserialize(src []byte, dst interface{}) error {
+	return msgpack.Unmarshal(src, dst)
+}
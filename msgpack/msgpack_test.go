@@ -0,0 +1,77 @@
+package msgpack_test
+
+import (
+	"encoding/gob"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/jcbwlkr/cqlstore/msgpack"
+)
+
+var hashKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestRoundTrip(t *testing.T) {
+	codec := securecookie.New(hashKey, nil)
+	codec.SetSerializer(msgpack.Serializer{})
+
+	in := map[interface{}]interface{}{
+		"user":  "jerry",
+		"admin": true,
+		"tags":  []interface{}{"a", "b"},
+	}
+	encoded, err := codec.Encode("test-sess", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make(map[interface{}]interface{})
+	if err := codec.Decode("test-sess", encoded, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["user"] != "jerry" || out["admin"] != true {
+		t.Errorf("expected %v, got %v", in, out)
+	}
+	if tags, ok := out["tags"].([]interface{}); !ok || len(tags) != 2 || tags[0] != "a" || tags[1] != "b" {
+		t.Errorf("expected tags [a b], got %#v", out["tags"])
+	}
+}
+
+// values is a typical small session. JSON can not encode the
+// map[interface{}]interface{} of session Values so a map with string keys is
+// used to compare all three.
+var values = map[string]interface{}{
+	"user":      "jerry",
+	"admin":     false,
+	"csrf":      "k3WJ2i9xGq8vHzLrT0mPpA",
+	"cart":      []interface{}{"soup", "bread", "muffin tops"},
+	"lastVisit": "2015-06-01T12:00:00Z",
+}
+
+func init() {
+	// gob needs to know the concrete types held in interfaces
+	gob.Register([]interface{}{})
+}
+
+func benchmarkSerializer(b *testing.B, s securecookie.Serializer) {
+	data, err := s.Serialize(values)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		data, err := s.Serialize(values)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var out map[string]interface{}
+		if err := s.Deserialize(data, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(data)), "bytes")
+}
+
+func BenchmarkGob(b *testing.B)     { benchmarkSerializer(b, securecookie.GobEncoder{}) }
+func BenchmarkJSON(b *testing.B)    { benchmarkSerializer(b, securecookie.JSONEncoder{}) }
+func BenchmarkMsgpack(b *testing.B) { benchmarkSerializer(b, msgpack.Serializer{}) }
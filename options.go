@@ -0,0 +1,891 @@
+package cqlstore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/securecookie"
+)
+
+// Logger is used by the store to report problems that do not cause an
+// operation to fail. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Option configures optional behavior of a CQLStore. Options are passed to
+// NewWithOptions and are applied in order before any tables are created.
+type Option func(*CQLStore) error
+
+// validate checks that the Options applied to st make sense together.
+func (st *CQLStore) validate() error {
+	if st.maxPerUser > 0 && st.userKey == nil {
+		return errors.New("WithMaxSessionsPerUser requires WithUserIndex")
+	}
+	if st.globalMax > 0 && st.recentBuckets == 0 {
+		return errors.New("WithGlobalMaxSessions requires WithClusteringByUpdatedAt")
+	}
+	if st.minReplication > 0 && st.replicationKeyspace == "" {
+		return errors.New("WithRequireReplication requires WithReplicationCheck")
+	}
+	if st.fieldEncryption && st.binary {
+		return errors.New("WithFieldEncryption can not be used with WithBinaryData")
+	}
+	if st.hashedKey && (st.userKey != nil || st.recentBuckets > 0) {
+		return errors.New("WithHashedKey can not be used with WithUserIndex or WithClusteringByUpdatedAt")
+	}
+	if st.maxIdle > 0 && (st.browserTTL > 0 || st.recentBuckets > 0 || st.cache != nil || st.readOnly) {
+		return errors.New("WithMaxIdle can not be used with WithBrowserSessionCookie, " +
+			"WithClusteringByUpdatedAt, WithCache or WithReadOnlyStore")
+	}
+	if st.chunkSize > 0 && (st.fieldEncryption || st.maxIdle > 0) {
+		return errors.New("WithChunking can not be used with WithFieldEncryption or WithMaxIdle")
+	}
+	if st.rejectForeign && st.appTag == "" {
+		return errors.New("WithRejectForeignTags requires WithAppTag")
+	}
+	if st.inPlace && (st.cache != nil || st.changeDetection) {
+		return errors.New("WithInPlaceDecode can not be used with WithCache or WithChangeDetection")
+	}
+	return nil
+}
+
+// WithKeyPairs sets the authentication and/or encryption keys used for both
+// the cookie's session ID value and the values stored in the database. They
+// are interpreted the same way as securecookie.CodecsFromPairs except that
+// keys must always come in pairs of a hash key and a block key. Hash keys must
+// be 32 or 64 bytes long. Block keys must be 16, 24 or 32 bytes long to select
+// AES-128, AES-192 or AES-256, or nil to leave values unencrypted. Keys that
+// do not fit are rejected with ErrInvalidKey.
+func WithKeyPairs(keypairs ...[]byte) Option {
+	return func(st *CQLStore) error {
+		if err := validateKeyPairs(keypairs); err != nil {
+			return err
+		}
+		st.keyPairs = keypairs
+		st.Codecs = securecookie.CodecsFromPairs(keypairs...)
+		return nil
+	}
+}
+
+// WithPath sets the Path of session cookies, which defaults to "/", for apps
+// mounted under a sub-path. It must start with a slash and may not contain
+// semicolons or control characters.
+func WithPath(p string) Option {
+	return func(st *CQLStore) error {
+		if !strings.HasPrefix(p, "/") || strings.ContainsFunc(p, func(r rune) bool {
+			return r == ';' || r < 0x20 || r == 0x7f
+		}) {
+			return errors.New("Invalid cookie path " + strconv.Quote(p))
+		}
+		st.Options.Path = p
+		return nil
+	}
+}
+
+// WithSameSite sets the SameSite attribute of session cookies. Browsers only
+// accept SameSite=None cookies that are also Secure so http.SameSiteNoneMode
+// makes them Secure too. Sessions that end up with SameSite=None but not
+// Secure, for example because Options.Secure was turned off afterwards, fail
+// to save with ErrInsecureSameSiteNone instead of being silently dropped.
+func WithSameSite(mode http.SameSite) Option {
+	return func(st *CQLStore) error {
+		st.Options.SameSite = mode
+		if mode == http.SameSiteNoneMode {
+			st.Options.Secure = true
+		}
+		return nil
+	}
+}
+
+// WithPartitioned sets the Partitioned attribute of session cookies so
+// browsers that partition third-party cookies (CHIPS) keep them per top-level
+// site. Partitioned cookies must be Secure so it makes them Secure too.
+// Sessions whose cookies end up Partitioned but not Secure fail to save with
+// ErrInsecurePartitioned.
+func WithPartitioned() Option {
+	return func(st *CQLStore) error {
+		st.Options.Partitioned = true
+		st.Options.Secure = true
+		return nil
+	}
+}
+
+// WithClock replaces the function the store uses to tell the current time.
+// It defaults to time.Now and is mostly useful for tests.
+func WithClock(now func() time.Time) Option {
+	return func(st *CQLStore) error {
+		if now == nil {
+			return errors.New("Clock function must not be nil")
+		}
+		st.now = now
+		return nil
+	}
+}
+
+// WithClusteringByUpdatedAt maintains a second table, named after the
+// sessions table with a "_recent" suffix, that lists sessions in the order
+// they were last saved. It enables RecentSessions.
+//
+// The recent table is partitioned by a small number of buckets and clustered
+// by updated_at descending. A session is assigned to a bucket by hashing its
+// ID. Using few buckets keeps RecentSessions cheap since it reads the head of
+// every bucket and merges them, but every save in a bucket lands on the same
+// partition so a single bucket can become a hot spot on a busy site. More
+// buckets spread writes across the cluster at the cost of more reads per
+// RecentSessions call. Each save also rewrites the session's entry which
+// leaves a tombstone behind, so a partition accumulates tombstones as quickly
+// as sessions are saved. Keep gc_grace_seconds on the recent table low if
+// your sessions are saved frequently.
+//
+// Saving or deleting a session with this Option enabled costs one extra read
+// and two extra writes.
+func WithClusteringByUpdatedAt(buckets int) Option {
+	return func(st *CQLStore) error {
+		if buckets < 1 {
+			return errors.New("Recent session buckets must be at least 1")
+		}
+		st.recentBuckets = buckets
+		return nil
+	}
+}
+
+// MergeFunc combines the session values currently in the database with the
+// values about to be saved and returns the values that should be saved
+// instead.
+type MergeFunc func(stored, current map[interface{}]interface{}) map[interface{}]interface{}
+
+// WithMergeFunc makes Save reload a previously saved session's values and
+// merge them with the values being saved rather than overwriting them. This
+// is useful for additive data, like a shopping cart, which two concurrent
+// requests for the same user might both modify. Without it the last request
+// to save wins and the other request's changes are lost.
+//
+// The reload and the write are separate queries so a save that happens
+// between them can still be lost unless WithOptimisticLocking is also used.
+// In that case a save that loses the race merges again and retries a few
+// times before giving up with ErrConcurrentModification.
+func WithMergeFunc(fn MergeFunc) Option {
+	return func(st *CQLStore) error {
+		st.merge = fn
+		return nil
+	}
+}
+
+// WithOptimisticLocking adds a version column to the sessions table which is
+// loaded with each session and checked when it is saved. If the session was
+// saved by another request since it was loaded then Save returns an error
+// wrapping ErrConcurrentModification instead of overwriting the other
+// request's changes. Callers can then load the session again and retry.
+//
+// Saves use lightweight transactions which are considerably slower than
+// plain writes.
+func WithOptimisticLocking() Option {
+	return func(st *CQLStore) error {
+		st.locking = true
+		return nil
+	}
+}
+
+// WithDefaultValues seeds the Values of every brand new session with a copy
+// of values. Sessions loaded from the database are left as they were saved.
+// The copy is shallow so values should not be modified after they are passed
+// in.
+func WithDefaultValues(values map[interface{}]interface{}) Option {
+	return func(st *CQLStore) error {
+		st.defaults = values
+		return nil
+	}
+}
+
+// WithExpireDelete changes how sessions are deleted. Rather than issuing a
+// DELETE, which leaves a tombstone behind that slows down reads until it is
+// compacted away, the session's row is rewritten with a time to live of one
+// second and left to expire. For up to a second after it is deleted the row
+// is still in the table but the store treats it as if it were gone. Sessions
+// stored with WithFieldEncryption or WithChunking are still deleted with a
+// DELETE since their values are in a collection column, which can not be
+// rewritten without leaving a tombstone either.
+func WithExpireDelete() Option {
+	return func(st *CQLStore) error {
+		st.expireDelete = true
+		return nil
+	}
+}
+
+// WithBinaryData stores session data in a blob column instead of text.
+// securecookie always produces base64 text which is decoded before it is
+// written and encoded again when it is read, so rows take about a quarter less
+// space. The column type is only chosen when the table is created so this
+// cannot be switched on for an existing table.
+func WithBinaryData() Option {
+	return func(st *CQLStore) error {
+		st.binary = true
+		return nil
+	}
+}
+
+// WithUserIndex maintains a second table, named after the sessions table with
+// a "_by_user" suffix, that lists the sessions of each user. A session belongs
+// to the user identified by the value stored in its Values under key.
+// Sessions without that value are not indexed. The index entry is removed
+// when the session is deleted but if a session switches users its entry for
+// the previous user remains until it expires.
+func WithUserIndex(key interface{}) Option {
+	return func(st *CQLStore) error {
+		if key == nil {
+			return errors.New("User index key must not be nil")
+		}
+		st.userKey = key
+		return nil
+	}
+}
+
+// WithMaxSessionsPerUser limits each user to n sessions. When a save gives a
+// user more than n sessions the ones that were saved least recently are
+// deleted like a Save with a negative MaxAge would, so AfterDelete is called
+// and Stats counts them. It requires WithUserIndex.
+func WithMaxSessionsPerUser(n int) Option {
+	return func(st *CQLStore) error {
+		if n < 1 {
+			return errors.New("Max sessions per user must be at least 1")
+		}
+		st.maxPerUser = n
+		return nil
+	}
+}
+
+// WithGlobalMaxSessions limits the table to about n sessions. The store keeps
+// a count of the sessions in the table of WithClusteringByUpdatedAt, which it
+// requires, counting them again at most once a minute. When a new session
+// takes the count past n the sessions saved least recently are deleted like
+// a Save with a negative MaxAge would, so AfterDelete is called and Stats
+// counts them.
+//
+// The limit is approximate. Sessions created, deleted or expired by other
+// stores are only seen when the sessions are counted again, so the table can
+// hold more than n sessions for a while, and stores sharing a table may evict
+// more than needed. Saving an existing session never evicts anything. Failing
+// to evict is logged but does not fail the save.
+func WithGlobalMaxSessions(n int) Option {
+	return func(st *CQLStore) error {
+		if n < 1 {
+			return errors.New("Global max sessions must be at least 1")
+		}
+		st.globalMax = n
+		return nil
+	}
+}
+
+// WithTenant isolates the sessions of tenants sharing one table. The tenant
+// of each request is found with the given function and stored with its
+// session. Loading a session for a request from a different tenant fails with
+// ErrTenantMismatch and returns a fresh session, so a cookie issued by one
+// tenant can never be used to read or overwrite another tenant's session.
+func WithTenant(tenant func(*http.Request) string) Option {
+	return func(st *CQLStore) error {
+		if tenant == nil {
+			return errors.New("Tenant function must not be nil")
+		}
+		st.tenant = tenant
+		return nil
+	}
+}
+
+// WithAppTag stores tag, such as the name and version of the app, with every
+// session the store saves. This shows which app wrote a row when several share
+// a table, for example during a rolling deploy. See WithRejectForeignTags.
+func WithAppTag(tag string) Option {
+	return func(st *CQLStore) error {
+		if tag == "" {
+			return errors.New("App tag must not be empty")
+		}
+		st.appTag = tag
+		return nil
+	}
+}
+
+// WithRejectForeignTags makes loading a session saved with a different
+// WithAppTag, or without one, fail with ErrAppTagMismatch and return a fresh
+// session, so apps that can not read each other's sessions can share a table.
+func WithRejectForeignTags() Option {
+	return func(st *CQLStore) error {
+		st.rejectForeign = true
+		return nil
+	}
+}
+
+// WithChangeDetection keeps a copy of the stored data of each session it loads
+// or saves in the session's Values, under a key that is never saved, so
+// SaveIfChanged can tell whether the session was modified.
+func WithChangeDetection() Option {
+	return func(st *CQLStore) error {
+		st.changeDetection = true
+		return nil
+	}
+}
+
+// WithInPlaceDecode makes New read the stored data of each session into a
+// buffer that is reused between loads and decode it from there, instead of
+// copying it into a new string first. For large sessions this saves
+// allocating a copy of the data on every load. It can not be used with
+// WithCache or WithChangeDetection since both keep the loaded data around.
+func WithInPlaceDecode() Option {
+	return func(st *CQLStore) error {
+		st.inPlace = true
+		return nil
+	}
+}
+
+// WithLegacyCookieImport helps migrating from gorilla's CookieStore, or another
+// store keeping the values in the cookie itself. When a session cookie is not
+// a session ID cookie but can be decoded into session values by codecs, New
+// returns a new session holding those values. Saving it imports the values
+// into the database and replaces the old cookie with a session ID cookie.
+func WithLegacyCookieImport(codecs ...securecookie.Codec) Option {
+	return func(st *CQLStore) error {
+		if len(codecs) == 0 {
+			return errors.New("At least one legacy codec is required")
+		}
+		st.legacyCodecs = codecs
+		return nil
+	}
+}
+
+// WithChunking splits stored session data larger than maxCellBytes into chunks
+// of at most that size, kept in a chunks column, and joins them again when the
+// session is loaded. It is meant for the rare app whose sessions are too large
+// to store comfortably in a single cell. Sessions that large are usually
+// better off keeping most of their data elsewhere. Securecookie also limits
+// how large encoded values can be, see MaxLength.
+func WithChunking(maxCellBytes int) Option {
+	return func(st *CQLStore) error {
+		if maxCellBytes <= 0 {
+			return errors.New("Chunk size must be positive")
+		}
+		st.chunkSize = maxCellBytes
+		return nil
+	}
+}
+
+// WithValuesValidator makes Save call validate with the values of each session
+// right before they are encoded, after BeforeSave and any WithMergeFunc. If it
+// returns an error nothing is saved and Save fails with ErrValidation. Use it
+// to catch values that should never be stored, such as types that do not
+// survive encoding. The values must not be modified.
+func WithValuesValidator(validate func(map[interface{}]interface{}) error) Option {
+	return func(st *CQLStore) error {
+		if validate == nil {
+			return errors.New("Values validator must not be nil")
+		}
+		st.validator = validate
+		return nil
+	}
+}
+
+// WithSessionName sets the session name used by Session so apps with a single
+// session do not have to repeat it on every call.
+func WithSessionName(name string) Option {
+	return func(st *CQLStore) error {
+		if name == "" {
+			return errors.New("Session name must not be empty")
+		}
+		st.sessionName = name
+		return nil
+	}
+}
+
+// WithAbsoluteTimeout limits how long a session can live regardless of how
+// recently it was used. The time each session is first saved is stored in a
+// created_at column and once d has passed New fails with ErrSessionExpired
+// and returns a fresh session. Sessions are otherwise expired by their row's
+// time to live which is renewed on every save.
+func WithAbsoluteTimeout(d time.Duration) Option {
+	return func(st *CQLStore) error {
+		if d <= 0 {
+			return errors.New("Absolute timeout must be positive")
+		}
+		st.absoluteTimeout = d
+		return nil
+	}
+}
+
+// WithMaxIdle expires sessions d after they were last loaded or saved, instead
+// of only saved. Every time New loads a session its row is written again with
+// a time to live of d and the current time in a last_accessed column. That is
+// a write for every read, and with WithOptimisticLocking it also changes the
+// row's version, so other requests that loaded the session earlier fail to
+// save it with ErrConcurrentModification. Without locking a save racing with
+// a load can be undone. The cookie and stored data still expire MaxAge after
+// the session was last saved so MaxAge should be longer than d. Combine it
+// with WithAbsoluteTimeout to also limit how long a session can be used.
+func WithMaxIdle(d time.Duration) Option {
+	return func(st *CQLStore) error {
+		if d < time.Second {
+			return errors.New("Max idle time must be at least a second")
+		}
+		st.maxIdle = int(d / time.Second)
+		return nil
+	}
+}
+
+// WithMinReissueAge limits how long a session cookie can be replayed. The time
+// a cookie was issued is encoded in it along with the session ID, and the
+// first Save of a session whose cookie was issued d or longer ago moves the
+// session to a new ID, deletes the row under the old one and issues a new
+// cookie. A stolen cookie then stops working once its owner's session has
+// been reissued. Cookies issued without the option count as infinitely old,
+// and cookies issued with it can not be read by stores without it.
+func WithMinReissueAge(d time.Duration) Option {
+	return func(st *CQLStore) error {
+		if d < time.Second {
+			return errors.New("Min reissue age must be at least a second")
+		}
+		st.reissueAge = d
+		return nil
+	}
+}
+
+// WithSyncMaxAgeFromTTL sets the MaxAge of each loaded session to the time its
+// row has left to live. Without it a session cookie saved again gets the full
+// MaxAge even though the row it points to may expire sooner. Rows saved
+// without a time to live leave MaxAge alone.
+func WithSyncMaxAgeFromTTL() Option {
+	return func(st *CQLStore) error {
+		st.syncMaxAge = true
+		return nil
+	}
+}
+
+// WithSignOnly makes the session ID cookie authenticated but not encrypted by
+// ignoring the encryption keys given to WithKeyPairs when encoding it. Session
+// IDs are random so hiding them gains little, and skipping encryption makes
+// the cookie smaller and cheaper to handle. Tampering with the cookie is still
+// detected. This only applies to the cookie; session data stored in the
+// database is still encrypted with the store's Codecs.
+func WithSignOnly() Option {
+	return func(st *CQLStore) error {
+		st.signOnly = true
+		return nil
+	}
+}
+
+// WithNameInKey adds the session name to the primary key of the sessions
+// table so sessions with different names are stored separately even if they
+// have the same ID. The table is still partitioned by ID alone, with the name
+// as a clustering column, so operations that only know a session's ID, like
+// ExportSession, act on the first or every name using that ID.
+func WithNameInKey() Option {
+	return func(st *CQLStore) error {
+		st.nameInKey = true
+		return nil
+	}
+}
+
+// WithIDGenerator replaces the function used to generate the IDs of new
+// sessions. IDs must be valid UUIDs since that is the type of the id column,
+// unless WithTextID is used. The default generates time based UUIDs.
+func WithIDGenerator(generate func() string) Option {
+	return func(st *CQLStore) error {
+		if generate == nil {
+			return errors.New("ID generator must not be nil")
+		}
+		st.idGenerator = generate
+		return nil
+	}
+}
+
+// WithDeterministic is for tests. It stops the store's clock at midnight on
+// January 1st 2000 UTC and makes session IDs random UUIDs from a pseudo random
+// generator seeded with seed, so stores given the same seed make the same
+// IDs in the same order and golden values can be compared. The IDs are easy
+// to guess so never use it in production.
+func WithDeterministic(seed int64) Option {
+	return func(st *CQLStore) error {
+		st.now = func() time.Time { return deterministicTime }
+		st.idGenerator = seededUUIDs(seed)
+		return nil
+	}
+}
+
+// WithTextID makes the id columns of the store's tables text instead of uuid
+// so IDs do not have to be UUIDs. Use it with WithIDGenerator, for example with
+// Base62ID. The column type is fixed when the table is created so an existing
+// table has to be migrated, see Migrate.
+func WithTextID() Option {
+	return func(st *CQLStore) error {
+		st.textID = true
+		return nil
+	}
+}
+
+// WithBaseContext runs every query of the store with ctx so cancelling it, for
+// example when a background worker shuts down, makes queries in flight and any
+// later operations fail with ctx's error. Queries of NewContext and SaveContext
+// also stop at the context they are given.
+func WithBaseContext(ctx context.Context) Option {
+	return func(st *CQLStore) error {
+		if ctx == nil {
+			return errors.New("Base context must not be nil")
+		}
+		st.baseCtx = ctx
+		return nil
+	}
+}
+
+// WithConsistencyDowngrade runs single row reads, like loading a session, at
+// consistency from. If not enough replicas are available, or they time out,
+// the read is retried once at the weaker consistency to. This keeps sessions
+// loading in a degraded cluster at the risk of reading stale data: a session
+// saved at a strong consistency may not have reached the replica answering the
+// retry, so an older version of it, or none at all, can be loaded. Saves are
+// not affected.
+func WithConsistencyDowngrade(from, to gocql.Consistency) Option {
+	return func(st *CQLStore) error {
+		if from == to {
+			return errors.New("Consistency downgrade must be to a different consistency")
+		}
+		st.downgrade = true
+		st.downgradeFrom = from
+		st.downgradeTo = to
+		return nil
+	}
+}
+
+// WithLogger sets where the store logs. It defaults to a logger writing to
+// standard error.
+func WithLogger(l Logger) Option {
+	return func(st *CQLStore) error {
+		if l == nil {
+			return errors.New("Logger must not be nil")
+		}
+		st.logger = l
+		return nil
+	}
+}
+
+// WithSlowQueryThreshold logs every query the store runs that takes longer
+// than d along with the store's table and the kind of statement.
+func WithSlowQueryThreshold(d time.Duration) Option {
+	return func(st *CQLStore) error {
+		if d <= 0 {
+			return errors.New("Slow query threshold must be positive")
+		}
+		st.slowQuery = d
+		return nil
+	}
+}
+
+// WithCircuitBreaker stops the store from querying the database after
+// failures queries in a row have failed. For the next cooldown every query
+// fails immediately with ErrCircuitOpen so requests are not slowed down
+// waiting on a database that is down. After the cooldown a single query is let
+// through to probe the database. If it succeeds queries resume as normal,
+// otherwise the breaker stays open for another cooldown. The cooldown is
+// measured with the wall clock, not the one set with WithClock. Queries
+// cancelled or timed out by their context and gocql.ErrNotFound are not
+// counted as failures.
+func WithCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(st *CQLStore) error {
+		if failures < 1 {
+			return errors.New("Circuit breaker failures must be at least 1")
+		}
+		if cooldown <= 0 {
+			return errors.New("Circuit breaker cooldown must be positive")
+		}
+		st.breaker = &breaker{failures: failures, cooldown: cooldown, now: time.Now}
+		return nil
+	}
+}
+
+// WithQueryTag starts every statement the store runs with a comment holding
+// tag, like /* app=foo */, so the store's queries can be picked out of audit
+// logs and traces. The tag may not contain "*/".
+func WithQueryTag(tag string) Option {
+	return func(st *CQLStore) error {
+		if tag == "" || strings.Contains(tag, "*/") {
+			return errors.New("Invalid query tag " + tag)
+		}
+		st.queryTag = tag
+		return nil
+	}
+}
+
+// WithCodecMaxAge sets how old the timestamps securecookie adds to cookies and
+// stored data may be before they are rejected. By default it follows the
+// longest MaxAge of the store's Options and those given to SetOptions,
+// including later changes, so values never expire before the session does.
+func WithCodecMaxAge(d time.Duration) Option {
+	return func(st *CQLStore) error {
+		if d < time.Second {
+			return errors.New("Codec max age must be at least a second")
+		}
+		st.codecMaxAge = int(d / time.Second)
+		return nil
+	}
+}
+
+// WithCodecSerializer sets how the codecs built from the keys given to
+// WithKeyPairs serialize values before they are encrypted and authenticated.
+// securecookie uses gob by default. The serializer must be able to handle the
+// map[interface{}]interface{} of session Values, which securecookie's
+// JSONEncoder can not, so use JSONSerializer for JSON. See the msgpack
+// subpackage for a smaller and faster alternative to gob.
+//
+// Cookies and sessions written with one serializer can not be read with
+// another. Switching serializers on a running site logs everyone out and
+// their old cookies fail to load, so do it together with a key rotation or
+// when losing sessions is acceptable.
+func WithCodecSerializer(s securecookie.Serializer) Option {
+	return func(st *CQLStore) error {
+		if s == nil {
+			return errors.New("Codec serializer must not be nil")
+		}
+		st.serializer = s
+		return nil
+	}
+}
+
+// WithCompressionThreshold compresses everything the store's Codecs serialize
+// with DEFLATE once it is over the given number of bytes, before it is
+// encrypted. Smaller values are stored as they are since compressing them
+// costs CPU and often makes them larger. A marker byte in front of each value
+// tells whether it was compressed. It works with any serializer set with
+// WithCodecSerializer, but sessions and cookies written without the option
+// can not be read with it and the other way around.
+func WithCompressionThreshold(bytes int) Option {
+	return func(st *CQLStore) error {
+		if bytes < 1 {
+			return errors.New("Compression threshold must be positive")
+		}
+		st.compressAbove = bytes
+		return nil
+	}
+}
+
+// WithBatchType sets the type of the batches SaveBatch and DeleteBatch send.
+// Every session lives in its own partition so the default,
+// gocql.UnloggedBatch, is the fastest. gocql.LoggedBatch makes Cassandra
+// apply the whole batch or none of it at the cost of writing it to the batch
+// log first. With unlogged batches SaveBatch writes each session on its own
+// instead so it can tell which were saved.
+func WithBatchType(typ gocql.BatchType) Option {
+	return func(st *CQLStore) error {
+		if typ != gocql.LoggedBatch && typ != gocql.UnloggedBatch {
+			return errors.New("Batch type must be logged or unlogged")
+		}
+		st.batchType = typ
+		return nil
+	}
+}
+
+// WithAutoMigrate makes New add the columns the store's Options need to a
+// sessions table created before they were used, for example by an older
+// version or without WithAbsoluteTimeout. CREATE TABLE IF NOT EXISTS leaves an
+// existing table alone so without it saves fail on the missing columns. Each
+// column is added with ALTER TABLE, which is skipped for columns that already
+// exist. Columns are never changed or dropped.
+func WithAutoMigrate() Option {
+	return func(st *CQLStore) error {
+		st.autoMigrate = true
+		return nil
+	}
+}
+
+// WithTableComment sets the comment of the sessions table when New creates
+// it, for example to tell DBAs which app it belongs to. The comment is quoted
+// so it may contain any text. Tables that already exist are not changed.
+func WithTableComment(comment string) Option {
+	return func(st *CQLStore) error {
+		st.tableComment = comment
+		return nil
+	}
+}
+
+// WithTableProperties adds properties to the WITH clause used when New
+// creates the sessions table, such as gc_grace_seconds or compaction. Values
+// are CQL literals: numbers, quoted strings or maps of them, for example
+//
+//	map[string]string{
+//		"gc_grace_seconds": "3600",
+//		"compaction":       "{'class': 'LeveledCompactionStrategy'}",
+//	}
+//
+// Only well known property names and values of that shape are accepted so the
+// statement can not be tampered with. Tables that already exist are not
+// changed. Use WithTableComment for the comment.
+func WithTableProperties(props map[string]string) Option {
+	return func(st *CQLStore) error {
+		for name, value := range props {
+			if !tableProperties[name] {
+				return errors.New("Unsupported table property " + name)
+			}
+			if !propertyValue.MatchString(value) {
+				return errors.New("Invalid value for table property " + name)
+			}
+		}
+		st.tableProps = props
+		return nil
+	}
+}
+
+// WithClearBadCookies makes Middleware delete session cookies that can not be
+// decoded, because they were tampered with or made with keys that were
+// rotated out, so the browser stops sending them. Handlers not using
+// Middleware can call ClearBadCookie themselves.
+func WithClearBadCookies() Option {
+	return func(st *CQLStore) error {
+		st.clearBad = true
+		return nil
+	}
+}
+
+// WithErrorContextKeys sets the context keys whose values NewContext and
+// SaveContext attach to the errors they return, for example the key a
+// middleware stores the request ID under.
+func WithErrorContextKeys(keys ...interface{}) Option {
+	return func(st *CQLStore) error {
+		for _, k := range keys {
+			if k == nil {
+				return errors.New("Error context keys must not be nil")
+			}
+		}
+		st.errorKeys = keys
+		return nil
+	}
+}
+
+// WithReadOnlyStore makes a store that only reads sessions, for example from a
+// read replica or with a role that can not write. The store does not try to
+// create its tables, which must already exist, and Save and everything else
+// that would write to the database fails with ErrReadOnly.
+func WithReadOnlyStore() Option {
+	return func(st *CQLStore) error {
+		st.readOnly = true
+		return nil
+	}
+}
+
+// WithBrowserSessionCookie sends session cookies without Max-Age or Expires so
+// browsers forget them when they are closed. The MaxAge of the store's and
+// sessions' Options is then only used to delete sessions, with a negative
+// value, and rows instead expire ttl after they were last saved. This keeps
+// abandoned sessions from living forever in the database.
+func WithBrowserSessionCookie(ttl time.Duration) Option {
+	return func(st *CQLStore) error {
+		if ttl < time.Second {
+			return errors.New("Browser session TTL must be at least a second")
+		}
+		st.browserTTL = int(ttl / time.Second)
+		return nil
+	}
+}
+
+// WithExpires computes the Expires attribute of session cookies from the
+// store's clock, see WithClock, so it always matches Max-Age for user agents
+// that ignore Max-Age and only honor Expires.
+func WithExpires() Option {
+	return func(st *CQLStore) error {
+		st.expires = true
+		return nil
+	}
+}
+
+// WithCache keeps up to size recently loaded sessions in memory so loading
+// them again skips the database. Saving or deleting a session through this
+// store removes it from the cache but changes made by other stores, such as
+// those on other servers, are not seen until the cached copy is ttl old. Keep
+// ttl short, since a session deleted on another server can still be loaded
+// here until then. CacheStats reports how effective the cache is.
+func WithCache(size int, ttl time.Duration) Option {
+	return func(st *CQLStore) error {
+		if size < 1 {
+			return errors.New("Cache size must be at least 1")
+		}
+		if ttl <= 0 {
+			return errors.New("Cache TTL must be positive")
+		}
+		st.cache = newCache(size, ttl)
+		return nil
+	}
+}
+
+// WithHashedKey stores a hash of each session's ID in the id column instead of
+// the ID itself. The cookie still carries the real ID which is hashed again to
+// find the session's row, so someone who gets hold of the database's contents
+// can not use them to hijack sessions. The hash is turned into a UUID to fit
+// the id column. Since the index tables list real session IDs this can not be
+// combined with WithUserIndex or WithClusteringByUpdatedAt.
+func WithHashedKey() Option {
+	return func(st *CQLStore) error {
+		st.hashedKey = true
+		return nil
+	}
+}
+
+// WithMaxAgeCeiling sets the longest a session may live. Sessions saved with
+// a larger MaxAge have it lowered to d, with a warning logged, and their rows
+// expire after d. It defaults to 20 years, the longest time to live Cassandra
+// accepts, so an absurd MaxAge does not make saves fail.
+func WithMaxAgeCeiling(d time.Duration) Option {
+	return func(st *CQLStore) error {
+		if d < time.Second || d > maxTTL*time.Second {
+			return errors.New("Max age ceiling must be between a second and 20 years")
+		}
+		st.maxAgeCeiling = int(d / time.Second)
+		return nil
+	}
+}
+
+// WithReplicationCheck makes New look up the replication of keyspace, which
+// should be the keyspace holding the sessions table, and log a warning if it
+// keeps only a single copy of each session. Losing one node then loses its
+// share of the sessions.
+func WithReplicationCheck(keyspace string) Option {
+	return func(st *CQLStore) error {
+		if !validName.MatchString(keyspace) {
+			return errors.New("Invalid keyspace name " + keyspace)
+		}
+		st.replicationKeyspace = keyspace
+		return nil
+	}
+}
+
+// WithRequireReplication makes New fail if the keyspace given to
+// WithReplicationCheck has a replication factor below min in any data center.
+func WithRequireReplication(min int) Option {
+	return func(st *CQLStore) error {
+		if min < 1 {
+			return errors.New("Required replication must be at least 1")
+		}
+		st.minReplication = min
+		return nil
+	}
+}
+
+// WithFieldEncryption stores each session value separately in a fields column
+// of type map<text, blob> instead of encoding them together in the data
+// column. Every value is encrypted on its own with the store's Codecs except
+// those under the plaintext keys which are stored as raw text so other tools
+// can read them directly, for example with blobAsText(fields['theme']).
+//
+// Session Values may then only have string keys and the values of plaintext
+// keys must be strings. Anyone with access to the database can read plaintext
+// values so never use them for anything sensitive. The column is only added
+// when the table is created. ExportSession and ImportSession are not
+// supported and it can not be combined with WithBinaryData.
+func WithFieldEncryption(plaintext ...string) Option {
+	return func(st *CQLStore) error {
+		st.fieldEncryption = true
+		st.plainFields = make(map[string]bool, len(plaintext))
+		for _, key := range plaintext {
+			st.plainFields[key] = true
+		}
+		return nil
+	}
+}
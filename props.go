@@ -0,0 +1,41 @@
+package cqlstore
+
+import (
+	"regexp"
+	"sort"
+)
+
+// tableProperties are the table properties WithTableProperties may set.
+var tableProperties = map[string]bool{
+	"bloom_filter_fp_chance":      true,
+	"caching":                     true,
+	"compaction":                  true,
+	"compression":                 true,
+	"crc_check_chance":            true,
+	"default_time_to_live":        true,
+	"gc_grace_seconds":            true,
+	"max_index_interval":          true,
+	"memtable_flush_period_in_ms": true,
+	"min_index_interval":          true,
+	"speculative_retry":           true,
+}
+
+// propertyValue matches the values WithTableProperties accepts: a number, a
+// string literal or a map of string literals to string literals or numbers.
+var propertyValue = regexp.MustCompile(`^(?:` + propertyLiteral + `|\{\s*` + propertyEntry + `(?:\s*,\s*` +
+	propertyEntry + `)*\s*\})$`)
+
+const (
+	propertyLiteral = `-?[0-9]+(?:\.[0-9]+)?|'(?:[^']|'')*'`
+	propertyEntry   = `'(?:[^']|'')*'\s*:\s*(?:` + propertyLiteral + `)`
+)
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
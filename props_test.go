@@ -0,0 +1,45 @@
+package cqlstore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTableComment(t *testing.T) {
+	ddl, err := SchemaDDL("sessions", WithKeyPairs(testKeys...), WithTableComment("app's sessions'; DROP TABLE x; --"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `) WITH comment = 'app''s sessions''; DROP TABLE x; --';`; !strings.Contains(ddl, want) {
+		t.Errorf("expected the DDL to contain %q, got %q", want, ddl)
+	}
+}
+
+func TestTableProperties(t *testing.T) {
+	ddl, err := SchemaDDL("sessions",
+		WithKeyPairs(testKeys...),
+		WithTableComment("sessions"),
+		WithTableProperties(map[string]string{
+			"gc_grace_seconds": "3600",
+			"compaction":       "{'class': 'TimeWindowCompactionStrategy', 'compaction_window_size': 1}",
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `) WITH comment = 'sessions' AND compaction = {'class': 'TimeWindowCompactionStrategy', ` +
+		`'compaction_window_size': 1} AND gc_grace_seconds = 3600;`
+	if !strings.Contains(ddl, want) {
+		t.Errorf("expected the DDL to contain %q, got %q", want, ddl)
+	}
+
+	for _, props := range []map[string]string{
+		{"id": "1"},
+		{"gc_grace_seconds": "1; DROP TABLE x"},
+		{"compaction": "{'class': 'x'} AND comment = 'y'"},
+	} {
+		if _, err := SchemaDDL("sessions", WithKeyPairs(testKeys...), WithTableProperties(props)); err == nil {
+			t.Errorf("expected %v to be rejected", props)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package cqlstore
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// RecentSession identifies a session and the time it was last saved.
+type RecentSession struct {
+	ID        string
+	UpdatedAt time.Time
+}
+
+// RecentSessions returns up to limit of the most recently saved sessions,
+// newest first. A limit of 0 returns no sessions without querying the
+// database and a negative limit is an error. The store must have been created
+// with the WithClusteringByUpdatedAt Option.
+func (st *CQLStore) RecentSessions(limit int) ([]RecentSession, error) {
+	if st.recentBuckets == 0 {
+		return nil, errors.New("RecentSessions requires the WithClusteringByUpdatedAt option")
+	}
+	if limit < 0 {
+		return nil, errors.New("RecentSessions limit must not be negative")
+	}
+	if limit == 0 {
+		// Cassandra rejects LIMIT 0
+		return nil, nil
+	}
+
+	var recent []RecentSession
+	for b := 0; b < st.recentBuckets; b++ {
+		iter := st.query(st.queryContext(), `SELECT "id", "updated_at" FROM "`+st.recentTable()+`" WHERE "bucket" = ? LIMIT ?`,
+			b, limit).Iter()
+
+		var rs RecentSession
+		for iter.Scan(&rs.ID, &rs.UpdatedAt) {
+			recent = append(recent, rs)
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Sort(byUpdatedAt(recent))
+	if len(recent) > limit {
+		recent = recent[:limit]
+	}
+
+	return recent, nil
+}
+
+type byUpdatedAt []RecentSession
+
+func (r byUpdatedAt) Len() int           { return len(r) }
+func (r byUpdatedAt) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byUpdatedAt) Less(i, j int) bool { return r[i].UpdatedAt.After(r[j].UpdatedAt) }
+
+// recentTable is the name of the table maintained by WithClusteringByUpdatedAt.
+func (st *CQLStore) recentTable() string {
+	return st.table + "_recent"
+}
+
+// recentBucket picks the partition of the recent table id belongs to.
+func (st *CQLStore) recentBucket(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(st.recentBuckets))
+}
+
+// updatedAt reads the last saved time of the session id with the given name.
+// It returns the zero time if the session does not exist.
+func (st *CQLStore) updatedAt(ctx context.Context, id, name string) (time.Time, error) {
+	var t time.Time
+	where, args := st.where(id, name)
+	err := st.rowQuery(ctx, id, `SELECT "updated_at" FROM "`+st.table+`" WHERE `+where, args...).Scan(&t)
+	if err == gocql.ErrNotFound {
+		return time.Time{}, nil
+	}
+	return t, err
+}
+
+// touchRecent moves the entry for id in the recent table from prev to now and
+// gives it the time to live ttl. Either time may be zero to only remove or
+// only add an entry.
+func (st *CQLStore) touchRecent(ctx context.Context, id string, prev, now time.Time, ttl int) error {
+	bucket := st.recentBucket(id)
+
+	if !prev.IsZero() {
+		var err error
+		if st.expireDelete {
+			err = st.query(ctx, `INSERT INTO "`+st.recentTable()+`" ("bucket", "updated_at", "id") VALUES(?, ?, ?) USING TTL 1`,
+				bucket, prev, id).Exec()
+		} else {
+			err = st.query(ctx, `DELETE FROM "`+st.recentTable()+`" WHERE "bucket" = ? AND "updated_at" = ? AND "id" = ?`,
+				bucket, prev, id).Exec()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if now.IsZero() {
+		return nil
+	}
+
+	return st.query(ctx, `INSERT INTO "`+st.recentTable()+`" ("bucket", "updated_at", "id") VALUES(?, ?, ?) USING TTL ?`,
+		bucket, now, id, ttl).Exec()
+}
+
+// globalRecount is how often evictOverGlobalMax counts the sessions again to
+// pick up ones created, deleted or expired outside of this store.
+const globalRecount = time.Minute
+
+// globalCount is the number of sessions WithGlobalMaxSessions believes the
+// table holds, so creating a session does not have to count them.
+type globalCount struct {
+	mu      sync.Mutex
+	n       int
+	counted time.Time
+}
+
+// evictOverGlobalMax counts a newly created session and deletes the sessions
+// saved least recently once there are more than WithGlobalMaxSessions. The
+// recent table is only counted every globalRecount and only the sessions to
+// evict are read.
+func (st *CQLStore) evictOverGlobalMax(ctx context.Context) error {
+	st.global.mu.Lock()
+	defer st.global.mu.Unlock()
+
+	if time.Since(st.global.counted) < globalRecount {
+		st.global.n++
+	} else {
+		n := 0
+		for b := 0; b < st.recentBuckets; b++ {
+			var c int
+			err := st.query(ctx, `SELECT COUNT(*) FROM "`+st.recentTable()+`" WHERE "bucket" = ?`, b).Scan(&c)
+			if err != nil {
+				return err
+			}
+			n += c
+		}
+		st.global.n = n
+		st.global.counted = time.Now()
+	}
+
+	excess := st.global.n - st.globalMax
+	if excess <= 0 {
+		return nil
+	}
+
+	// The oldest sessions overall are among the oldest excess of each bucket
+	var old []RecentSession
+	for b := 0; b < st.recentBuckets; b++ {
+		iter := st.query(ctx, `SELECT "id", "updated_at" FROM "`+st.recentTable()+`" WHERE "bucket" = ? ORDER BY "updated_at" ASC, "id" DESC LIMIT ?`,
+			b, excess).Iter()
+		var rs RecentSession
+		for iter.Scan(&rs.ID, &rs.UpdatedAt) {
+			old = append(old, rs)
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+
+	sort.Sort(sort.Reverse(byUpdatedAt(old)))
+	if len(old) > excess {
+		old = old[:excess]
+	}
+	for _, rs := range old {
+		if err := st.evict(ctx, rs.ID, ""); err != nil {
+			return err
+		}
+		st.global.n--
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package cqlstore
+
+import "testing"
+
+func TestRecentSessionsLimit(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "sessions", WithKeyPairs(testKeys...), WithClusteringByUpdatedAt(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(db.statements())
+
+	if _, err := store.RecentSessions(-1); err == nil {
+		t.Error("expected a negative limit to be an error")
+	}
+
+	recent, err := store.RecentSessions(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 0 {
+		t.Errorf("expected a limit of 0 to return no sessions, got %v", recent)
+	}
+	if after := len(db.statements()); after != before {
+		t.Errorf("expected no queries for a limit of 0, got %d", after-before)
+	}
+}
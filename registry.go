@@ -0,0 +1,51 @@
+package cqlstore
+
+import (
+	"sort"
+	"sync"
+)
+
+// registry remembers every table created by a store in this process.
+var registry = struct {
+	sync.Mutex
+	tables map[string]bool
+}{tables: make(map[string]bool)}
+
+// register adds the tables used by st to the registry.
+func register(st *CQLStore) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	for _, t := range st.tables() {
+		registry.tables[t] = true
+	}
+}
+
+// RegisteredTables returns the names of every table, including companion
+// tables like the one kept by WithUserIndex, that stores created in this
+// process manage. It is useful for admin dashboards and cleanup scripts.
+// Tables in different keyspaces with the same name are only listed once.
+func RegisteredTables() []string {
+	registry.Lock()
+	defer registry.Unlock()
+
+	tables := make([]string, 0, len(registry.tables))
+	for t := range registry.tables {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+
+	return tables
+}
+
+// tables returns the names of the tables st uses.
+func (st *CQLStore) tables() []string {
+	tables := []string{st.table}
+	if st.recentBuckets > 0 {
+		tables = append(tables, st.recentTable())
+	}
+	if st.userKey != nil {
+		tables = append(tables, st.userTable())
+	}
+	return tables
+}
@@ -0,0 +1,22 @@
+package cqlstore
+
+import "testing"
+
+func TestRegisteredTables(t *testing.T) {
+	for _, table := range []string{"registry_a", "registry_b"} {
+		if _, err := newStore(newFakeDB(), table, WithUserIndex("user")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	registered := make(map[string]bool)
+	for _, table := range RegisteredTables() {
+		registered[table] = true
+	}
+
+	for _, table := range []string{"registry_a", "registry_b", "registry_a_by_user", "registry_b_by_user"} {
+		if !registered[table] {
+			t.Errorf("expected %s to be registered", table)
+		}
+	}
+}
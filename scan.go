@@ -0,0 +1,183 @@
+package cqlstore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/sessions"
+)
+
+// DeleteWhere deletes every session whose values match pred and returns how
+// many were deleted. It is meant for finding sessions by something only stored
+// in their encrypted data, such as all sessions of a user who asked to be
+// forgotten. Every session in the table is loaded and decoded to test it, so
+// it is very expensive on large tables and should be run as a maintenance
+// task. Sessions that can not be decoded are left in place and once the rest
+// have been tested DeleteWhere returns an error saying how many there were,
+// wrapping the first decoding error.
+//
+// Decoding needs the name of each session, so the store must be created with
+// WithNameInKey or WithSessionName. Sessions are deleted like a Save with a
+// negative MaxAge so AfterDelete is called for each.
+func (st *CQLStore) DeleteWhere(pred func(values map[interface{}]interface{}) bool) (int, error) {
+	if st.readOnly {
+		return 0, saveError{ErrReadOnly}
+	}
+	if st.hashedKey {
+		return 0, errors.New("DeleteWhere does not support WithHashedKey")
+	}
+	if !st.nameInKey && st.sessionName == "" {
+		return 0, errors.New("DeleteWhere requires WithNameInKey or WithSessionName")
+	}
+
+	var id string
+	name := st.sessionName
+	cols := `"id"`
+	dest := []interface{}{&id}
+	if st.nameInKey {
+		cols += `, "name"`
+		dest = append(dest, &name)
+	}
+
+	ctx := st.queryContext()
+	n, undecodable := 0, 0
+	var decodeErr error
+	iter := st.query(ctx, `SELECT `+cols+` FROM "`+st.table+`"`).Iter()
+	for iter.Scan(dest...) {
+		r, err := st.load(ctx, id, name)
+		if err == gocql.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			iter.Close()
+			return n, loadError{err}
+		}
+
+		values := make(map[interface{}]interface{})
+		if err := st.decodeRow(name, r, &values); err != nil {
+			if undecodable == 0 {
+				decodeErr = err
+			}
+			undecodable++
+			continue
+		}
+		if !pred(values) {
+			continue
+		}
+
+		s := sessions.NewSession(st, name)
+		s.ID = id
+		s.Values = values
+		s.Options.MaxAge = -1
+		if err := st.persist(ctx, nil, s); err != nil {
+			iter.Close()
+			return n, err
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return n, loadError{err}
+	}
+	if undecodable > 0 {
+		return n, loadError{fmt.Errorf("%d sessions could not be decoded: %w", undecodable, decodeErr)}
+	}
+
+	return n, nil
+}
+
+// DeleteAllConfirmation must be passed to DeleteAll for it to run.
+const DeleteAllConfirmation = "DELETE-ALL-SESSIONS"
+
+// ErrNotConfirmed is returned by DeleteAll when it is not passed
+// DeleteAllConfirmation.
+var ErrNotConfirmed = errors.New("DeleteAll was not confirmed")
+
+// DeleteAll deletes every session in the table, logging everyone out, and
+// returns how many rows were deleted. To guard against calling it by mistake
+// confirm must be DeleteAllConfirmation, otherwise nothing is deleted and
+// ErrNotConfirmed is returned. Rows are deleted one at a time so the tables of
+// WithClusteringByUpdatedAt and WithUserIndex are cleaned up too. AfterDelete
+// is called for each row with a session holding its ID and name but no
+// values, as they are not loaded to keep DeleteAll from needing the keys of
+// every session. The name is only known with WithNameInKey or
+// WithSessionName, and with WithHashedKey the ID is the hashed key.
+func (st *CQLStore) DeleteAll(confirm string) (int, error) {
+	if confirm != DeleteAllConfirmation {
+		return 0, ErrNotConfirmed
+	}
+	if st.readOnly {
+		return 0, saveError{ErrReadOnly}
+	}
+
+	var id string
+	name := st.sessionName
+	cols := `"id"`
+	dest := []interface{}{&id}
+	if st.nameInKey {
+		cols += `, "name"`
+		dest = append(dest, &name)
+	}
+
+	ctx := st.queryContext()
+	n := 0
+	iter := st.query(ctx, `SELECT `+cols+` FROM "`+st.table+`"`).Iter()
+	for iter.Scan(dest...) {
+		var err error
+		if st.hashedKey {
+			// The id column already holds the hash
+			err = st.rowQuery(ctx, id, `DELETE FROM "`+st.table+`" WHERE "id" = ?`, id).Exec()
+		} else {
+			err = st.delete(ctx, id, name)
+		}
+		if err != nil {
+			iter.Close()
+			return n, saveError{err}
+		}
+		st.deleted.Add(1)
+		if st.AfterDelete != nil {
+			s := sessions.NewSession(st, name)
+			s.ID = id
+			s.Options.MaxAge = -1
+			st.AfterDelete(s)
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return n, loadError{err}
+	}
+
+	if st.userKey != nil {
+		if _, err := st.ReconcileUserIndex(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// ListSessions returns the IDs of a page of up to limit sessions, for paging
+// through them in admin tools. Pass a nil pageToken for the first page and the
+// returned nextToken for the following ones. nextToken is empty after the
+// last page. Pages come in token order, not the order sessions were saved,
+// and a page may have fewer than limit IDs even when more follow. With
+// WithHashedKey the hashed keys are returned instead of the IDs.
+func (st *CQLStore) ListSessions(pageToken []byte, limit int) (ids []string, nextToken []byte, err error) {
+	if limit < 1 {
+		return nil, nil, errors.New("ListSessions limit must be positive")
+	}
+
+	q := st.db.Query(st.tag(`SELECT DISTINCT "id" FROM "` + st.table + `"`)).PageSize(limit).PageState(pageToken)
+	iter := st.wrap(st.queryContext(), q).Iter()
+	nextToken = iter.PageState()
+
+	var id string
+	for iter.Scan(&id) {
+		ids = append(ids, id)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, nil, loadError{err}
+	}
+
+	return ids, nextToken, nil
+}
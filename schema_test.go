@@ -0,0 +1,128 @@
+package cqlstore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTableNameIsAlwaysQuoted(t *testing.T) {
+	db := newFakeDB()
+	store, err := newStore(db, "token", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	sess, _ := store.New(r, "test-sess")
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	store.load(store.queryContext(), sess.ID, "test-sess")
+	store.delete(store.queryContext(), sess.ID, "test-sess")
+
+	unquoted := regexp.MustCompile(`(?i)(TABLE IF NOT EXISTS|FROM|INTO|UPDATE) token\b`)
+	for _, stmt := range db.statements() {
+		if !strings.Contains(stmt, `"token"`) || unquoted.MatchString(stmt) {
+			t.Errorf("expected the table name to be quoted in %q", stmt)
+		}
+	}
+}
+
+func TestSchemaDDLMatchesNew(t *testing.T) {
+	opts := []Option{
+		WithKeyPairs(testKeys...),
+		WithBinaryData(),
+		WithClusteringByUpdatedAt(4),
+		WithUserIndex("user"),
+		WithAbsoluteTimeout(time.Hour),
+	}
+
+	ddl, err := SchemaDDL("sessions", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := newFakeDB()
+	if _, err := newStore(db, "sessions", opts...); err != nil {
+		t.Fatal(err)
+	}
+
+	stmts := db.statements()
+	if n := strings.Count(ddl, ";"); n != len(stmts) {
+		t.Errorf("expected %d statements, got %d in %q", len(stmts), n, ddl)
+	}
+	for _, stmt := range stmts {
+		if !strings.Contains(ddl, strings.TrimSpace(stmt)+";") {
+			t.Errorf("expected the DDL to contain %q", stmt)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if err := ValidateConfig("sessions", WithKeyPairs(testKeys...)); err != nil {
+		t.Errorf("expected a valid config to pass, got %v", err)
+	}
+
+	err := ValidateConfig("bad-table;", WithKeyPairs([]byte("too short"), nil))
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey, got %v", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "Invalid table name") {
+		t.Errorf("expected the table name to be reported, got %v", err)
+	}
+
+	err = ValidateConfig("sessions", WithKeyPairs(testKeys...), WithMaxSessionsPerUser(3))
+	if err == nil || !strings.Contains(err.Error(), "WithUserIndex") {
+		t.Errorf("expected Options that do not combine to be reported, got %v", err)
+	}
+}
+
+func TestAutoMigrate(t *testing.T) {
+	db := newFakeDB()
+	db.fail = func(stmt string, args []interface{}) error {
+		if strings.HasSuffix(stmt, "ADD version int") {
+			return errors.New("Invalid column name version because it conflicts with an existing column")
+		}
+		return nil
+	}
+	_, err := newStore(db, "sessions",
+		WithKeyPairs(testKeys...),
+		WithOptimisticLocking(),
+		WithAbsoluteTimeout(time.Hour),
+		WithAutoMigrate(),
+	)
+	if err != nil {
+		t.Fatalf("expected existing columns to be skipped, got %v", err)
+	}
+
+	var alters []string
+	for _, stmt := range db.statements() {
+		if strings.HasPrefix(stmt, "ALTER") {
+			alters = append(alters, stmt)
+		}
+	}
+	want := []string{
+		`ALTER TABLE "sessions" ADD version int`,
+		`ALTER TABLE "sessions" ADD created_at timestamp`,
+	}
+	if !reflect.DeepEqual(want, alters) {
+		t.Errorf("expected %q, got %q", want, alters)
+	}
+
+	db.fail = func(stmt string, args []interface{}) error {
+		if strings.HasPrefix(stmt, "ALTER") {
+			return errors.New("Unauthorized")
+		}
+		return nil
+	}
+	_, err = newStore(db, "sessions", WithKeyPairs(testKeys...), WithOptimisticLocking(), WithAutoMigrate())
+	if err == nil {
+		t.Error("expected other errors to fail New")
+	}
+}
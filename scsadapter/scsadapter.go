@@ -0,0 +1,104 @@
+// Package scsadapter stores sessions of github.com/alexedwards/scs in
+// Cassandra with a cqlstore.CQLStore's gocql session and keys.
+package scsadapter
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/jcbwlkr/cqlstore"
+	"github.com/jcbwlkr/cqlstore/internal/storeq"
+)
+
+// codecName is the name the session data is encoded with.
+const codecName = "scs"
+
+// Store implements the Store interface of scs, Find, Commit and Delete. scs
+// serializes sessions itself, the store encrypts and authenticates that data
+// with the keys of the CQLStore it was made from and keeps it in its own
+// table keyed by the scs token.
+type Store struct {
+	st    *cqlstore.CQLStore
+	table string
+	now   func() time.Time
+}
+
+// New creates a Store using the gocql session and keys of st, creating the
+// table if it does not exist unless st was created with WithReadOnlyStore.
+// Queries are run like st's own, with Options such as WithQueryTag and
+// WithCircuitBreaker applied. Data is encoded with st's Codecs so it expires
+// with them, after the MaxAge of st's Options, even if scs allows a longer
+// lifetime.
+func New(st *cqlstore.CQLStore, table string) (*Store, error) {
+	if !cqlstore.ValidName(table) {
+		return nil, errors.New("Invalid table name " + table)
+	}
+
+	if !storeq.ReadOnly(st) {
+		err := storeq.New(st, "", `
+		CREATE TABLE IF NOT EXISTS "`+table+`" (
+			token text,
+			data text,
+			expiry timestamp,
+			PRIMARY KEY (token)
+		)`).Exec()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Store{st: st, table: table, now: time.Now}, nil
+}
+
+// Find returns the data of the session with the given token. found is false
+// if the session does not exist, has expired or can not be decoded.
+func (s *Store) Find(token string) (b []byte, found bool, err error) {
+	var data string
+	var expiry time.Time
+	err = storeq.New(s.st, token, `SELECT "data", "expiry" FROM "`+s.table+`" WHERE "token" = ?`, token).Scan(&data, &expiry)
+	if err == gocql.ErrNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if !s.now().Before(expiry) {
+		return nil, false, nil
+	}
+
+	if err := s.st.Decode(codecName, data, &b); err != nil {
+		return nil, false, nil
+	}
+	return b, true, nil
+}
+
+// Commit saves the data of the session with the given token until expiry. It
+// returns cqlstore.ErrReadOnly if the CQLStore is read only.
+func (s *Store) Commit(token string, b []byte, expiry time.Time) error {
+	if storeq.ReadOnly(s.st) {
+		return cqlstore.ErrReadOnly
+	}
+	ttl := int(math.Ceil(expiry.Sub(s.now()).Seconds()))
+	if ttl <= 0 {
+		return s.Delete(token)
+	}
+
+	data, err := s.st.Encode(codecName, b)
+	if err != nil {
+		return err
+	}
+	return storeq.New(s.st, token, `INSERT INTO "`+s.table+`" ("token", "data", "expiry") VALUES(?, ?, ?) USING TTL ?`,
+		token, data, expiry, ttl).Exec()
+}
+
+// Delete removes the session with the given token. Deleting a session that
+// does not exist is not an error. It returns cqlstore.ErrReadOnly if the
+// CQLStore is read only.
+func (s *Store) Delete(token string) error {
+	if storeq.ReadOnly(s.st) {
+		return cqlstore.ErrReadOnly
+	}
+	return storeq.New(s.st, token, `DELETE FROM "`+s.table+`" WHERE "token" = ?`, token).Exec()
+}
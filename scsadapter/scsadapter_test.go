@@ -0,0 +1,102 @@
+package scsadapter_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/jcbwlkr/cqlstore"
+	"github.com/jcbwlkr/cqlstore/scsadapter"
+)
+
+var testKeys = [][]byte{[]byte("0123456789abcdef0123456789abcdef"), nil}
+
+// newStore connects to the cluster named by CQLSTORE_URL and
+// CQLSTORE_KEYSPACE and returns an adapter using a fresh keyspace. The
+// keyspace name gets a _scs suffix so running these tests alongside those of
+// cqlstore does not drop its keyspace.
+func newStore(t *testing.T) *scsadapter.Store {
+	url := os.Getenv("CQLSTORE_URL")
+	keyspace := os.Getenv("CQLSTORE_KEYSPACE")
+	if url == "" || keyspace == "" {
+		t.Skip("Tests require a running Cassandra instance with CQLSTORE_URL and CQLSTORE_KEYSPACE defined")
+	}
+	keyspace += "_scs"
+
+	cluster := gocql.NewCluster(url)
+	sess, err := cluster.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cqlstore.EnsureKeyspace(sess, keyspace, map[string]interface{}{
+		"class":              "SimpleStrategy",
+		"replication_factor": 1,
+	})
+	sess.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster.Keyspace = keyspace
+	dbSess, err := cluster.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dbSess.Query(`DROP KEYSPACE "` + keyspace + `"`).Exec()
+		dbSess.Close()
+	})
+
+	st, err := cqlstore.New(dbSess, "sessions", testKeys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := scsadapter.New(st, "scs_sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestStore(t *testing.T) {
+	store := newStore(t)
+
+	// Missing sessions are not found
+	if _, found, err := store.Find("missing"); err != nil || found {
+		t.Fatalf("expected a missing session to not be found, got %v, %v", found, err)
+	}
+
+	// Committed sessions are
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	b, found, err := store.Find("token")
+	if err != nil || !found || string(b) != "data" {
+		t.Fatalf("expected to find the session, got %q, %v, %v", b, found, err)
+	}
+
+	// Committing again replaces the data
+	if err := store.Commit("token", []byte("more"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if b, _, _ := store.Find("token"); string(b) != "more" {
+		t.Errorf("expected the data to be replaced, got %q", b)
+	}
+
+	// Deleted sessions are gone
+	if err := store.Delete("token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := store.Find("token"); err != nil || found {
+		t.Errorf("expected the deleted session to not be found, got %v, %v", found, err)
+	}
+
+	// Sessions committed already expired are not stored
+	if err := store.Commit("old", []byte("data"), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := store.Find("old"); found {
+		t.Error("expected an expired session to not be found")
+	}
+}
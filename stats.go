@@ -0,0 +1,29 @@
+package cqlstore
+
+// Stats counts what happened to sessions over the lifetime of a store.
+type Stats struct {
+	// Created is how many new sessions were saved for the first time.
+	Created uint64
+	// Loaded is how many sessions New loaded from a cookie.
+	Loaded uint64
+	// Saved is how many times sessions were saved, including Created.
+	Saved uint64
+	// Deleted is how many sessions were deleted by saving them with a
+	// negative MaxAge, Logout, DeleteWhere, DeleteAll or DeleteBatch, or
+	// evicted by WithMaxSessionsPerUser or WithGlobalMaxSessions.
+	Deleted uint64
+	// DecodeFailures is the same as DecodeFailures.
+	DecodeFailures uint64
+}
+
+// Stats returns the store's lifecycle counters. They are always kept and
+// only cost an atomic increment each.
+func (st *CQLStore) Stats() Stats {
+	return Stats{
+		Created:        st.created.Load(),
+		Loaded:         st.loaded.Load(),
+		Saved:          st.saved.Load(),
+		Deleted:        st.deleted.Load(),
+		DecodeFailures: st.decodeFailures.Load(),
+	}
+}
@@ -0,0 +1,53 @@
+package cqlstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	store, err := newStore(newFakeDB(), "sessions", WithKeyPairs(testKeys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create two sessions
+	var cookies []*http.Cookie
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		sess, _ := store.New(r, "test-sess")
+		w := httptest.NewRecorder()
+		if err := sess.Save(r, w); err != nil {
+			t.Fatal(err)
+		}
+		cookies = append(cookies, (&http.Response{Header: w.Header()}).Cookies()...)
+	}
+
+	// Load the first, save it again and delete the second
+	r, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	r.AddCookie(cookies[0])
+	sess, err := store.New(r, "test-sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ = http.NewRequest("GET", "http://www.example.com/", nil)
+	r.AddCookie(cookies[1])
+	if err := store.Logout(r, httptest.NewRecorder(), "test-sess"); err != nil {
+		t.Fatal(err)
+	}
+
+	// And fail to decode a cookie
+	r, _ = http.NewRequest("GET", "http://www.example.com/", nil)
+	r.AddCookie(&http.Cookie{Name: "test-sess", Value: "garbage"})
+	store.New(r, "test-sess")
+
+	want := Stats{Created: 2, Loaded: 2, Saved: 3, Deleted: 1, DecodeFailures: 1}
+	if got := store.Stats(); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,126 @@
+package cqlstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/sessions"
+)
+
+// userTable is the name of the table maintained by WithUserIndex.
+func (st *CQLStore) userTable() string {
+	return st.table + "_by_user"
+}
+
+// userOf returns the user s belongs to or "" if it is not indexed.
+func (st *CQLStore) userOf(s *sessions.Session) string {
+	if st.userKey == nil {
+		return ""
+	}
+	v, ok := s.Values[st.userKey]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// indexUser records s in the user index as saved at now and enforces
+// WithMaxSessionsPerUser.
+func (st *CQLStore) indexUser(ctx context.Context, s *sessions.Session, now time.Time, ttl int) error {
+	user := st.userOf(s)
+	if user == "" {
+		return nil
+	}
+
+	err := st.query(ctx, `INSERT INTO "`+st.userTable()+`" ("user_id", "id", "updated_at") VALUES(?, ?, ?) USING TTL ?`,
+		user, s.ID, now, ttl).Exec()
+	if err != nil {
+		return err
+	}
+
+	if st.maxPerUser == 0 {
+		return nil
+	}
+
+	iter := st.query(ctx, `SELECT "id", "updated_at" FROM "`+st.userTable()+`" WHERE "user_id" = ?`, user).Iter()
+	var all []RecentSession
+	var rs RecentSession
+	for iter.Scan(&rs.ID, &rs.UpdatedAt) {
+		all = append(all, rs)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	if len(all) <= st.maxPerUser {
+		return nil
+	}
+
+	// Newest first so everything past the limit gets evicted
+	sort.Sort(byUpdatedAt(all))
+	for _, old := range all[st.maxPerUser:] {
+		if err := st.evict(ctx, old.ID, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexUser removes s from the user index.
+func (st *CQLStore) unindexUser(ctx context.Context, s *sessions.Session) error {
+	user := st.userOf(s)
+	if user == "" {
+		return nil
+	}
+	return st.deleteUserEntry(ctx, user, s.ID)
+}
+
+// deleteUserEntry removes the index entry for session id of user.
+func (st *CQLStore) deleteUserEntry(ctx context.Context, user, id string) error {
+	return st.query(ctx, `DELETE FROM "`+st.userTable()+`" WHERE "user_id" = ? AND "id" = ?`, user, id).Exec()
+}
+
+// ReconcileUserIndex removes entries of the WithUserIndex table whose session
+// no longer exists and returns how many were removed. Entries normally expire
+// with their session but can be left behind if the two get out of step, for
+// example when rows are deleted outside of the store. It reads the whole index
+// so it should be run as a maintenance task.
+func (st *CQLStore) ReconcileUserIndex() (int, error) {
+	if st.userKey == nil {
+		return 0, errors.New("ReconcileUserIndex requires the WithUserIndex option")
+	}
+	if st.readOnly {
+		return 0, saveError{ErrReadOnly}
+	}
+
+	ctx := st.queryContext()
+	n := 0
+	var user, id string
+	iter := st.query(ctx, `SELECT "user_id", "id" FROM "`+st.userTable()+`"`).Iter()
+	for iter.Scan(&user, &id) {
+		var found string
+		where, args := st.where(id, "")
+		err := st.rowQuery(ctx, id, `SELECT "id" FROM "`+st.table+`" WHERE `+where+` LIMIT 1`, args...).Scan(&found)
+		if err == nil {
+			continue
+		}
+		if err == gocql.ErrNotFound {
+			err = st.deleteUserEntry(ctx, user, id)
+		}
+		if err != nil {
+			iter.Close()
+			return n, err
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}